@@ -0,0 +1,96 @@
+// Package audit records security events so they can be reviewed later
+package audit
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Types of events
+const (
+	Signup         = "signup"
+	Login          = "login"
+	Logout         = "logout"
+	TokenRefresh   = "token_refresh"
+	TokenRevoke    = "token_revoke"
+	ProfileUpdate  = "profile_update"
+	PasswordChange = "password_change"
+	PasswordReset  = "password_reset"
+	AccountLocked  = "account_locked"
+	AdminAction    = "admin_action"
+)
+
+// Outcomes of events
+const (
+	Success = "success"
+	Failure = "failure"
+)
+
+// Event is a security event
+type Event struct {
+	Type    string    `json:"type" bson:"type"`
+	Time    time.Time `json:"time" bson:"time"`
+	Outcome string    `json:"outcome" bson:"outcome"`
+	// Actor is who caused the event, e.g. the admin acting on a user
+	Actor string `json:"actor,omitempty" bson:"actor,omitempty"`
+	// Subject is the user the event is about, or the identifier they
+	// tried to log in with if there is no such user
+	Subject   string `json:"subject,omitempty" bson:"subject,omitempty"`
+	OrgID     string `json:"org_id,omitempty" bson:"org_id,omitempty"`
+	IP        string `json:"ip,omitempty" bson:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty" bson:"user_agent,omitempty"`
+	// Reason explains failures
+	Reason  string            `json:"reason,omitempty" bson:"reason,omitempty"`
+	Details map[string]string `json:"details,omitempty" bson:"details,omitempty"`
+}
+
+// AuditSink records events
+type AuditSink interface {
+	RecordEvent(event *Event) error
+}
+
+// Query selects the events returned by AuditLog.FindEvents. Empty fields
+// match every event.
+type Query struct {
+	Type    string
+	Outcome string
+	Actor   string
+	Subject string
+	Since   time.Time
+	Until   time.Time
+	Skip    int
+	Limit   int
+}
+
+// Matches reports whether event is selected by q, ignoring Skip and Limit
+func (q Query) Matches(event *Event) bool {
+	return (q.Type == "" || event.Type == q.Type) &&
+		(q.Outcome == "" || event.Outcome == q.Outcome) &&
+		(q.Actor == "" || event.Actor == q.Actor) &&
+		(q.Subject == "" || event.Subject == q.Subject) &&
+		(q.Since.IsZero() || !event.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || event.Time.Before(q.Until))
+}
+
+// AuditLog is an AuditSink that can be searched
+type AuditLog interface {
+	AuditSink
+	// FindEvents returns a page of the events matching q, newest first,
+	// along with the number of events matching it
+	FindEvents(q Query) ([]Event, int, error)
+}
+
+// LogSink writes events to the log. It is used when no other sink is
+// configured.
+type LogSink struct{}
+
+// RecordEvent logs the event
+func (LogSink) RecordEvent(event *Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	log.Printf("audit: %s\n", b)
+	return nil
+}
@@ -0,0 +1,121 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryMatches(t *testing.T) {
+	now := time.Now()
+	event := &Event{Type: Login, Time: now, Outcome: Failure, Actor: "admin@example.com", Subject: "spankie@example.com"}
+	tests := []struct {
+		name    string
+		query   Query
+		matches bool
+	}{
+		{name: "empty", query: Query{}, matches: true},
+		{name: "type", query: Query{Type: Login}, matches: true},
+		{name: "other type", query: Query{Type: Logout}, matches: false},
+		{name: "outcome", query: Query{Outcome: Failure}, matches: true},
+		{name: "other outcome", query: Query{Outcome: Success}, matches: false},
+		{name: "actor", query: Query{Actor: "admin@example.com"}, matches: true},
+		{name: "other actor", query: Query{Actor: "spankie@example.com"}, matches: false},
+		{name: "subject", query: Query{Subject: "spankie@example.com"}, matches: true},
+		{name: "other subject", query: Query{Subject: "admin@example.com"}, matches: false},
+		{name: "since is inclusive", query: Query{Since: now}, matches: true},
+		{name: "since after", query: Query{Since: now.Add(time.Second)}, matches: false},
+		{name: "until is exclusive", query: Query{Until: now}, matches: false},
+		{name: "until after", query: Query{Until: now.Add(time.Second)}, matches: true},
+		{name: "all fields", query: Query{Type: Login, Outcome: Failure, Subject: "spankie@example.com", Since: now.Add(-time.Hour), Until: now.Add(time.Hour)}, matches: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.matches, tt.query.Matches(event))
+		})
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().UTC().Truncate(time.Second)
+	events := []*Event{
+		{Type: Login, Time: start, Outcome: Success, Subject: "a@example.com"},
+		{Type: Login, Time: start.Add(time.Second), Outcome: Failure, Subject: "b@example.com", Reason: "wrong password"},
+		{Type: Logout, Time: start.Add(2 * time.Second), Outcome: Success, Subject: "a@example.com"},
+		{Type: Login, Time: start.Add(3 * time.Second), Outcome: Success, Subject: "b@example.com", Details: map[string]string{"method": "password"}},
+	}
+	for _, event := range events {
+		assert.NoError(t, sink.RecordEvent(event))
+	}
+	assert.NoError(t, sink.Close())
+
+	// events are kept when the file is opened again
+	sink, err = NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	tests := []struct {
+		name    string
+		query   Query
+		indexes []int
+		total   int
+	}{
+		{name: "newest first", query: Query{}, indexes: []int{3, 2, 1, 0}, total: 4},
+		{name: "type", query: Query{Type: Login}, indexes: []int{3, 1, 0}, total: 3},
+		{name: "subject", query: Query{Subject: "b@example.com"}, indexes: []int{3, 1}, total: 2},
+		{name: "page", query: Query{Skip: 1, Limit: 2}, indexes: []int{2, 1}, total: 4},
+		{name: "past the end", query: Query{Skip: 4}, indexes: []int{}, total: 4},
+		{name: "no match", query: Query{Type: PasswordReset}, indexes: []int{}, total: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, total, err := sink.FindEvents(tt.query)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.total, total)
+			want := []Event{}
+			for _, i := range tt.indexes {
+				want = append(want, *events[i])
+			}
+			if len(found) == 0 {
+				found = []Event{}
+			}
+			assert.Equal(t, want, found)
+		})
+	}
+}
+
+func TestFileSinkRejectsCorruptLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	if err := ioutil.WriteFile(path, []byte("not json\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	_, _, err = sink.FindEvents(Query{})
+	assert.Error(t, err)
+}
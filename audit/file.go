@@ -0,0 +1,85 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// FileSink appends events to a file as JSON lines
+type FileSink struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// NewFileSink opens the file at path for appending, creating it if needed
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{path: path, file: file}, nil
+}
+
+// RecordEvent implements AuditSink
+func (f *FileSink) RecordEvent(event *Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err = f.file.Write(append(b, '\n'))
+	return err
+}
+
+// FindEvents implements AuditLog by reading the whole file, so it is only
+// suitable for small logs
+func (f *FileSink) FindEvents(q Query) ([]Event, int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	var matches []Event
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		event := Event{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, 0, err
+		}
+		if q.Matches(&event) {
+			matches = append(matches, event)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// the file is oldest first
+	for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+		matches[i], matches[j] = matches[j], matches[i]
+	}
+	total := len(matches)
+	if q.Skip >= total {
+		return []Event{}, total, nil
+	}
+	matches = matches[q.Skip:]
+	if q.Limit > 0 && q.Limit < len(matches) {
+		matches = matches[:q.Limit]
+	}
+	return matches, total, nil
+}
+
+// Close closes the file
+func (f *FileSink) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
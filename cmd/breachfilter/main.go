@@ -0,0 +1,63 @@
+// Command breachfilter builds the bloom filter of breached passwords used
+// by the password policy from a list of SHA-1 hashes, like the ones
+// downloaded from Have I Been Pwned.
+//
+// Usage:
+//
+//	go run ./cmd/breachfilter -in pwned-passwords-sha1.txt -out breached.bloom
+package main
+
+import (
+	"bufio"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/spankie/go-auth/passwords"
+)
+
+func main() {
+	in := flag.String("in", "", "file with one hex SHA-1 hash per line")
+	out := flag.String("out", "breached.bloom", "where to write the filter")
+	fpRate := flag.Float64("fp", 0.001, "false positive rate of the filter")
+	flag.Parse()
+	if *in == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	list, err := os.Open(*in)
+	if err != nil {
+		log.Fatalf("open hash list: %v", err)
+	}
+	defer list.Close()
+
+	count, err := passwords.CountHashList(bufio.NewReader(list))
+	if err != nil {
+		log.Fatalf("read hash list: %v", err)
+	}
+	if _, err := list.Seek(0, 0); err != nil {
+		log.Fatalf("rewind hash list: %v", err)
+	}
+
+	filter := passwords.NewBloomFilter(count, *fpRate)
+	if _, err := filter.AddHashList(bufio.NewReader(list)); err != nil {
+		log.Fatalf("read hash list: %v", err)
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		log.Fatalf("create filter file: %v", err)
+	}
+	w := bufio.NewWriter(file)
+	if _, err := filter.WriteTo(w); err != nil {
+		log.Fatalf("write filter: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("write filter: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		log.Fatalf("write filter: %v", err)
+	}
+	log.Printf("wrote %d hashes to %s\n", count, *out)
+}
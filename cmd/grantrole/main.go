@@ -0,0 +1,39 @@
+// Command grantrole sets the roles of a user, e.g. to create the first
+// admin.
+//
+// Usage:
+//
+//	go run ./cmd/grantrole -email admin@example.com -roles user,admin
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spankie/go-auth/db"
+	"github.com/spankie/go-auth/servererrors"
+)
+
+func main() {
+	email := flag.String("email", "", "email of the user")
+	roles := flag.String("roles", "", "comma separated roles to give the user")
+	flag.Parse()
+	if *email == "" || *roles == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	DB := &db.MongoDB{}
+	DB.Init()
+	user, err := DB.FindUserByEmail(*email)
+	if _, inactive := err.(servererrors.InActiveUserError); err != nil && !inactive {
+		log.Fatalf("find user: %v", err)
+	}
+	user.Roles = strings.Split(*roles, ",")
+	if err := DB.UpdateUser(user); err != nil {
+		log.Fatalf("update user: %v", err)
+	}
+	log.Printf("%s now has the roles %s\n", user.Email, strings.Join(user.Roles, ", "))
+}
@@ -0,0 +1,64 @@
+// Command migratephones converts the phone numbers of existing users to the
+// E.164 format used since login by phone was added, so that those users
+// can log in with their phone number. Numbers in the national format are
+// converted with DEFAULT_PHONE_COUNTRY_CODE, which must be set.
+//
+// Usage:
+//
+//	DEFAULT_PHONE_COUNTRY_CODE=234 go run ./cmd/migratephones [-dry-run]
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/spankie/go-auth/db"
+	"github.com/spankie/go-auth/services"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "only print the changes")
+	flag.Parse()
+	if os.Getenv("DEFAULT_PHONE_COUNTRY_CODE") == "" {
+		log.Fatalf("DEFAULT_PHONE_COUNTRY_CODE must be set")
+	}
+
+	DB := &db.MongoDB{}
+	DB.Init()
+	users := DB.DB.C("user")
+	iter := users.Find(bson.M{"phone": bson.M{"$exists": true, "$not": bson.RegEx{Pattern: `^\+[1-9][0-9]{6,14}$`}}}).
+		Select(bson.M{"phone": 1, "email": 1}).Iter()
+	user := &struct {
+		ID    bson.ObjectId `bson:"_id"`
+		Email string        `bson:"email"`
+		Phone string        `bson:"phone"`
+	}{}
+	migrated, failed := 0, 0
+	for iter.Next(user) {
+		phone, err := services.NormalizePhone(user.Phone)
+		if err != nil {
+			log.Printf("%s: can't convert %q: %v\n", user.Email, user.Phone, err)
+			failed++
+			continue
+		}
+		// two users may have written the same number differently
+		if n, err := users.Find(bson.M{"phone": phone}).Count(); err != nil || n > 0 {
+			log.Printf("%s: %s is already used by another user\n", user.Email, phone)
+			failed++
+			continue
+		}
+		log.Printf("%s: %q -> %s\n", user.Email, user.Phone, phone)
+		if !*dryRun {
+			if err := users.UpdateId(user.ID, bson.M{"$set": bson.M{"phone": phone}}); err != nil {
+				log.Fatalf("update %s: %v", user.Email, err)
+			}
+		}
+		migrated++
+	}
+	if err := iter.Close(); err != nil {
+		log.Fatalf("find users: %v", err)
+	}
+	log.Printf("converted %d phone numbers, %d need fixing by hand\n", migrated, failed)
+}
@@ -0,0 +1,46 @@
+package db
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"github.com/spankie/go-auth/audit"
+)
+
+// RecordEvent saves an audit event, so MongoDB can be used as an
+// audit.AuditLog
+func (mdb *MongoDB) RecordEvent(event *audit.Event) error {
+	return mdb.DB.C("audit").Insert(event)
+}
+
+// FindEvents returns a page of the audit events matching q, newest first
+func (mdb *MongoDB) FindEvents(q audit.Query) ([]audit.Event, int, error) {
+	query := bson.M{}
+	for field, value := range map[string]string{
+		"type":    q.Type,
+		"outcome": q.Outcome,
+		"actor":   q.Actor,
+		"subject": q.Subject,
+	} {
+		if value != "" {
+			query[field] = value
+		}
+	}
+	if !q.Since.IsZero() || !q.Until.IsZero() {
+		between := bson.M{}
+		if !q.Since.IsZero() {
+			between["$gte"] = q.Since
+		}
+		if !q.Until.IsZero() {
+			between["$lt"] = q.Until
+		}
+		query["time"] = between
+	}
+
+	find := mdb.DB.C("audit").Find(query)
+	total, err := find.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+	events := []audit.Event{}
+	err = find.Sort("-time").Skip(q.Skip).Limit(q.Limit).All(&events)
+	return events, total, err
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/spankie/go-auth/models"
+)
+
+// CreateClient registers a new OAuth client
+func (mdb *MongoDB) CreateClient(client *models.Client) (*models.Client, error) {
+	client.ID = bson.NewObjectId()
+	client.CreatedAt = time.Now()
+	err := mdb.DB.C("client").Insert(client)
+	return client, err
+}
+
+// FindClientByID finds an OAuth client by ID
+func (mdb *MongoDB) FindClientByID(id string) (*models.Client, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+	client := &models.Client{}
+	err := mdb.DB.C("client").FindId(bson.ObjectIdHex(id)).One(client)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// ensureAuthorizationCodeIndexes makes mongo remove authorization codes an
+// hour after they expire
+func (mdb *MongoDB) ensureAuthorizationCodeIndexes() error {
+	c := mdb.DB.C("authorization_code")
+	if err := c.EnsureIndex(mgo.Index{Key: []string{"code_hash"}, Unique: true}); err != nil {
+		return err
+	}
+	return c.EnsureIndex(mgo.Index{Key: []string{"expires_at"}, ExpireAfter: time.Hour})
+}
+
+// CreateAuthorizationCode saves a new authorization code
+func (mdb *MongoDB) CreateAuthorizationCode(code *models.AuthorizationCode) (*models.AuthorizationCode, error) {
+	code.ID = bson.NewObjectId()
+	err := mdb.DB.C("authorization_code").Insert(code)
+	return code, err
+}
+
+// ConsumeAuthorizationCode marks the unexpired authorization code with the
+// hash codeHash issued to the client with the ID clientID as used and
+// returns it. A code can only be consumed once, and other clients can't
+// use it up.
+func (mdb *MongoDB) ConsumeAuthorizationCode(codeHash, clientID string) (*models.AuthorizationCode, error) {
+	if !bson.IsObjectIdHex(clientID) {
+		return nil, ErrInvalidID
+	}
+	code := &models.AuthorizationCode{}
+	now := time.Now()
+	_, err := mdb.DB.C("authorization_code").Find(bson.M{
+		"code_hash":  codeHash,
+		"client_id":  bson.ObjectIdHex(clientID),
+		"used_at":    bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": now},
+	}).Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"used_at": now}},
+		ReturnNew: true,
+	}, code)
+	if err != nil {
+		return nil, err
+	}
+	return code, nil
+}
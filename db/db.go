@@ -1,7 +1,9 @@
 package db
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/spankie/go-auth/models"
 )
@@ -15,9 +17,58 @@ type DB interface {
 	AddToBlackList(blacklist *models.Blacklist) error
 	TokenInBlacklist(token *string) bool
 	FindUserByPhone(phone string) (*models.User, error)
-	FindAllUsersExcept(except string) ([]models.User, error)
+	FindOrgUsersExcept(orgID, except string) ([]models.User, error)
+	IncrementFailedLogins(email string) (int, error)
+	LockUser(email string, until time.Time) error
+	ResetFailedLogins(email string) error
+	FindUserByResetToken(reset string) (*models.User, error)
+	FindUsers(filter UserFilter) ([]models.User, int, error)
+	FindUserByID(id string) (*models.User, error)
+	SetUserStatus(id, status string) error
+	RevokeUserTokens(id string, before time.Time) error
+	DeleteUser(id string) error
+	CreateOrganization(org *models.Organization) (*models.Organization, error)
+	FindOrganizationByID(id string) (*models.Organization, error)
+	AddMembership(userID string, membership models.Membership) error
+	RemoveMembership(userID, orgID string) error
+	CreateInvitation(invitation *models.Invitation) (*models.Invitation, error)
+	FindInvitationByID(id string) (*models.Invitation, error)
+	FindPendingInvitations(orgID string) ([]models.Invitation, error)
+	SetInvitationStatus(id, status string) error
+	ReleaseInvitation(id string) error
+	CreateGroup(group *models.Group) (*models.Group, error)
+	FindGroupByID(id string) (*models.Group, error)
+	FindOrgGroups(orgID string) ([]models.Group, error)
+	AddGroupMember(groupID, userID string) error
+	RemoveGroupMember(groupID, userID string) error
+	DeleteGroup(id string) error
+	CreateSession(session *models.Session) (*models.Session, error)
+	FindSessionByID(id string) (*models.Session, error)
+	FindUserSessions(userID string) ([]models.Session, error)
+	TouchSession(id string, seen time.Time, ip string) error
+	RevokeSession(id string) error
+	RevokeUserSessions(userID string) error
+	CreateClient(client *models.Client) (*models.Client, error)
+	FindClientByID(id string) (*models.Client, error)
+	CreateAuthorizationCode(code *models.AuthorizationCode) (*models.AuthorizationCode, error)
+	ConsumeAuthorizationCode(codeHash, clientID string) (*models.AuthorizationCode, error)
 }
 
+// UserFilter selects the users returned by FindUsers
+type UserFilter struct {
+	// Status only returns users with that status if set
+	Status string
+	// Search matches the start of the username, email, phone or names
+	Search string
+	// OrgID only returns members of the organization if set
+	OrgID string
+	Skip  int
+	Limit int
+}
+
+// ErrInvalidID is returned when an ID isn't a valid object ID
+var ErrInvalidID = errors.New("invalid id")
+
 // ValidationError defines error that occur due to validation
 type ValidationError struct {
 	Field   string `json:"field"`
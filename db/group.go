@@ -0,0 +1,64 @@
+package db
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/spankie/go-auth/models"
+)
+
+// CreateGroup saves a new group
+func (mdb *MongoDB) CreateGroup(group *models.Group) (*models.Group, error) {
+	group.ID = bson.NewObjectId()
+	group.CreatedAt = time.Now()
+	err := mdb.DB.C("group").Insert(group)
+	return group, err
+}
+
+// FindGroupByID finds a group by ID
+func (mdb *MongoDB) FindGroupByID(id string) (*models.Group, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+	group := &models.Group{}
+	err := mdb.DB.C("group").FindId(bson.ObjectIdHex(id)).One(group)
+	if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// FindOrgGroups returns the groups of the organization with the hex ID
+// orgID
+func (mdb *MongoDB) FindOrgGroups(orgID string) ([]models.Group, error) {
+	if !bson.IsObjectIdHex(orgID) {
+		return nil, ErrInvalidID
+	}
+	var groups []models.Group
+	err := mdb.DB.C("group").Find(bson.M{"org_id": bson.ObjectIdHex(orgID)}).Sort("name").All(&groups)
+	return groups, err
+}
+
+// AddGroupMember adds the user with the hex ID userID to a group
+func (mdb *MongoDB) AddGroupMember(groupID, userID string) error {
+	if !bson.IsObjectIdHex(groupID) || !bson.IsObjectIdHex(userID) {
+		return ErrInvalidID
+	}
+	return mdb.DB.C("group").UpdateId(bson.ObjectIdHex(groupID), bson.M{"$addToSet": bson.M{"members": bson.ObjectIdHex(userID)}})
+}
+
+// RemoveGroupMember removes the user with the hex ID userID from a group
+func (mdb *MongoDB) RemoveGroupMember(groupID, userID string) error {
+	if !bson.IsObjectIdHex(groupID) || !bson.IsObjectIdHex(userID) {
+		return ErrInvalidID
+	}
+	return mdb.DB.C("group").UpdateId(bson.ObjectIdHex(groupID), bson.M{"$pull": bson.M{"members": bson.ObjectIdHex(userID)}})
+}
+
+// DeleteGroup deletes a group
+func (mdb *MongoDB) DeleteGroup(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidID
+	}
+	return mdb.DB.C("group").RemoveId(bson.ObjectIdHex(id))
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"regexp"
 	"time"
 
 	"github.com/globalsign/mgo"
@@ -24,52 +25,87 @@ func (mdb *MongoDB) Init() {
 		panic(errors.Wrap(err, "Unable to connect to Mongo database"))
 	}
 	mdb.DB = DBSession.DB(dbname)
+	if err := mdb.ensureRateLimitIndexes(); err != nil {
+		panic(errors.Wrap(err, "Unable to create rate limit indexes"))
+	}
+	if err := mdb.ensureSessionIndexes(); err != nil {
+		panic(errors.Wrap(err, "Unable to create session indexes"))
+	}
+	if err := mdb.ensureAuthorizationCodeIndexes(); err != nil {
+		panic(errors.Wrap(err, "Unable to create authorization code indexes"))
+	}
+	if err := mdb.DB.C("audit").EnsureIndexKey("-time"); err != nil {
+		panic(errors.Wrap(err, "Unable to create audit indexes"))
+	}
 }
 
 // CreateUser creates a new user in the DB
 func (mdb *MongoDB) CreateUser(user *models.User) (*models.User, error) {
-	_, err := mdb.FindUserByEmail(user.Email)
-	if err == nil {
+	if _, err := mdb.FindUserByEmail(user.Email); userExists(err) {
 		return user, ValidationError{Field: "email", Message: "already in use"}
 	}
-	_, err = mdb.FindUserByUsername(user.Username)
-	if err == nil {
+	if _, err := mdb.FindUserByUsername(user.Username); userExists(err) {
 		return user, ValidationError{Field: "username", Message: "already in use"}
 	}
-	_, err = mdb.FindUserByPhone(user.Phone)
-	if err == nil {
+	if _, err := mdb.FindUserByPhone(user.Phone); userExists(err) {
 		return user, ValidationError{Field: "phone", Message: "already in use"}
 	}
+	user.ID = bson.NewObjectId()
 	user.CreatedAt = time.Now()
-	err = mdb.DB.C("user").Insert(user)
+	err := mdb.DB.C("user").Insert(user)
 	return user, err
 }
 
-// FindUserByUsername finds a user by the username
+// userExists reports whether the error returned by one of the FindUserBy
+// methods means a user was found, even if it is inactive
+func userExists(err error) bool {
+	if err == nil {
+		return true
+	}
+	_, inactive := err.(servererrors.InActiveUserError)
+	return inactive
+}
+
+// FindUserByUsername finds a user by the username.
+// Inactive users are returned along with an InActiveUserError
 func (mdb *MongoDB) FindUserByUsername(username string) (*models.User, error) {
 	user := &models.User{}
-	err := mdb.DB.C("user").Find(bson.M{"username": username}).One(user)
-	if user.Status != "active" {
-		return nil, servererrors.NewInActiveUserError("user is inactive")
+	err := mdb.DB.C("user").Find(bson.M{"username": caseInsensitive(username)}).One(user)
+	if err != nil {
+		return nil, err
 	}
-	return user, err
+	if !user.IsActive() {
+		return user, servererrors.NewInActiveUserError("user is inactive")
+	}
+	return user, nil
 }
 
-// FindUserByEmail finds a user by email
+// FindUserByEmail finds a user by email.
+// Inactive users are returned along with an InActiveUserError
 func (mdb *MongoDB) FindUserByEmail(email string) (*models.User, error) {
 	user := &models.User{}
-	err := mdb.DB.C("user").Find(bson.M{"email": email}).One(user)
-	if user.Status != "active" {
-		return nil, servererrors.NewInActiveUserError("user is inactive")
+	err := mdb.DB.C("user").Find(bson.M{"email": caseInsensitive(email)}).One(user)
+	if err != nil {
+		return nil, err
 	}
-	return user, err
+	if !user.IsActive() {
+		return user, servererrors.NewInActiveUserError("user is inactive")
+	}
+	return user, nil
 }
 
-// FindUserByPhone finds a user by the phone
+// FindUserByPhone finds a user by the phone.
+// Inactive users are returned along with an InActiveUserError
 func (mdb MongoDB) FindUserByPhone(phone string) (*models.User, error) {
 	user := &models.User{}
 	err := mdb.DB.C("user").Find(bson.M{"phone": phone}).One(user)
-	return user, err
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsActive() {
+		return user, servererrors.NewInActiveUserError("user is inactive")
+	}
+	return user, nil
 }
 
 // UpdateUser updates user in the collection
@@ -93,9 +129,155 @@ func (mdb *MongoDB) TokenInBlacklist(token *string) bool {
 	return true
 }
 
-// FindAllUsersExcept returns all the users expcept the one specified in the except parameter
-func (mdb *MongoDB) FindAllUsersExcept(except string) ([]models.User, error) {
+// FindOrgUsersExcept returns the members of the organization with the
+// hex ID orgID except the one specified in the except parameter
+func (mdb *MongoDB) FindOrgUsersExcept(orgID, except string) ([]models.User, error) {
+	if !bson.IsObjectIdHex(orgID) {
+		return nil, ErrInvalidID
+	}
 	var users []models.User
-	err := mdb.DB.C("user").Find(bson.M{"email": bson.M{"$ne": except}}).All(&users)
+	err := mdb.DB.C("user").Find(bson.M{
+		"email":              bson.M{"$ne": except},
+		"memberships.org_id": bson.ObjectIdHex(orgID),
+	}).All(&users)
 	return users, err
 }
+
+// caseInsensitive returns a query that matches value exactly, ignoring case
+func caseInsensitive(value string) bson.RegEx {
+	return bson.RegEx{Pattern: "^" + regexp.QuoteMeta(value) + "$", Options: "i"}
+}
+
+// IncrementFailedLogins adds one to the failed logins of the user with the
+// email and returns the new count
+func (mdb *MongoDB) IncrementFailedLogins(email string) (int, error) {
+	user := &models.User{}
+	_, err := mdb.DB.C("user").Find(bson.M{"email": email}).Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"failed_logins": 1}},
+		ReturnNew: true,
+	}, user)
+	return user.FailedLogins, err
+}
+
+// LockUser locks the user with the email until until, or until its status
+// is changed if until is zero, clearing its failed logins. It returns
+// mgo.ErrNotFound if the user isn't active anymore.
+func (mdb *MongoDB) LockUser(email string, until time.Time) error {
+	update := bson.M{
+		"$set": bson.M{"status": models.StatusLocked, "failed_logins": 0, "locked_until": until, "updatedat": time.Now()},
+	}
+	if until.IsZero() {
+		update = bson.M{
+			"$set":   bson.M{"status": models.StatusLocked, "failed_logins": 0, "updatedat": time.Now()},
+			"$unset": bson.M{"locked_until": ""},
+		}
+	}
+	return mdb.DB.C("user").Update(activeUser(email), update)
+}
+
+// ResetFailedLogins clears the failed logins and any expired lock of the
+// user with the email. It returns mgo.ErrNotFound if the user isn't active
+// anymore.
+func (mdb *MongoDB) ResetFailedLogins(email string) error {
+	return mdb.DB.C("user").Update(activeUser(email), bson.M{
+		"$set":   bson.M{"status": models.StatusActive, "failed_logins": 0, "updatedat": time.Now()},
+		"$unset": bson.M{"locked_until": ""},
+	})
+}
+
+// activeUser matches the user with the email if it can log in: it's
+// active, or its lock has expired
+func activeUser(email string) bson.M {
+	return bson.M{
+		"email": email,
+		"$or": []bson.M{
+			{"status": models.StatusActive},
+			{"status": models.StatusLocked, "locked_until": bson.M{"$lte": time.Now()}},
+		},
+	}
+}
+
+// FindUserByResetToken finds the user a password reset token was issued to
+func (mdb *MongoDB) FindUserByResetToken(reset string) (*models.User, error) {
+	user := &models.User{}
+	err := mdb.DB.C("user").Find(bson.M{"reset": reset}).One(user)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// FindUsers returns a page of the users matching filter along with the
+// number of users matching it, whatever their status
+func (mdb *MongoDB) FindUsers(filter UserFilter) ([]models.User, int, error) {
+	query := bson.M{}
+	if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+	if filter.OrgID != "" {
+		if !bson.IsObjectIdHex(filter.OrgID) {
+			return nil, 0, ErrInvalidID
+		}
+		query["memberships.org_id"] = bson.ObjectIdHex(filter.OrgID)
+	}
+	if filter.Search != "" {
+		prefix := bson.RegEx{Pattern: "^" + regexp.QuoteMeta(filter.Search), Options: "i"}
+		query["$or"] = []bson.M{
+			{"username": prefix},
+			{"email": prefix},
+			{"phone": prefix},
+			{"first_name": prefix},
+			{"last_name": prefix},
+		}
+	}
+	q := mdb.DB.C("user").Find(query)
+	total, err := q.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+	var users []models.User
+	err = q.Sort("-created_at").Skip(filter.Skip).Limit(filter.Limit).All(&users)
+	return users, total, err
+}
+
+// FindUserByID finds a user by ID, whatever their status
+func (mdb *MongoDB) FindUserByID(id string) (*models.User, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+	user := &models.User{}
+	err := mdb.DB.C("user").FindId(bson.ObjectIdHex(id)).One(user)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// SetUserStatus changes the status of a user, clearing any lockout
+func (mdb *MongoDB) SetUserStatus(id, status string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidID
+	}
+	return mdb.DB.C("user").UpdateId(bson.ObjectIdHex(id), bson.M{
+		"$set":   bson.M{"status": status, "failed_logins": 0, "updatedat": time.Now()},
+		"$unset": bson.M{"locked_until": ""},
+	})
+}
+
+// RevokeUserTokens invalidates the tokens of a user issued before before
+func (mdb *MongoDB) RevokeUserTokens(id string, before time.Time) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidID
+	}
+	return mdb.DB.C("user").UpdateId(bson.ObjectIdHex(id), bson.M{
+		"$set": bson.M{"tokens_valid_after": before},
+	})
+}
+
+// DeleteUser removes a user
+func (mdb *MongoDB) DeleteUser(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidID
+	}
+	return mdb.DB.C("user").RemoveId(bson.ObjectIdHex(id))
+}
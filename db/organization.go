@@ -0,0 +1,130 @@
+package db
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/spankie/go-auth/models"
+)
+
+// CreateOrganization saves a new organization
+func (mdb *MongoDB) CreateOrganization(org *models.Organization) (*models.Organization, error) {
+	org.ID = bson.NewObjectId()
+	org.CreatedAt = time.Now()
+	err := mdb.DB.C("organization").Insert(org)
+	return org, err
+}
+
+// FindOrganizationByID finds an organization by ID
+func (mdb *MongoDB) FindOrganizationByID(id string) (*models.Organization, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+	org := &models.Organization{}
+	err := mdb.DB.C("organization").FindId(bson.ObjectIdHex(id)).One(org)
+	if err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+// AddMembership makes the user with the hex ID userID a member of an
+// organization, replacing the roles they had there if they already were
+func (mdb *MongoDB) AddMembership(userID string, membership models.Membership) error {
+	if !bson.IsObjectIdHex(userID) {
+		return ErrInvalidID
+	}
+	c := mdb.DB.C("user")
+	id := bson.ObjectIdHex(userID)
+	err := c.Update(
+		bson.M{"_id": id, "memberships.org_id": membership.OrgID},
+		bson.M{"$set": bson.M{"memberships.$.roles": membership.Roles, "updatedat": time.Now()}},
+	)
+	if err != mgo.ErrNotFound {
+		return err
+	}
+	return c.Update(
+		bson.M{"_id": id},
+		bson.M{"$push": bson.M{"memberships": membership}, "$set": bson.M{"updatedat": time.Now()}},
+	)
+}
+
+// RemoveMembership removes the user with the hex ID userID from an
+// organization and from its groups
+func (mdb *MongoDB) RemoveMembership(userID, orgID string) error {
+	if !bson.IsObjectIdHex(userID) || !bson.IsObjectIdHex(orgID) {
+		return ErrInvalidID
+	}
+	id, org := bson.ObjectIdHex(userID), bson.ObjectIdHex(orgID)
+	err := mdb.DB.C("user").UpdateId(id, bson.M{
+		"$pull": bson.M{"memberships": bson.M{"org_id": org}},
+		"$set":  bson.M{"updatedat": time.Now()},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = mdb.DB.C("group").UpdateAll(bson.M{"org_id": org}, bson.M{"$pull": bson.M{"members": id}})
+	return err
+}
+
+// CreateInvitation saves a new invitation
+func (mdb *MongoDB) CreateInvitation(invitation *models.Invitation) (*models.Invitation, error) {
+	invitation.ID = bson.NewObjectId()
+	invitation.CreatedAt = time.Now()
+	err := mdb.DB.C("invitation").Insert(invitation)
+	return invitation, err
+}
+
+// FindInvitationByID finds an invitation by ID, whatever its status
+func (mdb *MongoDB) FindInvitationByID(id string) (*models.Invitation, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+	invitation := &models.Invitation{}
+	err := mdb.DB.C("invitation").FindId(bson.ObjectIdHex(id)).One(invitation)
+	if err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+// FindPendingInvitations returns the invitations to the organization with
+// the hex ID orgID that can still be accepted
+func (mdb *MongoDB) FindPendingInvitations(orgID string) ([]models.Invitation, error) {
+	if !bson.IsObjectIdHex(orgID) {
+		return nil, ErrInvalidID
+	}
+	var invitations []models.Invitation
+	err := mdb.DB.C("invitation").Find(bson.M{
+		"org_id":     bson.ObjectIdHex(orgID),
+		"status":     models.InvitationPending,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Sort("-created_at").All(&invitations)
+	return invitations, err
+}
+
+// SetInvitationStatus changes the status of a pending invitation. It
+// returns mgo.ErrNotFound if the invitation isn't pending anymore, so an
+// invitation can only be accepted or revoked once.
+func (mdb *MongoDB) SetInvitationStatus(id, status string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidID
+	}
+	return mdb.DB.C("invitation").Update(
+		bson.M{"_id": bson.ObjectIdHex(id), "status": models.InvitationPending},
+		bson.M{"$set": bson.M{"status": status}},
+	)
+}
+
+// ReleaseInvitation makes an accepted invitation pending again, when
+// accepting it failed after it was claimed
+func (mdb *MongoDB) ReleaseInvitation(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidID
+	}
+	return mdb.DB.C("invitation").Update(
+		bson.M{"_id": bson.ObjectIdHex(id), "status": models.InvitationAccepted},
+		bson.M{"$set": bson.M{"status": models.InvitationPending}},
+	)
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"math"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+)
+
+// maxRateLimitRetries is how many times a bucket update is retried when
+// another instance updated it at the same time
+const maxRateLimitRetries = 5
+
+type rateLimitBucket struct {
+	Key       string    `bson:"_id"`
+	Tokens    float64   `bson:"tokens"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+type loginFailure struct {
+	Key         string    `bson:"_id"`
+	Count       int       `bson:"count"`
+	LastFailure time.Time `bson:"last_failure"`
+}
+
+// ensureRateLimitIndexes makes mongo remove rate limit entries nobody
+// has touched for a day
+func (mdb *MongoDB) ensureRateLimitIndexes() error {
+	err := mdb.DB.C("ratelimit").EnsureIndex(mgo.Index{Key: []string{"updated_at"}, ExpireAfter: 24 * time.Hour})
+	if err != nil {
+		return err
+	}
+	return mdb.DB.C("login_failures").EnsureIndex(mgo.Index{Key: []string{"last_failure"}, ExpireAfter: 24 * time.Hour})
+}
+
+// TakeToken takes a token from the bucket identified by key, so MongoDB
+// can be used as a ratelimit.Store shared by several instances
+func (mdb *MongoDB) TakeToken(key string, burst int, interval time.Duration) (time.Duration, error) {
+	c := mdb.DB.C("ratelimit")
+	for i := 0; i < maxRateLimitRetries; i++ {
+		now := time.Now()
+		b := &rateLimitBucket{}
+		err := c.FindId(key).One(b)
+		if err == mgo.ErrNotFound {
+			err = c.Insert(&rateLimitBucket{Key: key, Tokens: float64(burst - 1), UpdatedAt: now})
+			if mgo.IsDup(err) {
+				continue
+			}
+			return 0, err
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		tokens := math.Min(float64(burst), b.Tokens+float64(now.Sub(b.UpdatedAt))/float64(interval))
+		if tokens < 1 {
+			return time.Duration((1 - tokens) * float64(interval)), nil
+		}
+		// only update the bucket if nobody else did since we read it
+		err = c.Update(
+			bson.M{"_id": key, "updated_at": b.UpdatedAt},
+			bson.M{"$set": bson.M{"tokens": tokens - 1, "updated_at": now}},
+		)
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		return 0, err
+	}
+	return 0, errors.New("rate limit bucket is being updated concurrently")
+}
+
+// AddFailure records a failed attempt for key
+func (mdb *MongoDB) AddFailure(key string, window time.Duration) (int, error) {
+	c := mdb.DB.C("login_failures")
+	now := time.Now()
+	err := c.Remove(bson.M{"_id": key, "last_failure": bson.M{"$lt": now.Add(-window)}})
+	if err != nil && err != mgo.ErrNotFound {
+		return 0, err
+	}
+	failure := &loginFailure{}
+	_, err = c.FindId(key).Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"count": 1}, "$set": bson.M{"last_failure": now}},
+		Upsert:    true,
+		ReturnNew: true,
+	}, failure)
+	return failure.Count, err
+}
+
+// Failures returns the consecutive failures recorded for key
+func (mdb *MongoDB) Failures(key string) (int, time.Time, error) {
+	failure := &loginFailure{}
+	err := mdb.DB.C("login_failures").FindId(key).One(failure)
+	if err == mgo.ErrNotFound {
+		return 0, time.Time{}, nil
+	}
+	return failure.Count, failure.LastFailure, err
+}
+
+// ResetFailures forgets the failures recorded for key
+func (mdb *MongoDB) ResetFailures(key string) error {
+	err := mdb.DB.C("login_failures").RemoveId(key)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
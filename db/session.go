@@ -0,0 +1,83 @@
+package db
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/spankie/go-auth/models"
+)
+
+// ensureSessionIndexes makes mongo remove sessions a day after they
+// expire
+func (mdb *MongoDB) ensureSessionIndexes() error {
+	c := mdb.DB.C("session")
+	if err := c.EnsureIndexKey("user_id"); err != nil {
+		return err
+	}
+	return c.EnsureIndex(mgo.Index{Key: []string{"expires_at"}, ExpireAfter: 24 * time.Hour})
+}
+
+// CreateSession saves a new session
+func (mdb *MongoDB) CreateSession(session *models.Session) (*models.Session, error) {
+	session.ID = bson.NewObjectId()
+	err := mdb.DB.C("session").Insert(session)
+	return session, err
+}
+
+// FindSessionByID finds a session by ID, whether it is active or not
+func (mdb *MongoDB) FindSessionByID(id string) (*models.Session, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+	session := &models.Session{}
+	err := mdb.DB.C("session").FindId(bson.ObjectIdHex(id)).One(session)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// FindUserSessions returns the active sessions of the user with the hex
+// ID userID, most recently used first
+func (mdb *MongoDB) FindUserSessions(userID string) ([]models.Session, error) {
+	if !bson.IsObjectIdHex(userID) {
+		return nil, ErrInvalidID
+	}
+	var sessions []models.Session
+	err := mdb.DB.C("session").Find(bson.M{
+		"user_id":    bson.ObjectIdHex(userID),
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Sort("-last_seen_at").All(&sessions)
+	return sessions, err
+}
+
+// TouchSession records that a session was used at seen from ip
+func (mdb *MongoDB) TouchSession(id string, seen time.Time, ip string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidID
+	}
+	return mdb.DB.C("session").UpdateId(bson.ObjectIdHex(id), bson.M{"$set": bson.M{"last_seen_at": seen, "ip": ip}})
+}
+
+// RevokeSession revokes a session
+func (mdb *MongoDB) RevokeSession(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidID
+	}
+	return mdb.DB.C("session").UpdateId(bson.ObjectIdHex(id), bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+}
+
+// RevokeUserSessions revokes every active session of the user with the
+// hex ID userID
+func (mdb *MongoDB) RevokeUserSessions(userID string) error {
+	if !bson.IsObjectIdHex(userID) {
+		return ErrInvalidID
+	}
+	_, err := mdb.DB.C("session").UpdateAll(
+		bson.M{"user_id": bson.ObjectIdHex(userID), "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+	return err
+}
@@ -0,0 +1,63 @@
+// Package mailer sends emails to users
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// Mailer sends an email
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// LogMailer writes emails to the log instead of sending them.
+// It is used when no other mailer is configured.
+type LogMailer struct{}
+
+// Send logs the email
+func (LogMailer) Send(to, subject, body string) error {
+	log.Printf("email to %s: %s\n%s\n", to, subject, body)
+	return nil
+}
+
+// SMTPMailer sends emails through an SMTP server
+type SMTPMailer struct {
+	Addr string
+	Auth smtp.Auth
+	From string
+}
+
+// NewSMTPMailerFromEnv configures an SMTPMailer from the SMTP_HOST,
+// SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD and MAIL_FROM env vars
+func NewSMTPMailerFromEnv() *SMTPMailer {
+	host := os.Getenv("SMTP_HOST")
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	m := &SMTPMailer{
+		Addr: host + ":" + port,
+		From: os.Getenv("MAIL_FROM"),
+	}
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		m.Auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return m
+}
+
+// Send sends a plain text email
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+	msg := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, []byte(msg))
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"io/ioutil"
 	"log"
 	"os"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/joho/godotenv"
+	"github.com/spankie/go-auth/audit"
 	"github.com/spankie/go-auth/db"
+	"github.com/spankie/go-auth/mailer"
+	"github.com/spankie/go-auth/passwords"
 	"github.com/spankie/go-auth/router"
 	"github.com/spankie/go-auth/server"
 )
@@ -18,11 +23,76 @@ func main() {
 		}
 	}
 
+	// users sign up with phone numbers in the national format
+	if os.Getenv("DEFAULT_PHONE_COUNTRY_CODE") == "" {
+		log.Fatalf("DEFAULT_PHONE_COUNTRY_CODE must be set")
+	}
+
 	DB := &db.MongoDB{}
 	DB.Init()
 	s := &server.Server{
 		DB:     DB,
 		Router: router.NewRouter(),
 	}
+	// share rate limits between instances through mongo
+	if os.Getenv("RATE_LIMIT_STORE") == "mongo" {
+		s.RateLimitStore = DB
+	}
+	switch os.Getenv("AUDIT_SINK") {
+	case "mongo":
+		s.Audit = DB
+	case "file":
+		sink, err := audit.NewFileSink(os.Getenv("AUDIT_LOG_FILE"))
+		if err != nil {
+			log.Fatalf("couldn't open audit log: %v", err)
+		}
+		defer sink.Close()
+		s.Audit = sink
+	}
+	if os.Getenv("SMTP_HOST") != "" {
+		s.Mailer = mailer.NewSMTPMailerFromEnv()
+	}
+	s.PasswordPolicy = passwords.PolicyFromEnv()
+	if path := os.Getenv("BREACHED_PASSWORDS_FILE"); path != "" {
+		filter, err := passwords.LoadBloomFilter(path)
+		if err != nil {
+			log.Fatalf("couldn't load breached passwords: %v", err)
+		}
+		s.PasswordPolicy.Breached = filter
+	}
+	s.PasswordHasher = passwords.HasherFromEnv()
+	peppers, current, err := passwords.PeppersFromEnv()
+	if err != nil {
+		log.Fatalf("couldn't load password peppers: %v", err)
+	}
+	if peppers != nil {
+		s.PasswordHasher = &passwords.PepperedHasher{
+			Hasher:  s.PasswordHasher,
+			Peppers: peppers,
+			Current: current,
+		}
+	}
+	// ID tokens must stay valid across restarts and instances, so the key
+	// isn't generated
+	if path := os.Getenv("OIDC_SIGNING_KEY_FILE"); path != "" {
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatalf("couldn't read ID token signing key: %v", err)
+		}
+		if s.SigningKey, err = jwt.ParseRSAPrivateKeyFromPEM(pem); err != nil {
+			log.Fatalf("couldn't parse ID token signing key: %v", err)
+		}
+	} else {
+		log.Printf("OIDC_SIGNING_KEY_FILE isn't set, OpenID Connect is off\n")
+	}
+	// the issuer can't come from requests, whose host header clients
+	// control
+	if s.Issuer = os.Getenv("OIDC_ISSUER"); s.Issuer == "" {
+		if env == "release" {
+			log.Fatalf("OIDC_ISSUER must be set")
+		}
+		s.Issuer = "http://localhost:" + os.Getenv("PORT")
+		log.Printf("OIDC_ISSUER isn't set, using %s\n", s.Issuer)
+	}
 	s.Start()
 }
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// AuthorizationCode is an OAuth authorization code a client can exchange
+// once for tokens. Only the hash of the code is stored.
+type AuthorizationCode struct {
+	ID          bson.ObjectId `bson:"_id,omitempty"`
+	CodeHash    string        `bson:"code_hash"`
+	ClientID    bson.ObjectId `bson:"client_id"`
+	UserID      bson.ObjectId `bson:"user_id"`
+	OrgID       string        `bson:"org_id,omitempty"`
+	RedirectURI string        `bson:"redirect_uri"`
+	// RedirectURIGiven is set when the client sent RedirectURI in the
+	// authorization request, it must then send it again for the tokens
+	RedirectURIGiven bool      `bson:"redirect_uri_given,omitempty"`
+	Scope            string    `bson:"scope,omitempty"`
+	CodeChallenge    string    `bson:"code_challenge"`
+	Nonce            string    `bson:"nonce,omitempty"`
+	CreatedAt        time.Time `bson:"created_at"`
+	ExpiresAt        time.Time `bson:"expires_at"`
+	UsedAt           time.Time `bson:"used_at,omitempty"`
+}
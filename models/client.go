@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Client is an application registered to use the OAuth endpoints
+type Client struct {
+	ID   bson.ObjectId `json:"client_id" bson:"_id,omitempty"`
+	Name string        `json:"name" bson:"name"`
+	// Public clients, like single page and mobile apps, can't keep a
+	// secret so they have none and authenticate with PKCE alone
+	Public     bool   `json:"public" bson:"public"`
+	SecretHash string `json:"-" bson:"secret_hash,omitempty"`
+	// ResourceServer clients are APIs that accept the access tokens of this
+	// one. They can introspect every token and learn who is acting for
+	// whom, while other clients can only introspect their own tokens.
+	ResourceServer bool      `json:"resource_server" bson:"resource_server,omitempty"`
+	RedirectURIs   []string  `json:"redirect_uris" bson:"redirect_uris"`
+	CreatedAt      time.Time `json:"created_at" bson:"created_at"`
+}
+
+// HasRedirectURI reports whether uri is one of the redirect URIs of the
+// client. URIs must match exactly.
+func (c *Client) HasRedirectURI(uri string) bool {
+	for _, registered := range c.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+	return false
+}
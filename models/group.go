@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Group is a team within an organization. Its members get its roles and
+// those of the groups it is nested in.
+type Group struct {
+	ID       bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	OrgID    bson.ObjectId `json:"org_id" bson:"org_id"`
+	ParentID bson.ObjectId `json:"parent_id,omitempty" bson:"parent_id,omitempty"`
+	Name     string        `json:"name" bson:"name"`
+	Roles    []string      `json:"roles,omitempty" bson:"roles,omitempty"`
+	// Members holds the IDs of the users in the group
+	Members   []bson.ObjectId `json:"members,omitempty" bson:"members,omitempty"`
+	CreatedAt time.Time       `json:"created_at,omitempty" bson:"created_at,omitempty"`
+}
+
+// HasMember reports whether the user with the ID userID is a direct
+// member of the group
+func (g *Group) HasMember(userID bson.ObjectId) bool {
+	for _, member := range g.Members {
+		if member == userID {
+			return true
+		}
+	}
+	return false
+}
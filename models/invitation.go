@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Invitation invites someone to join an organization
+type Invitation struct {
+	ID        bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	OrgID     bson.ObjectId `json:"org_id" bson:"org_id"`
+	Email     string        `json:"email" bson:"email"`
+	Roles     []string      `json:"roles,omitempty" bson:"roles,omitempty"`
+	InvitedBy string        `json:"invited_by" bson:"invited_by"`
+	Status    string        `json:"status" bson:"status"`
+	ExpiresAt time.Time     `json:"expires_at" bson:"expires_at"`
+	CreatedAt time.Time     `json:"created_at" bson:"created_at"`
+}
+
+// Values of Invitation.Status
+const (
+	InvitationPending  = "pending"
+	InvitationAccepted = "accepted"
+	InvitationRevoked  = "revoked"
+)
+
+// IsPending reports whether the invitation can still be accepted
+func (i *Invitation) IsPending() bool {
+	return i.Status == InvitationPending && time.Now().Before(i.ExpiresAt)
+}
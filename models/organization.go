@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Organization is a customer company, its members only see each other
+type Organization struct {
+	ID        bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	Name      string        `json:"name" bson:"name" binding:"required"`
+	CreatedBy string        `json:"created_by,omitempty" bson:"created_by,omitempty"`
+	CreatedAt time.Time     `json:"created_at,omitempty" bson:"created_at,omitempty"`
+}
+
+// Membership makes a user a member of an organization, with roles that
+// only apply within it
+type Membership struct {
+	OrgID bson.ObjectId `json:"org_id" bson:"org_id"`
+	Roles []string      `json:"roles,omitempty" bson:"roles,omitempty"`
+}
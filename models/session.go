@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Session is the server side record of a login
+type Session struct {
+	ID         bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	UserID     bson.ObjectId `json:"-" bson:"user_id"`
+	Device     string        `json:"device,omitempty" bson:"device,omitempty"`
+	IP         string        `json:"ip" bson:"ip"`
+	UserAgent  string        `json:"user_agent,omitempty" bson:"user_agent,omitempty"`
+	CreatedAt  time.Time     `json:"created_at" bson:"created_at"`
+	LastSeenAt time.Time     `json:"last_seen_at" bson:"last_seen_at"`
+	ExpiresAt  time.Time     `json:"expires_at" bson:"expires_at"`
+	RevokedAt  time.Time     `json:"-" bson:"revoked_at,omitempty"`
+}
+
+// IsActive reports whether tokens issued for the session can still be used
+func (s *Session) IsActive() bool {
+	return s.RevokedAt.IsZero() && time.Now().Before(s.ExpiresAt)
+}
@@ -1,20 +1,62 @@
 package models
 
-import "time"
+import (
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
 
 // User holds a user details
 type User struct {
-	FirstName      string    `json:"first_name" bson:"first_name,omitempty" binding:"required" form:"first_name"`
-	LastName       string    `json:"last_name" bson:"last_name,omitempty" binding:"required" form:"last_name"`
-	Phone          string    `json:"phone,omitempty" bson:"phone,omitempty" binding:"required" form:"phone"`
-	Email          string    `json:"email" bson:"email,omitempty" binding:"required,email" form:"email"`
-	Username       string    `json:"username" bson:"username,omitempty" binding:"required" form:"username"`
-	Password       []byte    `json:"-" bson:"password,omitempty"`
-	PasswordString string    `json:"password,omitempty" bson:"-" binding:"required" form:"password"`
-	Reset          string    `json:"-" bson:"reset"`
-	Image          string    `json:"image,omitempty" bson:"image,omitempty"`
-	Status         string    `json:"status,omitempty"`
-	CreatedAt      time.Time `json:"created_at,omitempty" bson:"created_at,omitempty"`
-	UpdatedAt      time.Time `json:"updated_at,omitempty"`
-	AccessToken    string    `json:"token,omitempty" bson:"token,omitempty"`
+	ID               bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	FirstName        string        `json:"first_name" bson:"first_name,omitempty" binding:"required" form:"first_name"`
+	LastName         string        `json:"last_name" bson:"last_name,omitempty" binding:"required" form:"last_name"`
+	Phone            string        `json:"phone,omitempty" bson:"phone,omitempty" binding:"required" form:"phone"`
+	Email            string        `json:"email" bson:"email,omitempty" binding:"required,email" form:"email"`
+	Username         string        `json:"username" bson:"username,omitempty" binding:"required" form:"username"`
+	Password         []byte        `json:"-" bson:"password,omitempty"`
+	PasswordString   string        `json:"password,omitempty" bson:"-" binding:"required" form:"password"`
+	Reset            string        `json:"-" bson:"reset"`
+	ResetExpiresAt   time.Time     `json:"-" bson:"reset_expires_at,omitempty"`
+	Image            string        `json:"image,omitempty" bson:"image,omitempty"`
+	Status           string        `json:"status,omitempty"`
+	CreatedAt        time.Time     `json:"created_at,omitempty" bson:"created_at,omitempty"`
+	UpdatedAt        time.Time     `json:"updated_at,omitempty"`
+	AccessToken      string        `json:"token,omitempty" bson:"token,omitempty"`
+	FailedLogins     int           `json:"-" bson:"failed_logins"`
+	LockedUntil      time.Time     `json:"-" bson:"locked_until,omitempty"`
+	Roles            []string      `json:"roles,omitempty" bson:"roles,omitempty"`
+	Permissions      []string      `json:"permissions,omitempty" bson:"permissions,omitempty"`
+	TokensValidAfter time.Time     `json:"-" bson:"tokens_valid_after,omitempty"`
+	Memberships      []Membership  `json:"memberships,omitempty" bson:"memberships,omitempty"`
+}
+
+// Values of User.Status
+const (
+	StatusActive   = "active"
+	StatusInactive = "inactive"
+	// StatusLocked is set after too many failed logins. The lock ends at
+	// LockedUntil, or when the status is changed if LockedUntil is zero.
+	StatusLocked = "locked"
+)
+
+// IsActive reports whether the user is allowed to use their account
+func (u *User) IsActive() bool {
+	return u.Status == StatusActive || (u.Status == StatusLocked && !u.IsLocked())
+}
+
+// IsLocked reports whether the user is currently locked out
+func (u *User) IsLocked() bool {
+	return u.Status == StatusLocked && (u.LockedUntil.IsZero() || time.Now().Before(u.LockedUntil))
+}
+
+// Membership returns the membership of the user in the organization with
+// the hex ID orgID, or nil if they aren't a member
+func (u *User) Membership(orgID string) *Membership {
+	for i := range u.Memberships {
+		if u.Memberships[i].OrgID.Hex() == orgID {
+			return &u.Memberships[i]
+		}
+	}
+	return nil
 }
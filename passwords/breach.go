@@ -0,0 +1,166 @@
+package passwords
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// bloomMagic starts every bloom filter file
+const bloomMagic = "GABF"
+
+// BreachChecker reports whether a password is known to have been leaked
+type BreachChecker interface {
+	Breached(password string) bool
+}
+
+// BloomFilter is a compact, offline set of SHA-1 password hashes from
+// known breaches. It can report false positives at the rate it was built
+// with but never false negatives.
+type BloomFilter struct {
+	bits   []byte
+	m      uint64
+	hashes uint32
+}
+
+// NewBloomFilter returns an empty filter sized to hold n hashes with the
+// false positive rate fpRate
+func NewBloomFilter(n uint64, fpRate float64) *BloomFilter {
+	if n == 0 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	hashes := uint32(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+	return &BloomFilter{bits: make([]byte, (m+7)/8), m: m, hashes: hashes}
+}
+
+// Breached reports whether the SHA-1 hash of password is in the filter
+func (f *BloomFilter) Breached(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	return f.Contains(sum)
+}
+
+// Add adds a SHA-1 hash to the filter
+func (f *BloomFilter) Add(sum [sha1.Size]byte) {
+	h1, h2 := f.split(sum)
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// Contains reports whether a SHA-1 hash may have been added to the filter
+func (f *BloomFilter) Contains(sum [sha1.Size]byte) bool {
+	h1, h2 := f.split(sum)
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// split derives the two hashes used for double hashing from a SHA-1 hash,
+// which is already uniformly distributed
+func (f *BloomFilter) split(sum [sha1.Size]byte) (uint64, uint64) {
+	return binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:16]) | 1
+}
+
+// AddHashList adds every hash in r to the filter. r holds one hex encoded
+// SHA-1 hash per line, optionally followed by ":<count>" as in the Have I
+// Been Pwned downloads.
+func (f *BloomFilter) AddHashList(r io.Reader) (uint64, error) {
+	var added uint64
+	err := eachHash(r, func(sum [sha1.Size]byte) {
+		f.Add(sum)
+		added++
+	})
+	return added, err
+}
+
+// CountHashList returns the number of hashes in a hash list, so a filter
+// can be sized before the list is added to it
+func CountHashList(r io.Reader) (uint64, error) {
+	var count uint64
+	err := eachHash(r, func([sha1.Size]byte) { count++ })
+	return count, err
+}
+
+func eachHash(r io.Reader, fn func([sha1.Size]byte)) error {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(text, ':'); i >= 0 {
+			text = text[:i]
+		}
+		if text == "" {
+			continue
+		}
+		var sum [sha1.Size]byte
+		if len(text) != hex.EncodedLen(sha1.Size) {
+			return fmt.Errorf("line %d: not a SHA-1 hash", line)
+		}
+		if _, err := hex.Decode(sum[:], []byte(text)); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		fn(sum)
+	}
+	return scanner.Err()
+}
+
+// WriteTo writes the filter in the format read by ReadBloomFilter
+func (f *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	header := make([]byte, len(bloomMagic)+4+8)
+	copy(header, bloomMagic)
+	binary.BigEndian.PutUint32(header[4:], f.hashes)
+	binary.BigEndian.PutUint64(header[8:], f.m)
+	n, err := w.Write(header)
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := w.Write(f.bits)
+	return int64(n + m), err
+}
+
+// ReadBloomFilter reads a filter written by WriteTo
+func ReadBloomFilter(r io.Reader) (*BloomFilter, error) {
+	header := make([]byte, len(bloomMagic)+4+8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != bloomMagic {
+		return nil, errors.New("not a bloom filter file")
+	}
+	f := &BloomFilter{
+		hashes: binary.BigEndian.Uint32(header[4:]),
+		m:      binary.BigEndian.Uint64(header[8:]),
+	}
+	if f.hashes == 0 || f.m == 0 {
+		return nil, errors.New("invalid bloom filter header")
+	}
+	f.bits = make([]byte, (f.m+7)/8)
+	if _, err := io.ReadFull(r, f.bits); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// LoadBloomFilter reads the filter stored in the file at path
+func LoadBloomFilter(path string) (*BloomFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadBloomFilter(bufio.NewReader(file))
+}
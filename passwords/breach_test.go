@@ -0,0 +1,121 @@
+package passwords
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBloomFilter(t *testing.T) {
+	breached := []string{"password", "123456", "P@ssw0rd"}
+	f := NewBloomFilter(uint64(len(breached)), 0.001)
+	for _, password := range breached {
+		f.Add(sha1.Sum([]byte(password)))
+	}
+
+	tests := []struct {
+		password string
+		breached bool
+	}{
+		{password: "password", breached: true},
+		{password: "123456", breached: true},
+		{password: "P@ssw0rd", breached: true},
+		{password: "Password", breached: false},
+		{password: "kX9#mQ2$vL7p", breached: false},
+		{password: "", breached: false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.breached, f.Breached(tt.password), tt.password)
+	}
+}
+
+func TestBloomFilterFalsePositiveRate(t *testing.T) {
+	n := 10000
+	f := NewBloomFilter(uint64(n), 0.01)
+	for i := 0; i < n; i++ {
+		f.Add(sha1.Sum([]byte(fmt.Sprintf("breached-%d", i))))
+	}
+	falsePositives := 0
+	for i := 0; i < n; i++ {
+		if !f.Breached(fmt.Sprintf("breached-%d", i)) {
+			t.Fatalf("breached-%d isn't in the filter", i)
+		}
+		if f.Breached(fmt.Sprintf("safe-%d", i)) {
+			falsePositives++
+		}
+	}
+	// the rate is random, allow twice the rate the filter was built with
+	assert.True(t, falsePositives < n*2/100, "%d false positives", falsePositives)
+}
+
+func TestBloomFilterHashList(t *testing.T) {
+	password := fmt.Sprintf("%X", sha1.Sum([]byte("password")))
+	tests := []struct {
+		name    string
+		list    string
+		count   uint64
+		wantErr bool
+	}{
+		{name: "plain", list: password + "\n", count: 1},
+		{name: "with counts", list: password + ":3861493\r\n\n" + strings.ToLower(password) + ":1\n", count: 2},
+		{name: "empty", list: "", count: 0},
+		{name: "not a hash", list: "password\n", wantErr: true},
+		{name: "not hex", list: strings.Repeat("z", 40) + "\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			count, err := CountHashList(strings.NewReader(tt.list))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.count, count)
+
+			f := NewBloomFilter(count, 0.001)
+			added, err := f.AddHashList(strings.NewReader(tt.list))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.count, added)
+			assert.Equal(t, tt.count > 0, f.Breached("password"))
+		})
+	}
+}
+
+func TestBloomFilterFile(t *testing.T) {
+	f := NewBloomFilter(10, 0.001)
+	f.Add(sha1.Sum([]byte("password")))
+
+	dir, err := ioutil.TempDir("", "bloom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "breached.bloom")
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadBloomFilter(path)
+	assert.NoError(t, err)
+	assert.Equal(t, f, loaded)
+	assert.True(t, loaded.Breached("password"))
+
+	_, err = ReadBloomFilter(strings.NewReader("not a bloom filter"))
+	assert.Error(t, err)
+	_, err = ReadBloomFilter(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	assert.Error(t, err, "truncated")
+	header := append([]byte(bloomMagic), make([]byte, 12)...)
+	_, err = ReadBloomFilter(bytes.NewReader(header))
+	assert.Error(t, err, "empty header")
+}
@@ -0,0 +1,194 @@
+package passwords
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Names of the supported hashing algorithms
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+// ErrUnknownHash is returned when a hash wasn't made by a supported algorithm
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// PasswordHasher hashes passwords and verifies them against stored hashes
+type PasswordHasher interface {
+	// Hash returns the encoded hash of password
+	Hash(password string) ([]byte, error)
+	// Verify reports whether password matches the encoded hash
+	Verify(password string, encoded []byte) (bool, error)
+	// NeedsRehash reports whether encoded was made with another algorithm
+	// or other parameters than the ones Hash uses now
+	NeedsRehash(encoded []byte) bool
+}
+
+// Argon2Params are the parameters of argon2id
+type Argon2Params struct {
+	// Memory is in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// Hasher hashes new passwords with Algorithm, and verifies hashes made
+// by any of the supported algorithms. Hashes are stored in the PHC string
+// format (bcrypt's own format is kept for bcrypt) so they can coexist.
+type Hasher struct {
+	Algorithm  string
+	Argon2     Argon2Params
+	BcryptCost int
+}
+
+// DefaultHasher returns the hasher used when nothing is configured
+func DefaultHasher() *Hasher {
+	return &Hasher{
+		Algorithm: Argon2id,
+		Argon2: Argon2Params{
+			Memory:      64 * 1024,
+			Iterations:  3,
+			Parallelism: 2,
+			SaltLength:  16,
+			KeyLength:   32,
+		},
+		BcryptCost: bcrypt.DefaultCost,
+	}
+}
+
+// HasherFromEnv returns the default hasher updated with the
+// PASSWORD_HASH_ALGORITHM, ARGON2_MEMORY, ARGON2_ITERATIONS,
+// ARGON2_PARALLELISM and BCRYPT_COST env vars
+func HasherFromEnv() *Hasher {
+	h := DefaultHasher()
+	switch algorithm := os.Getenv("PASSWORD_HASH_ALGORITHM"); algorithm {
+	case "":
+	case Argon2id, Bcrypt:
+		h.Algorithm = algorithm
+	default:
+		log.Printf("unknown PASSWORD_HASH_ALGORITHM %s, using %s\n", algorithm, h.Algorithm)
+	}
+	var memory, iterations, parallelism int
+	envInt("ARGON2_MEMORY", &memory)
+	envInt("ARGON2_ITERATIONS", &iterations)
+	envInt("ARGON2_PARALLELISM", &parallelism)
+	if memory > 0 {
+		h.Argon2.Memory = uint32(memory)
+	}
+	if iterations > 0 {
+		h.Argon2.Iterations = uint32(iterations)
+	}
+	if parallelism > 0 && parallelism < 256 {
+		h.Argon2.Parallelism = uint8(parallelism)
+	}
+	envInt("BCRYPT_COST", &h.BcryptCost)
+	return h
+}
+
+// Hash implements PasswordHasher
+func (h *Hasher) Hash(password string) ([]byte, error) {
+	if h.Algorithm == Bcrypt {
+		return bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+	}
+
+	p := h.Argon2
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)), nil
+}
+
+// Verify implements PasswordHasher
+func (h *Hasher) Verify(password string, encoded []byte) (bool, error) {
+	switch algorithmOf(encoded) {
+	case Bcrypt:
+		err := bcrypt.CompareHashAndPassword(encoded, []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case Argon2id:
+		p, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	default:
+		return false, ErrUnknownHash
+	}
+}
+
+// NeedsRehash implements PasswordHasher
+func (h *Hasher) NeedsRehash(encoded []byte) bool {
+	algorithm := algorithmOf(encoded)
+	if algorithm != h.Algorithm {
+		return true
+	}
+	if algorithm == Bcrypt {
+		cost, err := bcrypt.Cost(encoded)
+		return err != nil || cost != h.BcryptCost
+	}
+	p, salt, _, err := decodeArgon2id(encoded)
+	return err != nil || uint32(len(salt)) != h.Argon2.SaltLength || p != h.Argon2
+}
+
+// algorithmOf returns the algorithm an encoded hash was made with
+func algorithmOf(encoded []byte) string {
+	switch {
+	case bytes.HasPrefix(encoded, []byte("$argon2id$")):
+		return Argon2id
+	case bytes.HasPrefix(encoded, []byte("$2a$")),
+		bytes.HasPrefix(encoded, []byte("$2b$")),
+		bytes.HasPrefix(encoded, []byte("$2y$")):
+		return Bcrypt
+	default:
+		return ""
+	}
+}
+
+// decodeArgon2id parses a $argon2id$v=19$m=...,t=...,p=...$salt$key hash
+func decodeArgon2id(encoded []byte) (Argon2Params, []byte, []byte, error) {
+	var p Argon2Params
+	parts := strings.Split(string(encoded), "$")
+	if len(parts) != 6 {
+		return p, nil, nil, ErrUnknownHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2 parameters: %v", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2 salt: %v", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2 key: %v", err)
+	}
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+	return p, salt, key, nil
+}
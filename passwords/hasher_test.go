@@ -0,0 +1,106 @@
+package passwords
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testHasher returns a hasher for algorithm with cheap parameters
+func testHasher(algorithm string) *Hasher {
+	h := DefaultHasher()
+	h.Algorithm = algorithm
+	h.Argon2.Memory = 64
+	h.Argon2.Iterations = 1
+	h.BcryptCost = bcrypt.MinCost
+	return h
+}
+
+func TestHasherVerify(t *testing.T) {
+	for _, algorithm := range []string{Argon2id, Bcrypt} {
+		t.Run(algorithm, func(t *testing.T) {
+			h := testHasher(algorithm)
+			hash, err := h.Hash("password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, algorithm, algorithmOf(hash))
+
+			ok, err := h.Verify("password", hash)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			ok, err = h.Verify("Password", hash)
+			assert.NoError(t, err)
+			assert.False(t, ok)
+
+			// hashes are salted
+			other, _ := h.Hash("password")
+			assert.NotEqual(t, hash, other)
+		})
+	}
+}
+
+func TestHasherVerifiesOtherAlgorithms(t *testing.T) {
+	hash, _ := testHasher(Bcrypt).Hash("password")
+	ok, err := testHasher(Argon2id).Verify("password", hash)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	hash, _ = testHasher(Argon2id).Hash("password")
+	ok, err = testHasher(Bcrypt).Verify("password", hash)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestHasherVerifyInvalidHashes(t *testing.T) {
+	h := testHasher(Argon2id)
+	tests := []string{
+		"",
+		"password",
+		"$argon2i$v=19$m=64,t=1,p=2$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=2$c2FsdA",
+		"$argon2id$v=16$m=64,t=1,p=2$c2FsdA$a2V5",
+		"$argon2id$v=19$memory$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=2$!$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=2$c2FsdA$!",
+	}
+	for _, hash := range tests {
+		ok, err := h.Verify("password", []byte(hash))
+		assert.Error(t, err, hash)
+		assert.False(t, ok, hash)
+	}
+}
+
+func TestHasherNeedsRehash(t *testing.T) {
+	argon2Hash, _ := testHasher(Argon2id).Hash("password")
+	bcryptHash, _ := testHasher(Bcrypt).Hash("password")
+
+	stronger := testHasher(Argon2id)
+	stronger.Argon2.Iterations = 2
+	longerSalt := testHasher(Argon2id)
+	longerSalt.Argon2.SaltLength = 32
+	costlier := testHasher(Bcrypt)
+	costlier.BcryptCost = bcrypt.MinCost + 1
+
+	tests := []struct {
+		name   string
+		hasher *Hasher
+		hash   []byte
+		rehash bool
+	}{
+		{name: "same argon2id parameters", hasher: testHasher(Argon2id), hash: argon2Hash, rehash: false},
+		{name: "same bcrypt cost", hasher: testHasher(Bcrypt), hash: bcryptHash, rehash: false},
+		{name: "bcrypt to argon2id", hasher: testHasher(Argon2id), hash: bcryptHash, rehash: true},
+		{name: "argon2id to bcrypt", hasher: testHasher(Bcrypt), hash: argon2Hash, rehash: true},
+		{name: "more iterations", hasher: stronger, hash: argon2Hash, rehash: true},
+		{name: "longer salt", hasher: longerSalt, hash: argon2Hash, rehash: true},
+		{name: "higher bcrypt cost", hasher: costlier, hash: bcryptHash, rehash: true},
+		{name: "unknown hash", hasher: testHasher(Argon2id), hash: []byte("password"), rehash: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.rehash, tt.hasher.NeedsRehash(tt.hash))
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package passwords
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// pepperPrefix starts hashes of peppered passwords. It is followed by the
+// version of the pepper and the hash made by the wrapped hasher, e.g.
+// $pepper$k=2$argon2id$v=19$...
+const pepperPrefix = "$pepper$k="
+
+// minPepperLength is the smallest pepper accepted, in bytes
+const minPepperLength = 16
+
+// PepperedHasher wraps a hasher so that passwords are HMACed with a
+// secret pepper, kept outside the database, before being hashed. Peppers
+// are versioned so they can be rotated: old versions are kept to verify
+// existing hashes, which are upgraded to Current when users next log in.
+type PepperedHasher struct {
+	Hasher  PasswordHasher
+	Peppers map[int][]byte
+	Current int
+}
+
+// Hash implements PasswordHasher
+func (p *PepperedHasher) Hash(password string) ([]byte, error) {
+	pepper, ok := p.Peppers[p.Current]
+	if !ok {
+		return nil, fmt.Errorf("no pepper with version %d", p.Current)
+	}
+	hash, err := p.Hasher.Hash(applyPepper(pepper, password))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(pepperPrefix+strconv.Itoa(p.Current)), hash...), nil
+}
+
+// Verify implements PasswordHasher. Hashes made before peppering was
+// enabled are verified without a pepper.
+func (p *PepperedHasher) Verify(password string, encoded []byte) (bool, error) {
+	version, inner, peppered := splitPepper(encoded)
+	if !peppered {
+		return p.Hasher.Verify(password, encoded)
+	}
+	pepper, ok := p.Peppers[version]
+	if !ok {
+		return false, fmt.Errorf("no pepper with version %d", version)
+	}
+	return p.Hasher.Verify(applyPepper(pepper, password), inner)
+}
+
+// NeedsRehash implements PasswordHasher
+func (p *PepperedHasher) NeedsRehash(encoded []byte) bool {
+	version, inner, peppered := splitPepper(encoded)
+	return !peppered || version != p.Current || p.Hasher.NeedsRehash(inner)
+}
+
+// applyPepper returns the HMAC of password keyed with pepper, base64
+// encoded so it can be handed to any hasher
+func applyPepper(pepper []byte, password string) string {
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(password))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// splitPepper returns the pepper version and wrapped hash of a peppered hash
+func splitPepper(encoded []byte) (int, []byte, bool) {
+	if !bytes.HasPrefix(encoded, []byte(pepperPrefix)) {
+		return 0, nil, false
+	}
+	rest := encoded[len(pepperPrefix):]
+	end := bytes.IndexByte(rest, '$')
+	if end < 0 {
+		return 0, nil, false
+	}
+	version, err := strconv.Atoi(string(rest[:end]))
+	if err != nil {
+		return 0, nil, false
+	}
+	return version, rest[end:], true
+}
+
+// ReadPeppers reads peppers written one per line as
+// "<version>:<base64 pepper>". Empty lines and lines starting with # are
+// ignored. It returns the peppers and the highest version.
+func ReadPeppers(r io.Reader) (map[int][]byte, int, error) {
+	peppers := make(map[int][]byte)
+	latest := 0
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 {
+			return nil, 0, fmt.Errorf("line %d: expected <version>:<pepper>", line)
+		}
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || version <= 0 {
+			return nil, 0, fmt.Errorf("line %d: invalid version", line)
+		}
+		pepper, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, 0, fmt.Errorf("line %d: pepper isn't base64: %v", line, err)
+		}
+		if len(pepper) < minPepperLength {
+			return nil, 0, fmt.Errorf("line %d: pepper should be at least %d bytes", line, minPepperLength)
+		}
+		if _, ok := peppers[version]; ok {
+			return nil, 0, fmt.Errorf("line %d: version %d is repeated", line, version)
+		}
+		peppers[version] = pepper
+		if version > latest {
+			latest = version
+		}
+	}
+	return peppers, latest, scanner.Err()
+}
+
+// PeppersFromEnv loads the peppers from the file in PASSWORD_PEPPER_FILE,
+// or from PASSWORD_PEPPERS which holds the same format separated by
+// commas. New hashes use PASSWORD_PEPPER_VERSION, or the highest version.
+// It returns no peppers if neither is set.
+func PeppersFromEnv() (map[int][]byte, int, error) {
+	var r io.Reader
+	if path := os.Getenv("PASSWORD_PEPPER_FILE"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer file.Close()
+		r = file
+	} else if peppers := os.Getenv("PASSWORD_PEPPERS"); peppers != "" {
+		r = strings.NewReader(strings.Replace(peppers, ",", "\n", -1))
+	} else {
+		return nil, 0, nil
+	}
+
+	peppers, current, err := ReadPeppers(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if v := os.Getenv("PASSWORD_PEPPER_VERSION"); v != "" {
+		if current, err = strconv.Atoi(v); err != nil {
+			return nil, 0, fmt.Errorf("invalid PASSWORD_PEPPER_VERSION: %v", err)
+		}
+	}
+	if _, ok := peppers[current]; !ok {
+		return nil, 0, fmt.Errorf("no pepper with version %d", current)
+	}
+	return peppers, current, nil
+}
@@ -0,0 +1,116 @@
+package passwords
+
+import (
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	pepper1 = []byte("0123456789abcdef")
+	pepper2 = []byte("fedcba9876543210")
+)
+
+func TestPepperedHasher(t *testing.T) {
+	inner := testHasher(Argon2id)
+	old := &PepperedHasher{Hasher: inner, Peppers: map[int][]byte{1: pepper1}, Current: 1}
+	rotated := &PepperedHasher{Hasher: inner, Peppers: map[int][]byte{1: pepper1, 2: pepper2}, Current: 2}
+
+	hash, err := old.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(string(hash), "$pepper$k=1$argon2id$"), string(hash))
+	assert.False(t, old.NeedsRehash(hash))
+
+	// the pepper is needed to verify the hash
+	ok, err := inner.Verify("password", hash[len("$pepper$k=1"):])
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// old versions keep working after a rotation but get upgraded
+	ok, err = rotated.Verify("password", hash)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, _ = rotated.Verify("Password", hash)
+	assert.False(t, ok)
+	assert.True(t, rotated.NeedsRehash(hash))
+
+	// hashes made before peppering was enabled are upgraded too
+	unpeppered, _ := inner.Hash("password")
+	ok, err = rotated.Verify("password", unpeppered)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, rotated.NeedsRehash(unpeppered))
+
+	// removed versions can't be verified
+	hash, _ = rotated.Hash("password")
+	_, err = old.Verify("password", hash)
+	assert.Error(t, err)
+	_, err = (&PepperedHasher{Hasher: inner, Peppers: map[int][]byte{1: pepper1}, Current: 3}).Hash("password")
+	assert.Error(t, err)
+}
+
+func TestReadPeppers(t *testing.T) {
+	encoded1 := base64.StdEncoding.EncodeToString(pepper1)
+	encoded2 := base64.StdEncoding.EncodeToString(pepper2)
+	tests := []struct {
+		name    string
+		file    string
+		peppers map[int][]byte
+		latest  int
+		wantErr bool
+	}{
+		{
+			name:    "versions",
+			file:    "# rotated in june\n1:" + encoded1 + "\n\n2:" + encoded2 + "\n",
+			peppers: map[int][]byte{1: pepper1, 2: pepper2},
+			latest:  2,
+		},
+		{name: "empty", file: "", peppers: map[int][]byte{}, latest: 0},
+		{name: "no version", file: encoded1, wantErr: true},
+		{name: "invalid version", file: "0:" + encoded1, wantErr: true},
+		{name: "not base64", file: "1:not base64!", wantErr: true},
+		{name: "too short", file: "1:" + base64.StdEncoding.EncodeToString([]byte("short")), wantErr: true},
+		{name: "repeated version", file: "1:" + encoded1 + "\n1:" + encoded2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peppers, latest, err := ReadPeppers(strings.NewReader(tt.file))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.peppers, peppers)
+			assert.Equal(t, tt.latest, latest)
+		})
+	}
+}
+
+func TestPeppersFromEnv(t *testing.T) {
+	peppers, current, err := PeppersFromEnv()
+	assert.NoError(t, err)
+	assert.Nil(t, peppers)
+	assert.Zero(t, current)
+
+	os.Setenv("PASSWORD_PEPPERS", "1:"+base64.StdEncoding.EncodeToString(pepper1)+",2:"+base64.StdEncoding.EncodeToString(pepper2))
+	defer os.Unsetenv("PASSWORD_PEPPERS")
+	peppers, current, err = PeppersFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, map[int][]byte{1: pepper1, 2: pepper2}, peppers)
+	assert.Equal(t, 2, current)
+
+	os.Setenv("PASSWORD_PEPPER_VERSION", "1")
+	defer os.Unsetenv("PASSWORD_PEPPER_VERSION")
+	_, current, err = PeppersFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, current)
+
+	os.Setenv("PASSWORD_PEPPER_VERSION", "3")
+	_, _, err = PeppersFromEnv()
+	assert.Error(t, err)
+}
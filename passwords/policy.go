@@ -0,0 +1,161 @@
+// Package passwords checks that passwords are good enough to be used
+package passwords
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/servererrors"
+)
+
+// Policy describes the passwords users are allowed to choose
+type Policy struct {
+	// MinLength is counted in characters
+	MinLength int
+	// MaxLength is counted in bytes, as that is what hashers limit
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// MinScore is the lowest strength score (0-4, see Score) accepted
+	MinScore int
+	// Breached rejects passwords known to have been leaked, if set
+	Breached BreachChecker
+}
+
+// DefaultPolicy returns the policy used when nothing is configured
+func DefaultPolicy() *Policy {
+	return &Policy{
+		MinLength: 8,
+		// bcrypt, which can still be configured as the hasher,
+		// ignores anything after the 72nd byte
+		MaxLength: 72,
+		MinScore:  2,
+	}
+}
+
+// PolicyFromEnv returns the default policy updated with the
+// PASSWORD_MIN_LENGTH, PASSWORD_MAX_LENGTH, PASSWORD_MIN_SCORE and
+// PASSWORD_REQUIRE (a comma separated list of upper, lower, digit and
+// symbol) env vars
+func PolicyFromEnv() *Policy {
+	p := DefaultPolicy()
+	envInt("PASSWORD_MIN_LENGTH", &p.MinLength)
+	envInt("PASSWORD_MAX_LENGTH", &p.MaxLength)
+	envInt("PASSWORD_MIN_SCORE", &p.MinScore)
+	for _, class := range strings.Split(os.Getenv("PASSWORD_REQUIRE"), ",") {
+		switch strings.TrimSpace(class) {
+		case "upper":
+			p.RequireUpper = true
+		case "lower":
+			p.RequireLower = true
+		case "digit":
+			p.RequireDigit = true
+		case "symbol":
+			p.RequireSymbol = true
+		case "":
+		default:
+			log.Printf("unknown character class in PASSWORD_REQUIRE: %s\n", class)
+		}
+	}
+	return p
+}
+
+func envInt(name string, v *int) {
+	s := os.Getenv(name)
+	if s == "" {
+		return
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		log.Printf("invalid %s: %v\n", name, err)
+		return
+	}
+	*v = n
+}
+
+// Check returns the rules password breaks for user. field is the name
+// of the request field the password came from and is used in the errors.
+func (p *Policy) Check(field, password string, user *models.User) []servererrors.FieldError {
+	// the other rules aren't checked on passwords that are too long, so
+	// that huge passwords can't be used to make scoring eat the CPU
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		return []servererrors.FieldError{servererrors.NewRuleError(field, "max", strconv.Itoa(p.MaxLength))}
+	}
+	var errs []servererrors.FieldError
+	if utf8.RuneCountInString(password) < p.MinLength {
+		errs = append(errs, servererrors.NewRuleError(field, "min", strconv.Itoa(p.MinLength)))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		errs = append(errs, servererrors.NewRuleError(field, "uppercase", ""))
+	}
+	if p.RequireLower && !lower {
+		errs = append(errs, servererrors.NewRuleError(field, "lowercase", ""))
+	}
+	if p.RequireDigit && !digit {
+		errs = append(errs, servererrors.NewRuleError(field, "digit", ""))
+	}
+	if p.RequireSymbol && !symbol {
+		errs = append(errs, servererrors.NewRuleError(field, "symbol", ""))
+	}
+
+	lowered := strings.ToLower(password)
+	userInputs := personalInputs(user)
+	if user != nil {
+		if containsInput(lowered, user.Username) {
+			errs = append(errs, servererrors.NewRuleError(field, "excludes_username", ""))
+		}
+		if containsInput(lowered, strings.SplitN(user.Email, "@", 2)[0]) {
+			errs = append(errs, servererrors.NewRuleError(field, "excludes_email", ""))
+		}
+	}
+
+	if score := Score(password, userInputs...); score < p.MinScore {
+		errs = append(errs, servererrors.NewRuleError(field, "strength", strconv.Itoa(p.MinScore)).WithValue(score))
+	}
+
+	if p.Breached != nil && p.Breached.Breached(password) {
+		errs = append(errs, servererrors.NewRuleError(field, "not_breached", ""))
+	}
+	return errs
+}
+
+// containsInput reports whether the lowercased password contains input.
+// Inputs too short to be meaningful are ignored.
+func containsInput(password, input string) bool {
+	input = strings.ToLower(input)
+	return len(input) >= 3 && strings.Contains(password, input)
+}
+
+// personalInputs returns the user details an attacker would try first
+func personalInputs(user *models.User) []string {
+	if user == nil {
+		return nil
+	}
+	return []string{
+		user.Username,
+		user.FirstName,
+		user.LastName,
+		strings.SplitN(user.Email, "@", 2)[0],
+	}
+}
@@ -0,0 +1,115 @@
+package passwords
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/servererrors"
+	"github.com/stretchr/testify/assert"
+)
+
+// breachedSet is a BreachChecker holding the passwords in it
+type breachedSet map[string]bool
+
+func (b breachedSet) Breached(password string) bool {
+	return b[password]
+}
+
+func TestPolicyCheck(t *testing.T) {
+	user := &models.User{Username: "spankie", Email: "odohi.david@gmail.com", FirstName: "Odohi", LastName: "David"}
+	tests := []struct {
+		name     string
+		policy   *Policy
+		password string
+		user     *models.User
+		errs     []servererrors.FieldError
+	}{
+		{
+			name:     "strong password",
+			policy:   DefaultPolicy(),
+			password: "kX9#mQ2$vL7p",
+		},
+		{
+			name:     "too short",
+			policy:   &Policy{MinLength: 8},
+			password: "kX9#mQ2",
+			errs:     []servererrors.FieldError{servererrors.NewRuleError("password", "min", "8")},
+		},
+		{
+			name:     "length is counted in characters",
+			policy:   &Policy{MinLength: 8},
+			password: "ééééééé",
+			errs:     []servererrors.FieldError{servererrors.NewRuleError("password", "min", "8")},
+		},
+		{
+			name:     "too long",
+			policy:   &Policy{MinLength: 100, MaxLength: 10, RequireUpper: true},
+			password: "kx9#mq2$vl7p",
+			errs:     []servererrors.FieldError{servererrors.NewRuleError("password", "max", "10")},
+		},
+		{
+			name:     "character classes",
+			policy:   &Policy{RequireUpper: true, RequireLower: true, RequireDigit: true, RequireSymbol: true},
+			password: "kxmqvlp",
+			errs: []servererrors.FieldError{
+				servererrors.NewRuleError("password", "uppercase", ""),
+				servererrors.NewRuleError("password", "digit", ""),
+				servererrors.NewRuleError("password", "symbol", ""),
+			},
+		},
+		{
+			name:     "weak",
+			policy:   DefaultPolicy(),
+			password: "P@ssw0rd",
+			errs:     []servererrors.FieldError{servererrors.NewRuleError("password", "strength", "2").WithValue(0)},
+		},
+		{
+			name:     "details of the user",
+			policy:   &Policy{},
+			password: "kX9#Spankie",
+			user:     user,
+			errs:     []servererrors.FieldError{servererrors.NewRuleError("password", "excludes_username", "")},
+		},
+		{
+			name:     "email of the user",
+			policy:   &Policy{},
+			password: "kX9#odohi.david",
+			user:     user,
+			errs:     []servererrors.FieldError{servererrors.NewRuleError("password", "excludes_email", "")},
+		},
+		{
+			name:     "breached",
+			policy:   &Policy{Breached: breachedSet{"kX9#mQ2$vL7p": true}},
+			password: "kX9#mQ2$vL7p",
+			errs:     []servererrors.FieldError{servererrors.NewRuleError("password", "not_breached", "")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.errs, tt.policy.Check("password", tt.password, tt.user))
+		})
+	}
+}
+
+func TestPolicyFromEnv(t *testing.T) {
+	env := map[string]string{
+		"PASSWORD_MIN_LENGTH": "12",
+		"PASSWORD_MAX_LENGTH": "not a number",
+		"PASSWORD_MIN_SCORE":  "3",
+		"PASSWORD_REQUIRE":    "upper, digit,unknown",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	p := PolicyFromEnv()
+	assert.Equal(t, 12, p.MinLength)
+	assert.Equal(t, DefaultPolicy().MaxLength, p.MaxLength)
+	assert.Equal(t, 3, p.MinScore)
+	assert.True(t, p.RequireUpper)
+	assert.True(t, p.RequireDigit)
+	assert.False(t, p.RequireLower)
+	assert.False(t, p.RequireSymbol)
+}
@@ -0,0 +1,252 @@
+package passwords
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// maxScoredLength is the number of runes of a password that are scored.
+// Matching patterns takes quadratic time and longer passwords are strong
+// enough anyway.
+const maxScoredLength = 128
+
+// bruteforceCardinality is the number of guesses per character not
+// covered by a known pattern, as in zxcvbn
+const bruteforceCardinality = 10
+
+// Score estimates how hard password is to guess, in the same way as
+// zxcvbn: 0 is too guessable, 1 very guessable, 2 somewhat guessable,
+// 3 safely unguessable and 4 very unguessable. userInputs are details of
+// the user, like their name, that count as words an attacker would try.
+func Score(password string, userInputs ...string) int {
+	guesses := estimateGuesses(password, userInputs)
+	switch {
+	case guesses < 1e3+5:
+		return 0
+	case guesses < 1e6+5:
+		return 1
+	case guesses < 1e8+5:
+		return 2
+	case guesses < 1e10+5:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// match is a pattern covering the runes i to j of a password
+type match struct {
+	i, j    int
+	guesses float64
+}
+
+// estimateGuesses finds the cheapest way to build password out of known
+// patterns and bruteforced characters and returns the number of guesses
+// it would take
+func estimateGuesses(password string, userInputs []string) float64 {
+	runes := []rune(password)
+	if len(runes) > maxScoredLength {
+		runes = runes[:maxScoredLength]
+	}
+	if len(runes) == 0 {
+		return 1
+	}
+	ranked := make(map[string]int, len(commonPasswords)+len(userInputs))
+	for i, word := range userInputs {
+		if word = strings.ToLower(word); len(word) >= 3 {
+			ranked[word] = i + 1
+		}
+	}
+	for i, word := range commonPasswords {
+		if _, ok := ranked[word]; !ok {
+			ranked[word] = i + 1
+		}
+	}
+
+	var matches []match
+	matches = append(matches, dictionaryMatches(runes, ranked)...)
+	matches = append(matches, repeatMatches(runes)...)
+	matches = append(matches, sequenceMatches(runes)...)
+	matches = append(matches, keyboardMatches(runes)...)
+	matches = append(matches, yearMatches(runes)...)
+
+	// best[k] is the log10 of the fewest guesses needed for the first k runes
+	best := make([]float64, len(runes)+1)
+	for k := 1; k <= len(runes); k++ {
+		best[k] = best[k-1] + math.Log10(bruteforceCardinality)
+		for _, m := range matches {
+			if m.j == k-1 {
+				best[k] = math.Min(best[k], best[m.i]+math.Log10(m.guesses))
+			}
+		}
+	}
+	return math.Pow(10, best[len(runes)])
+}
+
+var l33t = strings.NewReplacer("4", "a", "@", "a", "8", "b", "3", "e", "1", "i", "!", "i", "0", "o", "5", "s", "$", "s", "7", "t")
+
+// dictionaryMatches finds common passwords and user inputs in runes,
+// including capitalized and l33t spelled ones
+func dictionaryMatches(runes []rune, ranked map[string]int) []match {
+	var matches []match
+	for i := range runes {
+		for j := i + 2; j < len(runes); j++ {
+			word := string(runes[i : j+1])
+			lowered := strings.ToLower(word)
+			unleeted := l33t.Replace(lowered)
+			rank, ok := ranked[unleeted]
+			if !ok {
+				continue
+			}
+			guesses := float64(rank)
+			if word != lowered {
+				guesses *= uppercaseVariations(runes[i : j+1])
+			}
+			if unleeted != lowered {
+				guesses *= 2
+			}
+			matches = append(matches, match{i, j, guesses})
+		}
+	}
+	return matches
+}
+
+// uppercaseVariations returns how many capitalizations of the word an
+// attacker would try before getting to this one
+func uppercaseVariations(word []rune) float64 {
+	upper := 0
+	for _, r := range word {
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+	if upper == len(word) || (upper == 1 && unicode.IsUpper(word[0])) {
+		return 2
+	}
+	return math.Pow(2, float64(upper))
+}
+
+// repeatMatches finds runs of the same character
+func repeatMatches(runes []rune) []match {
+	var matches []match
+	for i := 0; i < len(runes); {
+		j := i
+		for j+1 < len(runes) && runes[j+1] == runes[i] {
+			j++
+		}
+		if j-i >= 2 {
+			matches = append(matches, match{i, j, cardinality(runes[i]) * float64(j-i+1)})
+		}
+		i = j + 1
+	}
+	return matches
+}
+
+// sequenceMatches finds runs like "abc", "987" or "ace"
+func sequenceMatches(runes []rune) []match {
+	var matches []match
+	for i := 0; i+2 < len(runes); {
+		delta := runes[i+1] - runes[i]
+		j := i + 1
+		for j+1 < len(runes) && runes[j+1]-runes[j] == delta {
+			j++
+		}
+		if j-i >= 2 && delta != 0 && delta >= -5 && delta <= 5 {
+			base := cardinality(runes[i])
+			if strings.ContainsRune("aAzZ019", runes[i]) {
+				base = 4
+			}
+			guesses := base * float64(j-i+1)
+			if delta < 0 {
+				guesses *= 2
+			}
+			matches = append(matches, match{i, j, guesses})
+		}
+		i = j
+	}
+	return matches
+}
+
+var keyboardRows = []string{"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./"}
+
+// keyboardMatches finds runs of keys next to each other on a keyboard
+func keyboardMatches(runes []rune) []match {
+	var matches []match
+	lowered := []rune(strings.ToLower(string(runes)))
+	for i := range lowered {
+		for j := i + 2; j < len(lowered); j++ {
+			chunk := string(lowered[i : j+1])
+			if !onKeyboardRow(chunk) {
+				break
+			}
+			matches = append(matches, match{i, j, 20 * float64(j-i+1)})
+		}
+	}
+	return matches
+}
+
+func onKeyboardRow(chunk string) bool {
+	reversed := []rune(chunk)
+	for a, b := 0, len(reversed)-1; a < b; a, b = a+1, b-1 {
+		reversed[a], reversed[b] = reversed[b], reversed[a]
+	}
+	for _, row := range keyboardRows {
+		if strings.Contains(row, chunk) || strings.Contains(row, string(reversed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// yearMatches finds recent years, which are often birth years
+func yearMatches(runes []rune) []match {
+	var matches []match
+	for i := 0; i+3 < len(runes); i++ {
+		year := string(runes[i : i+4])
+		if (strings.HasPrefix(year, "19") || strings.HasPrefix(year, "20")) && isDigits(year) {
+			matches = append(matches, match{i, i + 3, 120})
+		}
+	}
+	return matches
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func cardinality(r rune) float64 {
+	switch {
+	case unicode.IsDigit(r):
+		return 10
+	case unicode.IsLetter(r):
+		return 26
+	default:
+		return 33
+	}
+}
+
+// commonPasswords are among the most used passwords, most common first
+var commonPasswords = []string{
+	"password", "123456", "123456789", "12345678", "12345", "qwerty", "1234567",
+	"111111", "1234567890", "123123", "abc123", "1234", "password1", "iloveyou",
+	"1q2w3e4r", "000000", "qwerty123", "zaq12wsx", "dragon", "sunshine",
+	"princess", "letmein", "654321", "monkey", "27653", "1qaz2wsx", "123321",
+	"qwertyuiop", "superman", "asdfghjkl", "trustno1", "welcome", "admin",
+	"master", "football", "baseball", "shadow", "michael", "jennifer", "hunter",
+	"login", "starwars", "passw0rd", "freedom", "whatever", "qazwsx", "ninja",
+	"mustang", "access", "solo", "charlie", "donald", "batman", "flower",
+	"hottie", "loveme", "hello", "secret", "summer", "winter", "spring",
+	"autumn", "pass", "test", "guest", "root", "changeme", "default", "user",
+	"love", "god", "money", "soccer", "jordan", "harley", "ranger", "buster",
+	"thomas", "tigger", "robert", "soccer", "hockey", "killer", "george",
+	"andrew", "cheese", "matrix", "pepper", "daniel", "computer", "internet",
+	"samsung", "google", "apple", "orange", "banana", "chocolate", "cookie",
+	"purple", "silver", "golden", "blessed", "angel", "lovely", "family",
+	"friends", "forever", "nigeria", "london", "chelsea", "arsenal", "liverpool",
+}
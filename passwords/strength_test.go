@@ -0,0 +1,58 @@
+package passwords
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScore(t *testing.T) {
+	tests := []struct {
+		name       string
+		password   string
+		userInputs []string
+		score      int
+	}{
+		{name: "empty", password: "", score: 0},
+		{name: "common password", password: "password", score: 0},
+		{name: "capitalized common password", password: "Password1", score: 0},
+		{name: "l33t common password", password: "P@ssw0rd", score: 0},
+		{name: "keyboard row", password: "qwertyuiop", score: 0},
+		{name: "repeat", password: "aaaaaaaa", score: 0},
+		{name: "sequence", password: "abcdefgh", score: 0},
+		{name: "keyboard row and sequence", password: "zxcvbnm123", score: 1},
+		{name: "years", password: "19901990", score: 1},
+		{name: "random", password: "kX9#mQ2$vL7p", score: 4},
+		{name: "passphrase", password: "correct horse battery staple", score: 4},
+		{name: "names", password: "odohidavid", score: 3},
+		{name: "names of the user", password: "odohidavid", userInputs: []string{"odohi", "david"}, score: 0},
+		{name: "short user inputs are ignored", password: "kX9#mQ2$vL7p", userInputs: []string{"kX"}, score: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.score, Score(tt.password, tt.userInputs...))
+		})
+	}
+}
+
+func TestScoreOnlyScoresTheStartOfLongPasswords(t *testing.T) {
+	long := strings.Repeat("a", maxScoredLength)
+	assert.Equal(t, estimateGuesses(long, nil), estimateGuesses(long+"kX9#mQ2$vL7p", nil))
+}
+
+func TestUppercaseVariations(t *testing.T) {
+	tests := []struct {
+		word       string
+		variations float64
+	}{
+		{word: "Password", variations: 2},
+		{word: "PASSWORD", variations: 2},
+		{word: "passWord", variations: 2},
+		{word: "PassWord", variations: 4},
+		{word: "pAsSwOrD", variations: 16},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.variations, uppercaseVariations([]rune(tt.word)), tt.word)
+	}
+}
@@ -0,0 +1,215 @@
+// Package policy decides whether a subject may perform an action on a
+// resource using rules over the subject, the resource, the action and
+// the context of the request
+package policy
+
+import (
+	"strings"
+
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/rbac"
+)
+
+// Effect is what a rule does when it applies
+type Effect int
+
+// Rule effects
+const (
+	Allow Effect = iota + 1
+	Deny
+)
+
+// Request is what the engine decides on
+type Request struct {
+	// Subject is the user making the request
+	Subject *models.User
+	// Permissions are the permissions granted to the subject by its roles
+	Permissions []string
+	// OrgPermissions are the permissions granted to the subject by its
+	// roles in the organization the request is made for. They only apply
+	// to the resources of that organization.
+	OrgPermissions []string
+	Action         string
+	Resource       interface{}
+	// Context holds anything else rules may look at, e.g. the client ip
+	Context map[string]interface{}
+}
+
+// Condition is a predicate over a request
+type Condition func(r *Request) bool
+
+// Rule allows or denies actions when its condition holds
+type Rule struct {
+	Name   string
+	Effect Effect
+	// Actions the rule applies to. An action ending with "*" matches
+	// every action starting with what precedes it.
+	Actions []string
+	// When is the condition under which the rule applies, nil means always
+	When Condition
+}
+
+// applies reports whether the rule applies to r
+func (rule Rule) applies(r *Request) bool {
+	return rbac.Allowed(rule.Actions, r.Action) && (rule.When == nil || rule.When(r))
+}
+
+// Engine evaluates requests against its rules. A request is allowed if
+// at least one rule allows it and no rule denies it.
+type Engine struct {
+	Rules []Rule
+}
+
+// NewEngine returns an engine with rules
+func NewEngine(rules ...Rule) *Engine {
+	return &Engine{Rules: rules}
+}
+
+// DefaultEngine returns an engine that allows what the permissions of
+// the subject grant, and what its permissions in its organization grant
+// on the organization and its members. It lets users read their own
+// details and those of the members of their organization. Unless they may
+// act on any organization, users can't act on users outside of theirs.
+func DefaultEngine() *Engine {
+	return NewEngine(
+		Rule{Name: "permissions", Effect: Allow, Actions: []string{"*"}, When: HasPermission()},
+		Rule{Name: "organization permissions", Effect: Allow, Actions: []string{"*"}, When: And(HasOrgPermission(), SameOrganization())},
+		Rule{Name: "self", Effect: Allow, Actions: []string{rbac.UsersRead}, When: Self()},
+		Rule{Name: "organization", Effect: Allow, Actions: []string{rbac.UsersRead}, When: SameOrganization()},
+		Rule{
+			Name:    "tenant isolation",
+			Effect:  Deny,
+			Actions: []string{"users:*"},
+			When:    And(OutsideOrganization(), Not(Granted(rbac.OrgsAll))),
+		},
+	)
+}
+
+// Add appends rules to the engine
+func (e *Engine) Add(rules ...Rule) {
+	e.Rules = append(e.Rules, rules...)
+}
+
+// Evaluate decides on r and returns the name of the rule that decided,
+// which is empty when no rule applied
+func (e *Engine) Evaluate(r *Request) (bool, string) {
+	allowed, decidedBy := false, ""
+	for _, rule := range e.Rules {
+		if !rule.applies(r) {
+			continue
+		}
+		if rule.Effect == Deny {
+			return false, rule.Name
+		}
+		if !allowed {
+			allowed, decidedBy = true, rule.Name
+		}
+	}
+	return allowed, decidedBy
+}
+
+// Can reports whether r is allowed
+func (e *Engine) Can(r *Request) bool {
+	allowed, _ := e.Evaluate(r)
+	return allowed
+}
+
+// HasPermission holds when the permissions of the subject grant the action
+func HasPermission() Condition {
+	return func(r *Request) bool {
+		return rbac.Allowed(r.Permissions, r.Action)
+	}
+}
+
+// HasOrgPermission holds when the permissions of the subject in the
+// organization the request is made for grant the action
+func HasOrgPermission() Condition {
+	return func(r *Request) bool {
+		return rbac.Allowed(r.OrgPermissions, r.Action)
+	}
+}
+
+// Granted holds when the permissions of the subject grant permission,
+// whatever the action
+func Granted(permission string) Condition {
+	return func(r *Request) bool {
+		return rbac.Allowed(r.Permissions, permission)
+	}
+}
+
+// OrgID returns the organization the request is made for
+func (r *Request) OrgID() string {
+	orgID, _ := r.Context["org_id"].(string)
+	return orgID
+}
+
+// SameOrganization holds when the resource is the organization the
+// request is made for or one of its members
+func SameOrganization() Condition {
+	return func(r *Request) bool {
+		if r.OrgID() == "" {
+			return false
+		}
+		switch resource := r.Resource.(type) {
+		case *models.User:
+			return resource.Membership(r.OrgID()) != nil
+		case *models.Organization:
+			return resource.ID.Hex() == r.OrgID()
+		}
+		return false
+	}
+}
+
+// OutsideOrganization holds when the resource is an organization other
+// than the one the request is made for, or a user other than the subject
+// who isn't a member of it
+func OutsideOrganization() Condition {
+	return func(r *Request) bool {
+		switch r.Resource.(type) {
+		case *models.User:
+			return !Self()(r) && !SameOrganization()(r)
+		case *models.Organization:
+			return !SameOrganization()(r)
+		}
+		return false
+	}
+}
+
+// Self holds when the resource is the subject
+func Self() Condition {
+	return func(r *Request) bool {
+		user, ok := r.Resource.(*models.User)
+		return ok && r.Subject != nil && strings.EqualFold(user.Email, r.Subject.Email)
+	}
+}
+
+// And holds when all of conditions hold
+func And(conditions ...Condition) Condition {
+	return func(r *Request) bool {
+		for _, condition := range conditions {
+			if !condition(r) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Or holds when any of conditions holds
+func Or(conditions ...Condition) Condition {
+	return func(r *Request) bool {
+		for _, condition := range conditions {
+			if condition(r) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not holds when condition doesn't
+func Not(condition Condition) Condition {
+	return func(r *Request) bool {
+		return !condition(r)
+	}
+}
@@ -0,0 +1,147 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/rbac"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultEngine(t *testing.T) {
+	org, otherOrg := bson.NewObjectId(), bson.NewObjectId()
+	subject := &models.User{Email: "spankie@example.com", Memberships: []models.Membership{{OrgID: org}}}
+	member := &models.User{Email: "member@example.com", Memberships: []models.Membership{{OrgID: org}}}
+	outsider := &models.User{Email: "outsider@example.com", Memberships: []models.Membership{{OrgID: otherOrg}}}
+	inOrg := map[string]interface{}{"org_id": org.Hex()}
+
+	tests := []struct {
+		name      string
+		request   *Request
+		allowed   bool
+		decidedBy string
+	}{
+		{
+			name:      "own details",
+			request:   &Request{Subject: subject, Action: rbac.UsersRead, Resource: &models.User{Email: "SPANKIE@example.com"}},
+			allowed:   true,
+			decidedBy: "self",
+		},
+		{
+			name:    "managing yourself",
+			request: &Request{Subject: subject, Action: rbac.UsersManage, Resource: subject},
+			allowed: false,
+		},
+		{
+			name:      "member of the organization",
+			request:   &Request{Subject: subject, Action: rbac.UsersRead, Resource: member, Context: inOrg},
+			allowed:   true,
+			decidedBy: "organization",
+		},
+		{
+			name:      "outside of the organization",
+			request:   &Request{Subject: subject, Action: rbac.UsersRead, Resource: outsider, Context: inOrg},
+			allowed:   false,
+			decidedBy: "tenant isolation",
+		},
+		{
+			name:      "global permission outside of the organization",
+			request:   &Request{Subject: subject, Permissions: []string{"users:*"}, Action: rbac.UsersManage, Resource: outsider, Context: inOrg},
+			allowed:   false,
+			decidedBy: "tenant isolation",
+		},
+		{
+			name:      "any organization",
+			request:   &Request{Subject: subject, Permissions: []string{"*"}, Action: rbac.UsersManage, Resource: outsider, Context: inOrg},
+			allowed:   true,
+			decidedBy: "permissions",
+		},
+		{
+			name:      "organization permission on a member",
+			request:   &Request{Subject: subject, OrgPermissions: []string{"users:*"}, Action: rbac.UsersManage, Resource: member, Context: inOrg},
+			allowed:   true,
+			decidedBy: "organization permissions",
+		},
+		{
+			name:      "organization permission on an outsider",
+			request:   &Request{Subject: subject, OrgPermissions: []string{"users:*"}, Action: rbac.UsersManage, Resource: outsider, Context: inOrg},
+			allowed:   false,
+			decidedBy: "tenant isolation",
+		},
+		{
+			name:      "organization permission without an organization",
+			request:   &Request{Subject: subject, OrgPermissions: []string{"users:*"}, Action: rbac.UsersManage, Resource: member},
+			allowed:   false,
+			decidedBy: "tenant isolation",
+		},
+		{
+			name:      "organization permission on the organization",
+			request:   &Request{Subject: subject, OrgPermissions: []string{"*"}, Action: "orgs:manage", Resource: &models.Organization{ID: org}, Context: inOrg},
+			allowed:   true,
+			decidedBy: "organization permissions",
+		},
+		{
+			name:    "organization permission on another organization",
+			request: &Request{Subject: subject, OrgPermissions: []string{"*"}, Action: "orgs:manage", Resource: &models.Organization{ID: otherOrg}, Context: inOrg},
+			allowed: false,
+		},
+	}
+	engine := DefaultEngine()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, decidedBy := engine.Evaluate(tt.request)
+			assert.Equal(t, tt.allowed, allowed)
+			assert.Equal(t, tt.decidedBy, decidedBy)
+			assert.Equal(t, tt.allowed, engine.Can(tt.request))
+		})
+	}
+}
+
+func TestEngineDenyWins(t *testing.T) {
+	fromOffice := func(r *Request) bool {
+		return r.Context["ip"] == "10.0.0.1"
+	}
+	engine := NewEngine(Rule{Name: "admins", Effect: Allow, Actions: []string{"*"}, When: HasPermission()})
+	engine.Add(Rule{Name: "office only", Effect: Deny, Actions: []string{"users:*"}, When: Not(fromOffice)})
+
+	request := &Request{Permissions: []string{"*"}, Action: rbac.UsersManage, Context: map[string]interface{}{"ip": "10.0.0.1"}}
+	allowed, decidedBy := engine.Evaluate(request)
+	assert.True(t, allowed)
+	assert.Equal(t, "admins", decidedBy)
+
+	request.Context["ip"] = "203.0.113.7"
+	allowed, decidedBy = engine.Evaluate(request)
+	assert.False(t, allowed)
+	assert.Equal(t, "office only", decidedBy)
+
+	// the deny rule doesn't apply to other actions
+	request.Action = rbac.AuditRead
+	assert.True(t, engine.Can(request))
+}
+
+func TestConditions(t *testing.T) {
+	yes := func(*Request) bool { return true }
+	no := func(*Request) bool { return false }
+	tests := []struct {
+		name      string
+		condition Condition
+		holds     bool
+	}{
+		{name: "and", condition: And(yes, yes), holds: true},
+		{name: "and with one false", condition: And(yes, no), holds: false},
+		{name: "empty and", condition: And(), holds: true},
+		{name: "or", condition: Or(no, yes), holds: true},
+		{name: "or with all false", condition: Or(no, no), holds: false},
+		{name: "empty or", condition: Or(), holds: false},
+		{name: "not", condition: Not(no), holds: true},
+		{name: "granted", condition: Granted(rbac.AuditRead), holds: true},
+		{name: "not granted", condition: Granted(rbac.OrgsAll), holds: false},
+	}
+	request := &Request{Permissions: []string{"audit:*"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.holds, tt.condition(request))
+		})
+	}
+}
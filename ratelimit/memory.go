@@ -0,0 +1,117 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepEvery is the number of operations between removals of stale entries
+const sweepEvery = 1000
+
+type bucket struct {
+	tokens   float64
+	burst    int
+	interval time.Duration
+	updated  time.Time
+}
+
+type failure struct {
+	count  int
+	last   time.Time
+	window time.Duration
+}
+
+// MemoryStore is a Store that keeps token buckets in memory.
+// It is only suitable when running a single instance of the server.
+type MemoryStore struct {
+	mu       sync.Mutex
+	ops      int
+	buckets  map[string]*bucket
+	failures map[string]*failure
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:  make(map[string]*bucket),
+		failures: make(map[string]*failure),
+	}
+}
+
+// TakeToken implements Store
+func (m *MemoryStore) TakeToken(key string, burst int, interval time.Duration) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maybeSweep()
+
+	now := time.Now()
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), burst: burst, interval: interval, updated: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+float64(now.Sub(b.updated))/float64(interval))
+	b.updated = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) * float64(interval)), nil
+	}
+	b.tokens--
+	return 0, nil
+}
+
+// AddFailure implements Store
+func (m *MemoryStore) AddFailure(key string, window time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maybeSweep()
+
+	now := time.Now()
+	f, ok := m.failures[key]
+	if !ok || now.Sub(f.last) > window {
+		f = &failure{}
+		m.failures[key] = f
+	}
+	f.count++
+	f.last = now
+	f.window = window
+	return f.count, nil
+}
+
+// Failures implements Store
+func (m *MemoryStore) Failures(key string) (int, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.failures[key]; ok {
+		return f.count, f.last, nil
+	}
+	return 0, time.Time{}, nil
+}
+
+// ResetFailures implements Store
+func (m *MemoryStore) ResetFailures(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.failures, key)
+	return nil
+}
+
+// maybeSweep removes full buckets and forgotten failures every sweepEvery
+// operations so the maps don't grow forever. m.mu must be held.
+func (m *MemoryStore) maybeSweep() {
+	m.ops++
+	if m.ops%sweepEvery != 0 {
+		return
+	}
+	now := time.Now()
+	for key, b := range m.buckets {
+		if b.tokens+float64(now.Sub(b.updated))/float64(b.interval) >= float64(b.burst) {
+			delete(m.buckets, key)
+		}
+	}
+	for key, f := range m.failures {
+		if now.Sub(f.last) > f.window {
+			delete(m.failures, key)
+		}
+	}
+}
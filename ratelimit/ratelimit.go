@@ -0,0 +1,123 @@
+// Package ratelimit throttles requests with token buckets and backs off
+// exponentially on repeated failures
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Store keeps the state of the limiter so that it can be shared between
+// several instances of the server
+type Store interface {
+	// TakeToken takes a token from the bucket identified by key. Buckets
+	// hold at most burst tokens and get a new one every interval. If the
+	// bucket is empty it returns how long until a token is available.
+	TakeToken(key string, burst int, interval time.Duration) (time.Duration, error)
+	// AddFailure records a failed attempt for key and returns the number
+	// of consecutive failures. Failures older than window are forgotten.
+	AddFailure(key string, window time.Duration) (int, error)
+	// Failures returns the number of consecutive failures for key and when
+	// the last one happened
+	Failures(key string) (int, time.Time, error)
+	// ResetFailures forgets the failures recorded for key
+	ResetFailures(key string) error
+}
+
+// Limiter throttles attempts per key
+type Limiter struct {
+	Store Store
+	// Name is prepended to keys so limiters can share a store
+	Name string
+	// Burst is the number of attempts allowed at once
+	Burst int
+	// Interval is how often an extra attempt is allowed
+	Interval time.Duration
+	// FreeFailures is the number of consecutive failures allowed before
+	// backing off
+	FreeFailures int
+	// BaseDelay is the delay after the first failure past FreeFailures,
+	// it doubles with every failure after that up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// FailureWindow is how long failures are remembered
+	FailureWindow time.Duration
+}
+
+// NewLimiter returns a limiter that allows burst attempts at once and one
+// more every interval, with the default backoff settings
+func NewLimiter(store Store, name string, burst int, interval time.Duration) *Limiter {
+	return &Limiter{
+		Store:         store,
+		Name:          name,
+		Burst:         burst,
+		Interval:      interval,
+		FreeFailures:  3,
+		BaseDelay:     time.Second,
+		MaxDelay:      15 * time.Minute,
+		FailureWindow: 24 * time.Hour,
+	}
+}
+
+// Allow reports how long the caller must wait before attempting again
+// for key. A zero duration means the attempt is allowed.
+func (l *Limiter) Allow(key string) (time.Duration, error) {
+	key = l.key(key)
+	count, last, err := l.Store.Failures(key)
+	if err != nil {
+		return 0, err
+	}
+	if count > l.FreeFailures && time.Since(last) < l.FailureWindow {
+		if wait := time.Until(last.Add(l.backoff(count))); wait > 0 {
+			return wait, nil
+		}
+	}
+	return l.Store.TakeToken(key, l.Burst, l.Interval)
+}
+
+// Fail records a failed attempt for key
+func (l *Limiter) Fail(key string) error {
+	_, err := l.Store.AddFailure(l.key(key), l.FailureWindow)
+	return err
+}
+
+// Succeed clears the failures recorded for key
+func (l *Limiter) Succeed(key string) error {
+	return l.Store.ResetFailures(l.key(key))
+}
+
+// backoff returns the delay to apply after count consecutive failures
+func (l *Limiter) backoff(count int) time.Duration {
+	delay := l.BaseDelay
+	for i := l.FreeFailures + 1; i < count; i++ {
+		delay *= 2
+		if delay >= l.MaxDelay {
+			return l.MaxDelay
+		}
+	}
+	return delay
+}
+
+func (l *Limiter) key(key string) string {
+	return l.Name + ":" + key
+}
+
+// ParseRate parses rates written as "<count>/<duration>", e.g. "10/1m"
+// for ten attempts a minute, into a burst and refill interval
+func ParseRate(rate string) (int, time.Duration, error) {
+	parts := strings.SplitN(rate, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("rate %q should look like <count>/<duration>", rate)
+	}
+	count, err := strconv.Atoi(parts[0])
+	if err != nil || count <= 0 {
+		return 0, 0, fmt.Errorf("invalid count in rate %q", rate)
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return 0, 0, fmt.Errorf("invalid duration in rate %q", rate)
+	}
+	return count, period / time.Duration(count), nil
+}
@@ -0,0 +1,115 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate     string
+		burst    int
+		interval time.Duration
+		wantErr  bool
+	}{
+		{rate: "10/1m", burst: 10, interval: 6 * time.Second},
+		{rate: "5/1m", burst: 5, interval: 12 * time.Second},
+		{rate: "1/1h", burst: 1, interval: time.Hour},
+		{rate: "30/1s", burst: 30, interval: time.Second / 30},
+		{rate: "10", wantErr: true},
+		{rate: "", wantErr: true},
+		{rate: "ten/1m", wantErr: true},
+		{rate: "0/1m", wantErr: true},
+		{rate: "-1/1m", wantErr: true},
+		{rate: "10/minute", wantErr: true},
+		{rate: "10/0s", wantErr: true},
+		{rate: "10/-1m", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rate, func(t *testing.T) {
+			burst, interval, err := ParseRate(tt.rate)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.burst, burst)
+			assert.Equal(t, tt.interval, interval)
+		})
+	}
+}
+
+func TestLimiterBackoff(t *testing.T) {
+	l := NewLimiter(NewMemoryStore(), "test", 10, time.Second)
+	tests := []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{failures: 4, delay: time.Second},
+		{failures: 5, delay: 2 * time.Second},
+		{failures: 6, delay: 4 * time.Second},
+		{failures: 13, delay: 512 * time.Second},
+		{failures: 14, delay: 15 * time.Minute},
+		{failures: 100, delay: 15 * time.Minute},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.delay, l.backoff(tt.failures), "after %d failures", tt.failures)
+	}
+}
+
+func TestLimiterAllow(t *testing.T) {
+	l := NewLimiter(NewMemoryStore(), "test", 2, time.Hour)
+
+	// the burst is allowed, then callers must wait for the next token
+	for i := 0; i < 2; i++ {
+		wait, err := l.Allow("a")
+		assert.NoError(t, err)
+		assert.Zero(t, wait)
+	}
+	wait, err := l.Allow("a")
+	assert.NoError(t, err)
+	assert.True(t, wait > 0 && wait <= time.Hour, "wait %s", wait)
+
+	// keys have their own buckets
+	wait, err = l.Allow("b")
+	assert.NoError(t, err)
+	assert.Zero(t, wait)
+}
+
+func TestLimiterFailures(t *testing.T) {
+	l := NewLimiter(NewMemoryStore(), "test", 100, time.Second)
+
+	// the first failures are free
+	for i := 0; i < l.FreeFailures; i++ {
+		assert.NoError(t, l.Fail("a"))
+		wait, err := l.Allow("a")
+		assert.NoError(t, err)
+		assert.Zero(t, wait)
+	}
+	assert.NoError(t, l.Fail("a"))
+	wait, err := l.Allow("a")
+	assert.NoError(t, err)
+	assert.True(t, wait > 0 && wait <= l.BaseDelay, "wait %s", wait)
+
+	// a success starts over
+	assert.NoError(t, l.Succeed("a"))
+	wait, err = l.Allow("a")
+	assert.NoError(t, err)
+	assert.Zero(t, wait)
+}
+
+func TestMemoryStoreForgetsOldFailures(t *testing.T) {
+	m := NewMemoryStore()
+	count, err := m.AddFailure("a", time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, _ = m.AddFailure("a", time.Hour)
+	assert.Equal(t, 2, count)
+
+	// failures outside of the window start a new count
+	m.failures["a"].last = time.Now().Add(-2 * time.Hour)
+	count, _ = m.AddFailure("a", time.Hour)
+	assert.Equal(t, 1, count)
+}
@@ -0,0 +1,67 @@
+package rbac
+
+import (
+	"sync"
+	"time"
+
+	"github.com/spankie/go-auth/models"
+)
+
+// DefaultGroupCacheTTL is how long groups are cached by default. It bounds
+// how long other instances of the server take to see changes to groups.
+const DefaultGroupCacheTTL = 30 * time.Second
+
+type cachedGroups struct {
+	groups  []models.Group
+	expires time.Time
+}
+
+// GroupCache keeps the groups of organizations in memory for a while so
+// they aren't looked up on every request
+type GroupCache struct {
+	find func(orgID string) ([]models.Group, error)
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedGroups
+}
+
+// NewGroupCache returns a cache of the groups find returns, kept for ttl
+func NewGroupCache(find func(orgID string) ([]models.Group, error), ttl time.Duration) *GroupCache {
+	return &GroupCache{find: find, ttl: ttl, entries: make(map[string]cachedGroups)}
+}
+
+// Find returns the groups of the organization with the hex ID orgID
+func (gc *GroupCache) Find(orgID string) ([]models.Group, error) {
+	now := time.Now()
+	gc.mu.Lock()
+	entry, ok := gc.entries[orgID]
+	gc.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.groups, nil
+	}
+
+	groups, err := gc.find(orgID)
+	if err != nil {
+		return nil, err
+	}
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	// drop the entries that expired so the cache doesn't grow with every
+	// organization ever seen
+	for id, entry := range gc.entries {
+		if !now.Before(entry.expires) {
+			delete(gc.entries, id)
+		}
+	}
+	gc.entries[orgID] = cachedGroups{groups: groups, expires: now.Add(gc.ttl)}
+	return groups, nil
+}
+
+// Invalidate forgets the groups of the organization with the hex ID orgID,
+// to be called whenever they change
+func (gc *GroupCache) Invalidate(orgID string) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	delete(gc.entries, orgID)
+}
@@ -0,0 +1,65 @@
+package rbac
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/spankie/go-auth/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupCache(t *testing.T) {
+	lookups := map[string]int{}
+	fail := false
+	cache := NewGroupCache(func(orgID string) ([]models.Group, error) {
+		if fail {
+			return nil, errors.New("db down")
+		}
+		lookups[orgID]++
+		return []models.Group{{ID: bson.NewObjectId(), Name: orgID}}, nil
+	}, time.Minute)
+
+	first, err := cache.Find("a")
+	assert.NoError(t, err)
+	again, err := cache.Find("a")
+	assert.NoError(t, err)
+	assert.Equal(t, first, again)
+	assert.Equal(t, 1, lookups["a"])
+
+	_, _ = cache.Find("b")
+	assert.Equal(t, 1, lookups["b"])
+
+	cache.Invalidate("a")
+	changed, _ := cache.Find("a")
+	assert.Equal(t, 2, lookups["a"])
+	assert.NotEqual(t, first, changed)
+
+	// expired entries are looked up again
+	cache.entries["b"] = cachedGroups{expires: time.Now().Add(-time.Second)}
+	_, _ = cache.Find("b")
+	assert.Equal(t, 2, lookups["b"])
+
+	// errors aren't cached
+	cache.Invalidate("a")
+	fail = true
+	_, err = cache.Find("a")
+	assert.Error(t, err)
+	fail = false
+	_, err = cache.Find("a")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, lookups["a"])
+}
+
+func TestGroupCacheDropsExpiredEntries(t *testing.T) {
+	cache := NewGroupCache(func(string) ([]models.Group, error) {
+		return nil, nil
+	}, time.Minute)
+	cache.entries["old"] = cachedGroups{expires: time.Now().Add(-time.Second)}
+	_, _ = cache.Find("new")
+	_, ok := cache.entries["old"]
+	assert.False(t, ok)
+	_, ok = cache.entries["new"]
+	assert.True(t, ok)
+}
@@ -0,0 +1,98 @@
+// Package rbac maps the roles given to users to the permissions they grant
+package rbac
+
+import "strings"
+
+// Permissions checked by the API
+const (
+	UsersList   = "users:list"
+	UsersRead   = "users:read"
+	UsersManage = "users:manage"
+	// Impersonate lets admins act as another user. It is kept out of the
+	// users namespace so that managing users doesn't grant it.
+	Impersonate = "impersonation:start"
+	// AuditRead lets users search the audit log
+	AuditRead = "audit:read"
+	// ClientsManage lets users register OAuth clients
+	ClientsManage = "clients:manage"
+	// OrgsAll lets users act on users of any organization
+	OrgsAll = "orgs:all"
+)
+
+// Built in roles
+const (
+	// RoleUser is given to every user that signs up
+	RoleUser = "user"
+	// RoleAdmin can do anything
+	RoleAdmin = "admin"
+	// RoleOrgAdmin manages the users of an organization. It is given to
+	// the user who creates an organization.
+	RoleOrgAdmin = "org_admin"
+)
+
+// Roles maps role names to the permissions they grant. A permission
+// ending with "*" grants every permission starting with what precedes it.
+type Roles map[string][]string
+
+// DefaultRoles returns the built in roles
+func DefaultRoles() Roles {
+	return Roles{
+		RoleUser:     {},
+		RoleAdmin:    {"*"},
+		RoleOrgAdmin: {"users:*"},
+	}
+}
+
+// UserRoles returns roles, or the user role if there are none
+func UserRoles(roles []string) []string {
+	if len(roles) == 0 {
+		return []string{RoleUser}
+	}
+	return roles
+}
+
+// Permissions returns the permissions granted by roles along with the
+// extra permissions granted directly
+func (r Roles) Permissions(roles []string, extra ...string) []string {
+	seen := make(map[string]bool)
+	var permissions []string
+	add := func(permission string) {
+		if !seen[permission] {
+			seen[permission] = true
+			permissions = append(permissions, permission)
+		}
+	}
+	for _, role := range roles {
+		for _, permission := range r[role] {
+			add(permission)
+		}
+	}
+	for _, permission := range extra {
+		add(permission)
+	}
+	return permissions
+}
+
+// Covers reports whether the granted permissions include every one of
+// required
+func Covers(granted, required []string) bool {
+	for _, permission := range required {
+		if !Allowed(granted, permission) {
+			return false
+		}
+	}
+	return true
+}
+
+// Allowed reports whether the granted permissions include permission
+func Allowed(granted []string, permission string) bool {
+	for _, g := range granted {
+		if g == permission {
+			return true
+		}
+		if strings.HasSuffix(g, "*") && strings.HasPrefix(permission, strings.TrimSuffix(g, "*")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package rbac
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRolesPermissions(t *testing.T) {
+	roles := Roles{
+		RoleUser:     {},
+		RoleAdmin:    {"*"},
+		RoleOrgAdmin: {"users:*"},
+		"auditor":    {AuditRead, UsersRead},
+	}
+	tests := []struct {
+		name        string
+		roles       []string
+		extra       []string
+		permissions []string
+	}{
+		{name: "no roles", roles: nil, permissions: nil},
+		{name: "role without permissions", roles: []string{RoleUser}, permissions: nil},
+		{name: "unknown role", roles: []string{"owner"}, permissions: nil},
+		{name: "one role", roles: []string{"auditor"}, permissions: []string{AuditRead, UsersRead}},
+		{name: "several roles", roles: []string{RoleOrgAdmin, "auditor"}, permissions: []string{"users:*", AuditRead, UsersRead}},
+		{name: "extra permissions", roles: []string{RoleUser}, extra: []string{ClientsManage}, permissions: []string{ClientsManage}},
+		{name: "duplicates", roles: []string{"auditor", "auditor"}, extra: []string{UsersRead}, permissions: []string{AuditRead, UsersRead}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.permissions, roles.Permissions(tt.roles, tt.extra...))
+		})
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		granted    []string
+		permission string
+		allowed    bool
+	}{
+		{granted: []string{UsersRead}, permission: UsersRead, allowed: true},
+		{granted: []string{UsersRead}, permission: UsersManage, allowed: false},
+		{granted: []string{"users:*"}, permission: UsersManage, allowed: true},
+		{granted: []string{"users:*"}, permission: AuditRead, allowed: false},
+		{granted: []string{"users:*"}, permission: Impersonate, allowed: false},
+		{granted: []string{"*"}, permission: Impersonate, allowed: true},
+		{granted: nil, permission: UsersRead, allowed: false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.allowed, Allowed(tt.granted, tt.permission), "%v %s", tt.granted, tt.permission)
+	}
+}
+
+func TestCovers(t *testing.T) {
+	tests := []struct {
+		name     string
+		granted  []string
+		required []string
+		covers   bool
+	}{
+		{name: "nothing required", granted: nil, required: nil, covers: true},
+		{name: "same", granted: []string{UsersRead, AuditRead}, required: []string{AuditRead, UsersRead}, covers: true},
+		{name: "wildcard", granted: []string{"users:*"}, required: []string{UsersRead, UsersManage}, covers: true},
+		{name: "missing one", granted: []string{"users:*"}, required: []string{UsersRead, AuditRead}, covers: false},
+		{name: "wildcard isn't covered by what it grants", granted: []string{UsersRead, UsersManage}, required: []string{"users:*"}, covers: false},
+		{name: "everything", granted: []string{"*"}, required: []string{"users:*", AuditRead}, covers: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.covers, Covers(tt.granted, tt.required))
+		})
+	}
+}
+
+func TestUserRoles(t *testing.T) {
+	assert.Equal(t, []string{RoleUser}, UserRoles(nil))
+	assert.Equal(t, []string{RoleAdmin}, UserRoles([]string{RoleAdmin}))
+}
@@ -0,0 +1,69 @@
+package rbac
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"github.com/spankie/go-auth/models"
+)
+
+// Resolver computes the effective permissions of users from their roles,
+// their extra permissions and the groups they belong to
+type Resolver struct {
+	Roles Roles
+	// Groups returns the groups of an organization, usually from a
+	// GroupCache. Groups are ignored if it is nil.
+	Groups func(orgID string) ([]models.Group, error)
+}
+
+// Resolve returns the global permissions granted by roles and
+// permissions, as found in an access token
+func (r *Resolver) Resolve(roles, permissions []string) []string {
+	return r.Roles.Permissions(roles, permissions...)
+}
+
+// ResolveOrg returns the permissions granted within the organization with
+// the hex ID orgID by orgRoles, as found in an access token, along with
+// the ones user gets from the groups they belong to there. They only
+// apply to the resources of the organization.
+func (r *Resolver) ResolveOrg(user *models.User, orgID string, orgRoles []string) ([]string, error) {
+	if orgID == "" {
+		return nil, nil
+	}
+	if r.Groups != nil && user != nil {
+		groups, err := r.Groups(orgID)
+		if err != nil {
+			return nil, err
+		}
+		orgRoles = append(append([]string{}, orgRoles...), GroupRoles(groups, user.ID)...)
+	}
+	return r.Roles.Permissions(orgRoles), nil
+}
+
+// GroupRoles returns the roles of the groups the user with the ID userID
+// is a member of and of the groups those are nested in
+func GroupRoles(groups []models.Group, userID bson.ObjectId) []string {
+	var roles []string
+	for i := range groups {
+		if groups[i].HasMember(userID) {
+			roles = append(roles, InheritedRoles(groups, groups[i].ID)...)
+		}
+	}
+	return roles
+}
+
+// InheritedRoles returns the roles the members of the group with the ID
+// groupID get from it and from the groups it is nested in
+func InheritedRoles(groups []models.Group, groupID bson.ObjectId) []string {
+	byID := make(map[bson.ObjectId]*models.Group, len(groups))
+	for i := range groups {
+		byID[groups[i].ID] = &groups[i]
+	}
+
+	var roles []string
+	visited := make(map[bson.ObjectId]bool)
+	// walk up to the top level group, guarding against cycles
+	for group := byID[groupID]; group != nil && !visited[group.ID]; group = byID[group.ParentID] {
+		visited[group.ID] = true
+		roles = append(roles, group.Roles...)
+	}
+	return roles
+}
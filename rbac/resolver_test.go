@@ -0,0 +1,71 @@
+package rbac
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/spankie/go-auth/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupRoles(t *testing.T) {
+	user := bson.NewObjectId()
+	engineering := models.Group{ID: bson.NewObjectId(), Roles: []string{"engineer"}}
+	backend := models.Group{ID: bson.NewObjectId(), ParentID: engineering.ID, Roles: []string{"deployer"}, Members: []bson.ObjectId{user}}
+	sales := models.Group{ID: bson.NewObjectId(), Roles: []string{"seller"}}
+	// a and b are nested in each other
+	a := models.Group{ID: bson.NewObjectId(), Roles: []string{"a"}, Members: []bson.ObjectId{user}}
+	b := models.Group{ID: bson.NewObjectId(), ParentID: a.ID, Roles: []string{"b"}}
+	a.ParentID = b.ID
+
+	tests := []struct {
+		name   string
+		groups []models.Group
+		roles  []string
+	}{
+		{name: "no groups", groups: nil, roles: nil},
+		{name: "not a member", groups: []models.Group{engineering, sales}, roles: nil},
+		{name: "nested", groups: []models.Group{engineering, backend, sales}, roles: []string{"deployer", "engineer"}},
+		{name: "parent missing", groups: []models.Group{backend}, roles: []string{"deployer"}},
+		{name: "cycle", groups: []models.Group{a, b}, roles: []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.roles, GroupRoles(tt.groups, user))
+		})
+	}
+}
+
+func TestResolveOrg(t *testing.T) {
+	user := &models.User{ID: bson.NewObjectId()}
+	org := bson.NewObjectId().Hex()
+	groups := []models.Group{{ID: bson.NewObjectId(), Roles: []string{"auditor"}, Members: []bson.ObjectId{user.ID}}}
+	roles := Roles{RoleOrgAdmin: {"users:*"}, "auditor": {AuditRead}}
+	resolver := &Resolver{Roles: roles, Groups: func(orgID string) ([]models.Group, error) {
+		if orgID != org {
+			return nil, errors.New("unknown organization")
+		}
+		return groups, nil
+	}}
+
+	permissions, err := resolver.ResolveOrg(user, org, []string{RoleOrgAdmin})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"users:*", AuditRead}, permissions)
+
+	// the groups of other organizations don't count
+	_, err = resolver.ResolveOrg(user, bson.NewObjectId().Hex(), nil)
+	assert.Error(t, err)
+
+	permissions, err = resolver.ResolveOrg(user, "", []string{RoleOrgAdmin})
+	assert.NoError(t, err)
+	assert.Nil(t, permissions)
+
+	resolver.Groups = nil
+	permissions, err = resolver.ResolveOrg(user, org, []string{RoleOrgAdmin})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"users:*"}, permissions)
+
+	// global permissions ignore groups
+	assert.Equal(t, []string{"users:*", ClientsManage}, resolver.Resolve([]string{RoleOrgAdmin}, []string{ClientsManage}))
+}
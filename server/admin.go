@@ -0,0 +1,248 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo"
+	"github.com/spankie/go-auth/audit"
+	"github.com/spankie/go-auth/db"
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/rbac"
+	"github.com/spankie/go-auth/server/middleware"
+	"github.com/spankie/go-auth/server/response"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// auditAdminAction records an action taken by an admin on a user
+func (s *Server) auditAdminAction(c *gin.Context, action string, target *models.User) {
+	s.audit(c, &audit.Event{
+		Type:    audit.AdminAction,
+		Outcome: audit.Success,
+		Subject: target.Email,
+		Details: map[string]string{"action": action, "user_id": target.ID.Hex()},
+	})
+}
+
+// pagination reads the page and per_page query parameters, responding
+// with an error if they are invalid
+func pagination(c *gin.Context) (int, int, bool) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		response.JSON(c, "", http.StatusBadRequest, nil, []string{"invalid page"})
+		return 0, 0, false
+	}
+	perPage, err := strconv.Atoi(c.DefaultQuery("per_page", strconv.Itoa(defaultPageSize)))
+	if err != nil || perPage < 1 || perPage > maxPageSize {
+		response.JSON(c, "", http.StatusBadRequest, nil, []string{"invalid per_page"})
+		return 0, 0, false
+	}
+	return page, perPage, true
+}
+
+// outranks reports whether the user of the request holds every
+// permission target has, globally and, if orgID is set, within that
+// organization, so nobody can act on users with more power than they have.
+// The permissions of the user within their organization only count when
+// it is the one of orgID.
+func (s *Server) outranks(c *gin.Context, target *models.User, orgID string) bool {
+	required := s.Roles.Permissions(rbac.UserRoles(target.Roles), target.Permissions...)
+	granted := grantedPermissions(c)
+	if orgID == "" || orgID != middleware.OrgID(c) {
+		permissionsI, _ := c.Get("permissions")
+		granted, _ = permissionsI.([]string)
+	}
+	if orgID == "" {
+		return rbac.Covers(granted, required)
+	}
+	if membership := target.Membership(orgID); membership != nil {
+		resolver := &rbac.Resolver{Roles: s.Roles, Groups: s.Groups.Find}
+		orgPermissions, err := resolver.ResolveOrg(target, orgID, membership.Roles)
+		if err != nil {
+			log.Printf("resolve organization permissions error: %v\n", err)
+			return false
+		}
+		required = append(required, orgPermissions...)
+	}
+	return rbac.Covers(granted, required)
+}
+
+// adminTarget loads the user the :id parameter refers to, responding
+// with an error if it can't or if the admin may not perform action on
+// them. Admins may only read the details of users with more permissions
+// than they have.
+func (s *Server) adminTarget(c *gin.Context, action string) (*models.User, bool) {
+	user, err := s.DB.FindUserByID(c.Param("id"))
+	switch err {
+	case nil:
+		if !middleware.Can(c, action, user) {
+			response.JSON(c, "", http.StatusNotFound, nil, []string{"user not found"})
+			return nil, false
+		}
+		if action != rbac.UsersRead && !s.outranks(c, user, "") {
+			response.JSON(c, "", http.StatusForbidden, nil, []string{"forbidden"})
+			return nil, false
+		}
+		return user, true
+	case db.ErrInvalidID, mgo.ErrNotFound:
+		response.JSON(c, "", http.StatusNotFound, nil, []string{"user not found"})
+	default:
+		log.Printf("find user by id error: %v\n", err)
+		response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+	}
+	return nil, false
+}
+
+// isSelf reports whether target is the admin making the request. Admins
+// can't deactivate or delete themselves so they don't lock everyone out.
+func isSelf(c *gin.Context, target *models.User) bool {
+	if userI, exists := c.Get("user"); exists {
+		if user, ok := userI.(*models.User); ok {
+			return user.Email == target.Email
+		}
+	}
+	return false
+}
+
+// handleAdminListUsers lists users, whatever their status, a page at a time
+func (s *Server) handleAdminListUsers() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		page, perPage, ok := pagination(c)
+		if !ok {
+			return
+		}
+
+		filter := db.UserFilter{
+			Status: c.Query("status"),
+			Search: c.Query("q"),
+			Skip:   (page - 1) * perPage,
+			Limit:  perPage,
+		}
+		// admins only see the members of their organization unless they
+		// may act on any
+		permissionsI, _ := c.Get("permissions")
+		if permissions, _ := permissionsI.([]string); !rbac.Allowed(permissions, rbac.OrgsAll) {
+			if filter.OrgID = middleware.OrgID(c); filter.OrgID == "" {
+				response.JSON(c, "retrieved users sucessfully", http.StatusOK, gin.H{
+					"users":    []models.User{},
+					"total":    0,
+					"page":     page,
+					"per_page": perPage,
+				}, nil)
+				return
+			}
+		}
+		users, total, err := s.DB.FindUsers(filter)
+		if err != nil {
+			log.Printf("find users error : %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		response.JSON(c, "retrieved users sucessfully", http.StatusOK, gin.H{
+			"users":    users,
+			"total":    total,
+			"page":     page,
+			"per_page": perPage,
+		}, nil)
+	}
+}
+
+// handleAdminShowUser returns a user's details
+func (s *Server) handleAdminShowUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := s.adminTarget(c, rbac.UsersRead)
+		if !ok {
+			return
+		}
+		response.JSON(c, "user retrieved successfully", http.StatusOK, gin.H{
+			"user":          user,
+			"failed_logins": user.FailedLogins,
+			"locked":        user.IsLocked(),
+			"locked_until":  user.LockedUntil,
+		}, nil)
+	}
+}
+
+// handleAdminSetStatus changes a user's status. Deactivated users are
+// logged out, reactivating a user also unlocks them.
+func (s *Server) handleAdminSetStatus(status string) gin.HandlerFunc {
+	action := "deactivated"
+	if status == models.StatusActive {
+		action = "reactivated"
+	}
+	return func(c *gin.Context) {
+		user, ok := s.adminTarget(c, rbac.UsersManage)
+		if !ok {
+			return
+		}
+		if status != models.StatusActive && isSelf(c, user) {
+			response.JSON(c, "", http.StatusBadRequest, nil, []string{"you can't deactivate yourself"})
+			return
+		}
+
+		if err := s.DB.SetUserStatus(user.ID.Hex(), status); err != nil {
+			log.Printf("set user status error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		if status != models.StatusActive {
+			if err := s.DB.RevokeUserTokens(user.ID.Hex(), time.Now()); err != nil {
+				log.Printf("revoke user tokens error: %v\n", err)
+				response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+				return
+			}
+		}
+		s.auditAdminAction(c, action, user)
+		response.JSON(c, "user "+action+" successfully", http.StatusOK, nil, nil)
+	}
+}
+
+// handleAdminLogoutUser revokes every token issued to a user
+func (s *Server) handleAdminLogoutUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := s.adminTarget(c, rbac.UsersManage)
+		if !ok {
+			return
+		}
+		if err := s.DB.RevokeUserTokens(user.ID.Hex(), time.Now()); err != nil {
+			log.Printf("revoke user tokens error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		if err := s.DB.RevokeUserSessions(user.ID.Hex()); err != nil {
+			log.Printf("revoke sessions error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		s.auditAdminAction(c, "logged out", user)
+		response.JSON(c, "user logged out successfully", http.StatusOK, nil, nil)
+	}
+}
+
+// handleAdminDeleteUser deletes a user
+func (s *Server) handleAdminDeleteUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := s.adminTarget(c, rbac.UsersManage)
+		if !ok {
+			return
+		}
+		if isSelf(c, user) {
+			response.JSON(c, "", http.StatusBadRequest, nil, []string{"you can't delete yourself"})
+			return
+		}
+		if err := s.DB.DeleteUser(user.ID.Hex()); err != nil {
+			log.Printf("delete user error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		s.auditAdminAction(c, "deleted", user)
+		response.JSON(c, "user deleted successfully", http.StatusOK, nil, nil)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spankie/go-auth/audit"
+	"github.com/spankie/go-auth/server/middleware"
+	"github.com/spankie/go-auth/server/response"
+)
+
+// audit records a security event about the request
+func (s *Server) audit(c *gin.Context, event *audit.Event) {
+	middleware.RecordEvent(c, s.Audit, event)
+}
+
+// handleListAuditEvents searches the audit log
+func (s *Server) handleListAuditEvents() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		auditLog, ok := s.Audit.(audit.AuditLog)
+		if !ok {
+			response.JSON(c, "", http.StatusNotImplemented, nil, []string{"the audit log can't be searched"})
+			return
+		}
+		page, perPage, ok := pagination(c)
+		if !ok {
+			return
+		}
+		q := audit.Query{
+			Type:    c.Query("type"),
+			Outcome: c.Query("outcome"),
+			Actor:   c.Query("actor"),
+			Subject: c.Query("subject"),
+			Skip:    (page - 1) * perPage,
+			Limit:   perPage,
+		}
+		for param, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+			if value := c.Query(param); value != "" {
+				var err error
+				if *t, err = time.Parse(time.RFC3339, value); err != nil {
+					response.JSON(c, "", http.StatusBadRequest, nil, []string{"invalid " + param + ", use RFC 3339"})
+					return
+				}
+			}
+		}
+
+		events, total, err := auditLog.FindEvents(q)
+		if err != nil {
+			log.Printf("find audit events error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		if events == nil {
+			events = []audit.Event{}
+		}
+		response.JSON(c, "retrieved audit events successfully", http.StatusOK, gin.H{
+			"events":   events,
+			"total":    total,
+			"page":     page,
+			"per_page": perPage,
+		}, nil)
+	}
+}
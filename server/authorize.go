@@ -0,0 +1,358 @@
+package server
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/spankie/go-auth/audit"
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/server/middleware"
+	"github.com/spankie/go-auth/services"
+)
+
+// authorizationCodeValidity is how long clients have to exchange an
+// authorization code for tokens
+const authorizationCodeValidity = 10 * time.Minute
+
+// authorizationCodeBytes is the number of random bytes in an
+// authorization code
+const authorizationCodeBytes = 32
+
+// authorizeFormValidity is how long the login and consent page can be
+// submitted for
+const authorizeFormValidity = 30 * time.Minute
+
+// authorizeRequest holds the parameters of an authorization request, see
+// RFC 6749 section 4.1.1, RFC 7636 section 4.3 and OpenID Connect Core 1.0
+// section 3.1.2.1
+type authorizeRequest struct {
+	ResponseType string
+	ClientID     string
+	RedirectURI  string
+	// RedirectURIGiven is false when the client left RedirectURI out and
+	// its only registered one is used
+	RedirectURIGiven    bool
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Nonce               string
+}
+
+// authorizePage is the login and consent page of the authorization
+// endpoint. It submits to the URL it was served from.
+var authorizePage = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Sign in to {{.Client.Name}}</title>
+</head>
+<body>
+<h1>Sign in to continue to {{.Client.Name}}</h1>
+{{with .Scopes}}<p>{{$.Client.Name}} is asking for:</p>
+<ul>{{range .}}<li>{{.}}</li>{{end}}</ul>{{end}}
+{{with .Error}}<p role="alert">{{.}}</p>{{end}}
+<form method="post">
+<input type="hidden" name="form_token" value="{{.FormToken}}">
+<input type="hidden" name="response_type" value="{{.Request.ResponseType}}">
+<input type="hidden" name="client_id" value="{{.Request.ClientID}}">
+{{if .Request.RedirectURIGiven}}<input type="hidden" name="redirect_uri" value="{{.Request.RedirectURI}}">{{end}}
+<input type="hidden" name="scope" value="{{.Request.Scope}}">
+<input type="hidden" name="state" value="{{.Request.State}}">
+<input type="hidden" name="code_challenge" value="{{.Request.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.Request.CodeChallengeMethod}}">
+<input type="hidden" name="nonce" value="{{.Request.Nonce}}">
+<p><label>Email, username or phone<br><input name="identifier" value="{{.Identifier}}" autocomplete="username" required></label></p>
+<p><label>Password<br><input type="password" name="password" autocomplete="current-password" required></label></p>
+<p>
+<button type="submit" name="consent" value="allow">Allow</button>
+<button type="submit" name="consent" value="deny" formnovalidate>Deny</button>
+</p>
+</form>
+</body>
+</html>
+`))
+
+// parseAuthorizeRequest reads and checks the parameters of an authorization
+// request. Users are shown an error when the client or redirect URI is
+// invalid, other errors are sent back to the client.
+func (s *Server) parseAuthorizeRequest(c *gin.Context) (*authorizeRequest, *models.Client, bool) {
+	req := &authorizeRequest{
+		ResponseType:        c.Request.FormValue("response_type"),
+		ClientID:            c.Request.FormValue("client_id"),
+		RedirectURI:         c.Request.FormValue("redirect_uri"),
+		Scope:               c.Request.FormValue("scope"),
+		State:               c.Request.FormValue("state"),
+		CodeChallenge:       c.Request.FormValue("code_challenge"),
+		CodeChallengeMethod: c.Request.FormValue("code_challenge_method"),
+		Nonce:               c.Request.FormValue("nonce"),
+	}
+	client, err := s.DB.FindClientByID(req.ClientID)
+	if err != nil {
+		log.Printf("authorization request from unknown client %q: %v\n", req.ClientID, err)
+		c.String(http.StatusBadRequest, "The application asking you to sign in isn't registered.")
+		return nil, nil, false
+	}
+	// the redirect URI can only be left out when there is no doubt about it
+	req.RedirectURIGiven = req.RedirectURI != ""
+	if !req.RedirectURIGiven && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+	if !client.HasRedirectURI(req.RedirectURI) {
+		log.Printf("authorization request with unregistered redirect uri %q\n", req.RedirectURI)
+		c.String(http.StatusBadRequest, "The application asking you to sign in sent an invalid redirect URI.")
+		return nil, nil, false
+	}
+
+	switch {
+	case req.ResponseType != "code":
+		redirectToClient(c, req, url.Values{"error": {"unsupported_response_type"}})
+	case !s.validScope(req.Scope):
+		redirectToClient(c, req, url.Values{"error": {"invalid_scope"}})
+	case req.CodeChallenge == "":
+		redirectToClient(c, req, url.Values{"error": {"invalid_request"}, "error_description": {"code_challenge is required"}})
+	case !services.ValidCodeChallenge(req.CodeChallenge):
+		redirectToClient(c, req, url.Values{"error": {"invalid_request"}, "error_description": {"code_challenge must be 43 base64url characters"}})
+	case req.CodeChallengeMethod != "S256":
+		redirectToClient(c, req, url.Values{"error": {"invalid_request"}, "error_description": {"code_challenge_method must be S256"}})
+	default:
+		return req, client, true
+	}
+	return nil, nil, false
+}
+
+// formBinding returns the parameters of req the token of the login and
+// consent page is bound to, so it can't be used to submit another request
+func (req *authorizeRequest) formBinding() string {
+	params := url.Values{
+		"response_type":         {req.ResponseType},
+		"client_id":             {req.ClientID},
+		"redirect_uri":          {req.RedirectURI},
+		"scope":                 {req.Scope},
+		"state":                 {req.State},
+		"code_challenge":        {req.CodeChallenge},
+		"code_challenge_method": {req.CodeChallengeMethod},
+		"nonce":                 {req.Nonce},
+	}
+	return "authorize:" + params.Encode()
+}
+
+// redirectToClient sends the user back to the redirect URI of req with
+// params and the state of the request
+func redirectToClient(c *gin.Context, req *authorizeRequest, params url.Values) {
+	// registered redirect URIs are checked to be valid URLs
+	u, _ := url.Parse(req.RedirectURI)
+	query := u.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	u.RawQuery = query.Encode()
+	c.Redirect(http.StatusFound, u.String())
+}
+
+// renderAuthorizePage responds with the login and consent page, which
+// must be submitted with formToken
+func renderAuthorizePage(c *gin.Context, status int, req *authorizeRequest, client *models.Client, formToken, identifier, message string) {
+	page := &bytes.Buffer{}
+	err := authorizePage.Execute(page, gin.H{
+		"Client":     client,
+		"Request":    req,
+		"FormToken":  formToken,
+		"Scopes":     strings.Fields(req.Scope),
+		"Identifier": identifier,
+		"Error":      message,
+	})
+	if err != nil {
+		log.Printf("render authorize page error: %v\n", err)
+		c.String(http.StatusInternalServerError, "internal server error")
+		return
+	}
+	c.Data(status, "text/html; charset=utf-8", page.Bytes())
+}
+
+// handleAuthorize shows the login and consent page to users sent by a
+// client to the authorization endpoint. The page can only be submitted
+// from the browser it was served to, with a token bound to the request
+// like CSRF tokens are bound to sessions, so other sites can't log users
+// in with an account of their choosing.
+func (s *Server) handleAuthorize() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req, client, ok := s.parseAuthorizeRequest(c)
+		if !ok {
+			return
+		}
+		formToken, err := services.NewCSRFToken(os.Getenv("JWT_SECRET"), req.formBinding())
+		if err != nil {
+			log.Printf("generate form token error: %v\n", err)
+			c.String(http.StatusInternalServerError, "internal server error")
+			return
+		}
+		services.SetTokenCookie(c, services.AuthorizeFormCookie, formToken, int(authorizeFormValidity.Seconds()))
+		renderAuthorizePage(c, http.StatusOK, req, client, formToken, "", "")
+	}
+}
+
+// handleAuthorizeConsent logs the user in and, if they allowed it, sends
+// them back to the client with an authorization code
+func (s *Server) handleAuthorizeConsent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req, client, ok := s.parseAuthorizeRequest(c)
+		if !ok {
+			return
+		}
+		formToken, _ := c.Cookie(services.AuthorizeFormCookie)
+		if !services.ValidCSRFToken(formToken, c.PostForm("form_token"), os.Getenv("JWT_SECRET"), req.formBinding()) {
+			log.Printf("authorization request submitted without a valid form token\n")
+			c.String(http.StatusForbidden, "This sign in page has expired. Go back to the application and try again.")
+			return
+		}
+		if c.PostForm("consent") != "allow" {
+			redirectToClient(c, req, url.Values{"error": {"access_denied"}})
+			return
+		}
+		identifier := c.PostForm("identifier")
+		user, loginErr := s.authenticate(c, identifier, c.PostForm("password"))
+		if loginErr != nil {
+			renderAuthorizePage(c, loginErr.status, req, client, formToken, identifier, loginErr.message)
+			return
+		}
+
+		code, err := services.RandomToken(authorizationCodeBytes)
+		if err != nil {
+			log.Printf("generate authorization code error: %v\n", err)
+			redirectToClient(c, req, url.Values{"error": {"server_error"}})
+			return
+		}
+		now := time.Now()
+		_, err = s.DB.CreateAuthorizationCode(&models.AuthorizationCode{
+			CodeHash:         services.HashToken(code),
+			ClientID:         client.ID,
+			UserID:           user.ID,
+			OrgID:            defaultOrgID(user),
+			RedirectURI:      req.RedirectURI,
+			RedirectURIGiven: req.RedirectURIGiven,
+			Scope:            req.Scope,
+			CodeChallenge:    req.CodeChallenge,
+			Nonce:            req.Nonce,
+			CreatedAt:        now,
+			ExpiresAt:        now.Add(authorizationCodeValidity),
+		})
+		if err != nil {
+			log.Printf("create authorization code error: %v\n", err)
+			redirectToClient(c, req, url.Values{"error": {"server_error"}})
+			return
+		}
+		s.audit(c, &audit.Event{
+			Type:    audit.Login,
+			Outcome: audit.Success,
+			Subject: user.Email,
+			Actor:   user.Email,
+			OrgID:   defaultOrgID(user),
+			Details: map[string]string{"client_id": client.ID.Hex()},
+		})
+		redirectToClient(c, req, url.Values{"code": {code}})
+	}
+}
+
+// handleToken issues tokens to clients for the authorization_code and
+// refresh_token grants
+func (s *Server) handleToken() gin.HandlerFunc {
+	grants := map[string]func(*gin.Context, *models.Client){
+		"authorization_code": s.exchangeAuthorizationCode,
+		"refresh_token":      s.refreshClientToken,
+	}
+	return func(c *gin.Context) {
+		grant, ok := grants[c.PostForm("grant_type")]
+		if !ok {
+			oauthError(c, http.StatusBadRequest, "unsupported_grant_type", "only the authorization_code and refresh_token grants are supported")
+			return
+		}
+		client, ok := s.tokenClient(c)
+		if !ok || !middleware.Throttle(c, s.clientLimiter, client.ID.Hex()) {
+			return
+		}
+		grant(c, client)
+	}
+}
+
+// exchangeAuthorizationCode exchanges an authorization code for the same
+// access and refresh tokens a login gets, as described in RFC 6749 section
+// 4.1.3, along with an ID token if the openid scope was granted
+func (s *Server) exchangeAuthorizationCode(c *gin.Context, client *models.Client) {
+	invalidGrant := func() {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "the authorization code is invalid")
+	}
+	// codes are looked up along with the client so other clients can't
+	// use them up
+	code, err := s.DB.ConsumeAuthorizationCode(services.HashToken(c.PostForm("code")), client.ID.Hex())
+	if err != nil {
+		log.Printf("consume authorization code error: %v\n", err)
+		invalidGrant()
+		return
+	}
+	if !services.VerifyCodeChallenge(c.PostForm("code_verifier"), code.CodeChallenge) {
+		invalidGrant()
+		return
+	}
+	// the redirect URI must be sent again if it was in the authorization request
+	if uri := c.PostForm("redirect_uri"); (uri != "" || code.RedirectURIGiven) && uri != code.RedirectURI {
+		invalidGrant()
+		return
+	}
+	user, err := s.DB.FindUserByID(code.UserID.Hex())
+	if err != nil || !user.IsActive() {
+		invalidGrant()
+		return
+	}
+	// the ID token is made first so a failure doesn't leave a session
+	// nobody has the tokens of
+	var idToken string
+	if hasScope(code.Scope, scopeOpenID) {
+		if idToken, err = s.idToken(c, user, client, code); err != nil {
+			log.Printf("id token generation error: %v\n", err)
+			oauthError(c, http.StatusInternalServerError, "server_error", "internal server error")
+			return
+		}
+	}
+
+	session, err := s.startSession(c, user, client.Name, services.RefreshTokenValidity)
+	if err != nil {
+		log.Printf("create session error: %v\n", err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "internal server error")
+		return
+	}
+	extra := jwt.MapClaims{"client_id": client.ID.Hex()}
+	if code.Scope != "" {
+		extra["scope"] = code.Scope
+	}
+	accToken, refreshToken, err := s.sessionTokens(user, code.OrgID, session, extra)
+	if err != nil {
+		log.Printf("token generation error err: %v\n", err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "internal server error")
+		return
+	}
+	tokens := gin.H{
+		"access_token":  accToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(services.AccessTokenValidity.Seconds()),
+		"refresh_token": refreshToken,
+	}
+	if code.Scope != "" {
+		tokens["scope"] = code.Scope
+	}
+	if idToken != "" {
+		tokens["id_token"] = idToken
+	}
+	c.JSON(http.StatusOK, tokens)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spankie/go-auth/audit"
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/server/response"
+	"github.com/spankie/go-auth/services"
+)
+
+// clientSecretBytes is the number of random bytes in a client secret
+const clientSecretBytes = 32
+
+// handleRegisterClient registers an OAuth client. The secret of
+// confidential clients is only returned here, as just its hash is stored.
+func (s *Server) handleRegisterClient() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := &struct {
+			Name           string   `json:"name" binding:"required"`
+			Public         bool     `json:"public"`
+			ResourceServer bool     `json:"resource_server"`
+			RedirectURIs   []string `json:"redirect_uris"`
+		}{}
+		if err := c.ShouldBindJSON(req); err != nil {
+			response.JSON(c, "", http.StatusBadRequest, nil, []string{"name is required"})
+			return
+		}
+		for _, uri := range req.RedirectURIs {
+			if !validRedirectURI(uri) {
+				response.JSON(c, "", http.StatusBadRequest, nil, []string{"invalid redirect uri: " + uri})
+				return
+			}
+		}
+		if req.Public && req.ResourceServer {
+			response.JSON(c, "", http.StatusBadRequest, nil, []string{"resource servers can't be public clients"})
+			return
+		}
+		client := &models.Client{
+			Name:           strings.TrimSpace(req.Name),
+			Public:         req.Public,
+			ResourceServer: req.ResourceServer,
+			RedirectURIs:   req.RedirectURIs,
+		}
+		var secret string
+		if !client.Public {
+			var err error
+			if secret, err = services.RandomToken(clientSecretBytes); err != nil {
+				log.Printf("generate client secret error: %v\n", err)
+				response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+				return
+			}
+			client.SecretHash = services.HashToken(secret)
+		}
+		client, err := s.DB.CreateClient(client)
+		if err != nil {
+			log.Printf("create client error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		s.audit(c, &audit.Event{
+			Type:    audit.AdminAction,
+			Outcome: audit.Success,
+			Details: map[string]string{"action": "register_client", "client_id": client.ID.Hex()},
+		})
+		data := gin.H{"client": client}
+		if secret != "" {
+			data["client_secret"] = secret
+		}
+		response.JSON(c, "client registered", http.StatusCreated, data, nil)
+	}
+}
+
+// validRedirectURI reports whether uri can be registered as a redirect
+// URI. It must be absolute and have no fragment, as required by RFC 6749.
+// Custom schemes are allowed for native apps.
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	return err == nil && u.IsAbs() && !strings.Contains(uri, "#")
+}
+
+// authenticateClient authenticates the client calling an OAuth endpoint
+// with HTTP basic authentication or the client_id and client_secret form
+// parameters, as described in RFC 6749 section 2.3.1
+func (s *Server) authenticateClient(c *gin.Context) (*models.Client, bool) {
+	id, secret, basic := c.Request.BasicAuth()
+	if !basic {
+		id, secret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+	client, err := s.DB.FindClientByID(id)
+	if err != nil || client.Public || subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(services.HashToken(secret))) != 1 {
+		if basic {
+			c.Header("WWW-Authenticate", `Basic realm="go-auth"`)
+		}
+		oauthError(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return nil, false
+	}
+	return client, true
+}
+
+// tokenClient authenticates the client calling the token endpoint. Public
+// clients only give their ID, PKCE proves they started the flow.
+func (s *Server) tokenClient(c *gin.Context) (*models.Client, bool) {
+	if _, _, basic := c.Request.BasicAuth(); basic || c.PostForm("client_secret") != "" {
+		return s.authenticateClient(c)
+	}
+	client, err := s.DB.FindClientByID(c.PostForm("client_id"))
+	if err != nil || !client.Public {
+		oauthError(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return nil, false
+	}
+	return client, true
+}
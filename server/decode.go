@@ -1,6 +1,8 @@
 package server
 
 import (
+	"strings"
+
 	"github.com/gin-gonic/gin"
 	validator "github.com/go-playground/validator/v10"
 	"github.com/spankie/go-auth/servererrors"
@@ -15,6 +17,9 @@ func (s *Server) decode(c *gin.Context, v interface{}) []string {
 			for _, fieldErr := range verr {
 				errs = append(errs, servererrors.NewFieldError(fieldErr).String())
 			}
+		} else if strings.Contains(err.Error(), "request body too large") {
+			// set by http.MaxBytesReader, see middleware.MaxBodySize
+			errs = append(errs, "request body too large")
 		} else {
 			errs = append(errs, "internal server error")
 		}
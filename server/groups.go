@@ -0,0 +1,234 @@
+package server
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/rbac"
+	"github.com/spankie/go-auth/server/response"
+)
+
+// orgGroup loads the group of org the :group_id parameter refers to,
+// responding with an error if it can't
+func (s *Server) orgGroup(c *gin.Context, org *models.Organization) (*models.Group, bool) {
+	group, err := s.DB.FindGroupByID(c.Param("group_id"))
+	if err == nil && group.OrgID == org.ID {
+		return group, true
+	}
+	if err != nil && err != mgo.ErrNotFound {
+		log.Printf("find group error: %v\n", err)
+	}
+	response.JSON(c, "", http.StatusNotFound, nil, []string{"group not found"})
+	return nil, false
+}
+
+// revocableGroup checks that the user of the request may take the roles
+// group gives away from members, responding with an error if they may
+// not. Like when removing members of the organization, they must be able
+// to grant the roles and outrank the members. It returns the groups of
+// org.
+func (s *Server) revocableGroup(c *gin.Context, org *models.Organization, group *models.Group, members []bson.ObjectId) ([]models.Group, bool) {
+	groups, err := s.DB.FindOrgGroups(org.ID.Hex())
+	if err != nil {
+		log.Printf("find groups error: %v\n", err)
+		response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+		return nil, false
+	}
+	if !s.grantable(c, rbac.InheritedRoles(groups, group.ID)) {
+		response.JSON(c, "", http.StatusForbidden, nil, []string{"you can't revoke these roles"})
+		return nil, false
+	}
+	for _, id := range members {
+		member, err := s.DB.FindUserByID(id.Hex())
+		if err == mgo.ErrNotFound {
+			// deleted users have nothing left to lose
+			continue
+		}
+		if err != nil {
+			log.Printf("find user by id error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return nil, false
+		}
+		if !s.outranks(c, member, org.ID.Hex()) {
+			response.JSON(c, "", http.StatusForbidden, nil, []string{"forbidden"})
+			return nil, false
+		}
+	}
+	return groups, true
+}
+
+// handleListGroups lists the groups of an organization
+func (s *Server) handleListGroups() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := s.orgFromParam(c, rbac.UsersRead)
+		if !ok {
+			return
+		}
+		groups, err := s.DB.FindOrgGroups(org.ID.Hex())
+		if err != nil {
+			log.Printf("find groups error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		if groups == nil {
+			groups = []models.Group{}
+		}
+		response.JSON(c, "retrieved groups successfully", http.StatusOK, gin.H{"groups": groups}, nil)
+	}
+}
+
+// handleCreateGroup creates a group, nested in another one if parent_id
+// is set
+func (s *Server) handleCreateGroup() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := s.orgFromParam(c, rbac.UsersManage)
+		if !ok {
+			return
+		}
+		groupRequest := &struct {
+			Name     string   `json:"name" binding:"required"`
+			ParentID string   `json:"parent_id"`
+			Roles    []string `json:"roles"`
+		}{}
+		if errs := s.decode(c, groupRequest); errs != nil {
+			response.JSON(c, "", http.StatusBadRequest, nil, errs)
+			return
+		}
+		if !s.grantable(c, groupRequest.Roles) {
+			response.JSON(c, "", http.StatusForbidden, nil, []string{"you can't grant these roles"})
+			return
+		}
+
+		group := &models.Group{OrgID: org.ID, Name: groupRequest.Name, Roles: groupRequest.Roles}
+		if groupRequest.ParentID != "" {
+			// groups can only be nested in existing groups, so there can't
+			// be cycles
+			parent, err := s.DB.FindGroupByID(groupRequest.ParentID)
+			if err != nil || parent.OrgID != org.ID {
+				log.Printf("find parent group error: %v\n", err)
+				response.JSON(c, "", http.StatusBadRequest, nil, []string{"parent group not found"})
+				return
+			}
+			group.ParentID = parent.ID
+		}
+
+		group, err := s.DB.CreateGroup(group)
+		if err != nil {
+			log.Printf("create group error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		response.JSON(c, "group created successfully", http.StatusCreated, gin.H{"group": group}, nil)
+	}
+}
+
+// handleDeleteGroup deletes a group that has no subgroups, taking its roles
+// away from its members
+func (s *Server) handleDeleteGroup() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := s.orgFromParam(c, rbac.UsersManage)
+		if !ok {
+			return
+		}
+		group, ok := s.orgGroup(c, org)
+		if !ok {
+			return
+		}
+		groups, ok := s.revocableGroup(c, org, group, group.Members)
+		if !ok {
+			return
+		}
+		for _, g := range groups {
+			if g.ParentID == group.ID {
+				response.JSON(c, "", http.StatusBadRequest, nil, []string{"delete the subgroups of the group first"})
+				return
+			}
+		}
+		if err := s.DB.DeleteGroup(group.ID.Hex()); err != nil {
+			log.Printf("delete group error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		s.Groups.Invalidate(org.ID.Hex())
+		response.JSON(c, "group deleted successfully", http.StatusOK, nil, nil)
+	}
+}
+
+// handleAddGroupMember adds a member of the organization to a group
+func (s *Server) handleAddGroupMember() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := s.orgFromParam(c, rbac.UsersManage)
+		if !ok {
+			return
+		}
+		group, ok := s.orgGroup(c, org)
+		if !ok {
+			return
+		}
+		memberRequest := &struct {
+			UserID string `json:"user_id" binding:"required"`
+		}{}
+		if errs := s.decode(c, memberRequest); errs != nil {
+			response.JSON(c, "", http.StatusBadRequest, nil, errs)
+			return
+		}
+		user, err := s.DB.FindUserByID(memberRequest.UserID)
+		if err != nil || user.Membership(org.ID.Hex()) == nil {
+			log.Printf("find group member error: %v\n", err)
+			response.JSON(c, "", http.StatusBadRequest, nil, []string{"user is not a member of the organization"})
+			return
+		}
+		// nobody can be given roles through a group that the person adding
+		// them couldn't grant
+		groups, err := s.DB.FindOrgGroups(org.ID.Hex())
+		if err != nil {
+			log.Printf("find groups error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		if !s.grantable(c, rbac.InheritedRoles(groups, group.ID)) {
+			response.JSON(c, "", http.StatusForbidden, nil, []string{"you can't grant these roles"})
+			return
+		}
+		if err := s.DB.AddGroupMember(group.ID.Hex(), user.ID.Hex()); err != nil {
+			log.Printf("add group member error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		s.Groups.Invalidate(org.ID.Hex())
+		response.JSON(c, "member added successfully", http.StatusOK, nil, nil)
+	}
+}
+
+// handleRemoveGroupMember removes a user from a group
+func (s *Server) handleRemoveGroupMember() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := s.orgFromParam(c, rbac.UsersManage)
+		if !ok {
+			return
+		}
+		group, ok := s.orgGroup(c, org)
+		if !ok {
+			return
+		}
+		userID := c.Param("user_id")
+		if !bson.IsObjectIdHex(userID) || !group.HasMember(bson.ObjectIdHex(userID)) {
+			response.JSON(c, "", http.StatusNotFound, nil, []string{"member not found"})
+			return
+		}
+		if _, ok := s.revocableGroup(c, org, group, []bson.ObjectId{bson.ObjectIdHex(userID)}); !ok {
+			return
+		}
+		if err := s.DB.RemoveGroupMember(group.ID.Hex(), userID); err != nil {
+			log.Printf("remove group member error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		s.Groups.Invalidate(org.ID.Hex())
+		response.JSON(c, "member removed successfully", http.StatusOK, nil, nil)
+	}
+}
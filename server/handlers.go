@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -15,107 +16,253 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
+	"github.com/spankie/go-auth/audit"
 	"github.com/spankie/go-auth/db"
 	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/rbac"
+	"github.com/spankie/go-auth/server/middleware"
 	"github.com/spankie/go-auth/server/response"
 	"github.com/spankie/go-auth/servererrors"
 	"github.com/spankie/go-auth/services"
-	"golang.org/x/crypto/bcrypt"
 )
 
 func (s *Server) handleSignup() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		user := &models.User{Status: "active"}
+		user := &models.User{}
 
 		if errs := s.decode(c, user); errs != nil {
 			response.JSON(c, "", http.StatusBadRequest, nil, errs)
 			return
 		}
-		var err error
-		user.Password, err = bcrypt.GenerateFromPassword([]byte(user.PasswordString), bcrypt.DefaultCost)
-		if err != nil {
-			log.Printf("hash password err: %v\n", err)
-			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
-			return
-		}
-		user, err = s.DB.CreateUser(user)
-		if err != nil {
-			log.Printf("create user err: %v\n", err)
-			if err, ok := err.(db.ValidationError); ok {
-				response.JSON(c, "", http.StatusBadRequest, nil, []string{err.Error()})
-				return
-			}
-			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+		if _, ok := s.registerUser(c, user); !ok {
 			return
 		}
 		response.JSON(c, "signup successful", http.StatusCreated, nil, nil)
 	}
 }
 
+// registerUser creates an active account for user, responding with an
+// error if it can't
+func (s *Server) registerUser(c *gin.Context, user *models.User) (*models.User, bool) {
+	user.Status = models.StatusActive
+	// users can't choose their own roles
+	user.Roles = []string{rbac.RoleUser}
+	user.Permissions = nil
+	user.Memberships = nil
+	var err error
+	user.Email = services.NormalizeEmail(user.Email)
+	if user.Phone, err = services.NormalizePhone(user.Phone); err != nil {
+		response.JSON(c, "", http.StatusBadRequest, nil, []string{db.ValidationError{Field: "phone", Message: err.Error()}.Error()})
+		return nil, false
+	}
+	if errs := s.PasswordPolicy.Check("PasswordString", user.PasswordString, user); errs != nil {
+		response.JSON(c, "", http.StatusBadRequest, nil, servererrors.FieldErrorStrings(errs))
+		return nil, false
+	}
+	user.Password, err = s.PasswordHasher.Hash(user.PasswordString)
+	if err != nil {
+		log.Printf("hash password err: %v\n", err)
+		response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+		return nil, false
+	}
+	user, err = s.DB.CreateUser(user)
+	if err != nil {
+		log.Printf("create user err: %v\n", err)
+		if err, ok := err.(db.ValidationError); ok {
+			s.audit(c, &audit.Event{Type: audit.Signup, Outcome: audit.Failure, Subject: user.Email, Reason: err.Error()})
+			response.JSON(c, "", http.StatusBadRequest, nil, []string{err.Error()})
+			return nil, false
+		}
+		response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+		return nil, false
+	}
+	s.audit(c, &audit.Event{Type: audit.Signup, Outcome: audit.Success, Subject: user.Email, Actor: user.Email})
+	return user, true
+}
+
 func (s *Server) handleLogin() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		user := &models.User{}
 		loginRequest := &struct {
-			Username string `json:"username" binding:"required"`
+			Identifier string `json:"identifier" binding:"required_without=Username"`
+			// Username is kept for clients that haven't moved to identifier yet
+			Username string `json:"username" binding:"required_without=Identifier"`
 			Password string `json:"password" binding:"required"`
+			// OrgID is the organization to log into, it defaults to the
+			// first one the user is a member of
+			OrgID string `json:"org_id"`
+			// Device names the device in the list of sessions, it defaults
+			// to a description of the user agent
+			Device string `json:"device"`
 		}{}
 
 		if errs := s.decode(c, loginRequest); errs != nil {
 			response.JSON(c, "", http.StatusBadRequest, nil, errs)
 			return
 		}
-		// Check if the user with that username exists
-		user, err := s.DB.FindUserByUsername(loginRequest.Username)
-		if err != nil {
-			if inactiveErr, ok := err.(servererrors.InActiveUserError); ok {
-				response.JSON(c, "", http.StatusBadRequest, nil, []string{inactiveErr.Error()})
-				return
-			}
-			log.Printf("No user: %v\n", err)
-			response.JSON(c, "", http.StatusUnauthorized, nil, []string{"user not found"})
-			return
+		if loginRequest.Identifier == "" {
+			loginRequest.Identifier = loginRequest.Username
 		}
-		log.Printf("%v\n%s\n", user.Password, string(user.Password))
-		err = bcrypt.CompareHashAndPassword(user.Password, []byte(loginRequest.Password))
-		if err != nil {
-			log.Printf("passwords do not match %v\n", err)
-			response.JSON(c, "", http.StatusUnauthorized, nil, []string{"username or password incorrect"})
+		user, loginErr := s.authenticate(c, loginRequest.Identifier, loginRequest.Password)
+		if loginErr != nil {
+			response.JSON(c, "", loginErr.status, nil, []string{loginErr.message})
 			return
 		}
-
-		accessClaims := jwt.MapClaims{
-			"user_email": user.Email,
-			"exp":        time.Now().Add(services.AccessTokenValidity).Unix(),
-		}
-		refreshClaims := jwt.MapClaims{
-			"exp": time.Now().Add(services.RefreshTokenValidity).Unix(),
-			"sub": 1,
+		if loginRequest.OrgID == "" {
+			loginRequest.OrgID = defaultOrgID(user)
+		} else if user.Membership(loginRequest.OrgID) == nil {
+			s.audit(c, &audit.Event{Type: audit.Login, Outcome: audit.Failure, Subject: user.Email, Reason: "not a member of the organization"})
+			response.JSON(c, "", http.StatusForbidden, nil, []string{"not a member of this organization"})
+			return
 		}
-
-		secret := os.Getenv("JWT_SECRET")
-		accToken, err := services.GenerateToken(jwt.SigningMethodHS256, accessClaims, &secret)
+		s.audit(c, &audit.Event{Type: audit.Login, Outcome: audit.Success, Subject: user.Email, Actor: user.Email, OrgID: loginRequest.OrgID})
+		session, err := s.startSession(c, user, loginRequest.Device, services.RefreshTokenValidity)
 		if err != nil {
-			log.Printf("token generation error err: %v\n", err)
+			log.Printf("create session error: %v\n", err)
 			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
 			return
 		}
-
-		refreshToken, err := services.GenerateToken(jwt.SigningMethodHS256, refreshClaims, &secret)
+		accToken, refreshToken, err := s.sessionTokens(user, loginRequest.OrgID, session, nil)
 		if err != nil {
 			log.Printf("token generation error err: %v\n", err)
 			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
 			return
 		}
 
+		if services.CookieMode() {
+			// keep the tokens out of reach of scripts in the browser
+			services.SetTokenCookie(c, services.AccessTokenCookie, accToken, int(services.AccessTokenValidity.Seconds()))
+			services.SetTokenCookie(c, services.RefreshTokenCookie, refreshToken, int(services.RefreshTokenValidity.Seconds()))
+			csrfToken, err := services.NewCSRFToken(os.Getenv("JWT_SECRET"), session.ID.Hex())
+			if err != nil {
+				log.Printf("csrf token generation error err: %v\n", err)
+				response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+				return
+			}
+			services.SetCSRFCookie(c, csrfToken, int(services.RefreshTokenValidity.Seconds()))
+			response.JSON(c, "login successful", http.StatusOK, gin.H{"user": user, "csrf_token": csrfToken}, nil)
+			return
+		}
+
 		response.JSON(c, "login successful", http.StatusOK, gin.H{
 			"user":          user,
-			"access_token":  *accToken,
-			"refresh_token": *refreshToken,
+			"access_token":  accToken,
+			"refresh_token": refreshToken,
 		}, nil)
 	}
 }
 
+// loginError is why a login failed along with the status to respond with
+type loginError struct {
+	status  int
+	message string
+}
+
+// authenticate checks the credentials of a user logging in with the
+// identifier and password, recording failures. Every failure for a wrong
+// identifier or password gets the same error so it can't be used to find
+// out which accounts exist.
+func (s *Server) authenticate(c *gin.Context, identifier, password string) (*models.User, *loginError) {
+	invalid := &loginError{http.StatusUnauthorized, errInvalidCredentials}
+	user, err := s.findUserByIdentifier(identifier)
+	inactiveErr, inactive := err.(servererrors.InActiveUserError)
+	if err != nil && !(inactive && user != nil) {
+		log.Printf("No user: %v\n", err)
+		// spend as much time as a real comparison would
+		s.compareDummyPassword(password)
+		s.audit(c, &audit.Event{Type: audit.Login, Outcome: audit.Failure, Subject: identifier, Reason: "unknown user"})
+		return nil, invalid
+	}
+	if !s.verifyPassword(user, password) {
+		s.audit(c, &audit.Event{Type: audit.Login, Outcome: audit.Failure, Subject: user.Email, Reason: "wrong password"})
+		if user.IsActive() {
+			s.recordFailedLogin(c, user)
+		}
+		return nil, invalid
+	}
+	if inactive {
+		log.Printf("login attempt on inactive user %s\n", user.Email)
+		s.audit(c, &audit.Event{Type: audit.Login, Outcome: audit.Failure, Subject: user.Email, Reason: inactiveErr.Error()})
+		if discloseInactiveUsers() {
+			message := inactiveErr.Error()
+			if user.IsLocked() {
+				message = "account is locked"
+			}
+			return nil, &loginError{http.StatusForbidden, message}
+		}
+		return nil, invalid
+	}
+	s.resetFailedLogins(user)
+	middleware.ClearFailures(c, s.loginLimiter)
+	s.upgradePasswordHash(user, password)
+	return user, nil
+}
+
+// sessionTokens returns an access token for user in the organization with
+// the hex ID orgID and a refresh token, both tied to session. The extra
+// claims are added to the access token.
+func (s *Server) sessionTokens(user *models.User, orgID string, session *models.Session, extra jwt.MapClaims) (string, string, error) {
+	accessClaims := services.AccessTokenClaims(user, orgID, time.Now())
+	for claim, value := range extra {
+		accessClaims[claim] = value
+	}
+	accessClaims["sid"] = session.ID.Hex()
+	refreshClaims := jwt.MapClaims{
+		"typ": services.RefreshTokenType,
+		"exp": session.ExpiresAt.Unix(),
+		"sid": session.ID.Hex(),
+	}
+	// clients can only revoke the tokens issued to them, and can't widen
+	// their scope when refreshing them
+	for _, claim := range []string{"client_id", "scope"} {
+		if value, ok := extra[claim]; ok {
+			refreshClaims[claim] = value
+		}
+	}
+
+	secret := os.Getenv("JWT_SECRET")
+	accToken, err := services.GenerateToken(jwt.SigningMethodHS256, accessClaims, &secret)
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken, err := services.GenerateToken(jwt.SigningMethodHS256, refreshClaims, &secret)
+	if err != nil {
+		return "", "", err
+	}
+	return *accToken, *refreshToken, nil
+}
+
+// errInvalidCredentials is the only error login reports for a wrong
+// identifier or password
+const errInvalidCredentials = "invalid login credentials"
+
+// discloseInactiveUsers reports whether users who get their password right
+// should be told that their account is inactive. It is set with the
+// LOGIN_DISCLOSE_INACTIVE env var and is off by default
+func discloseInactiveUsers() bool {
+	return os.Getenv("LOGIN_DISCLOSE_INACTIVE") == "true"
+}
+
+// findUserByIdentifier looks a user up by username, email or phone
+// depending on what identifier looks like. Identifiers that look like
+// phone numbers are also tried as usernames, as usernames can be numeric.
+func (s *Server) findUserByIdentifier(identifier string) (*models.User, error) {
+	normalized, kind := services.ParseIdentifier(identifier)
+	switch kind {
+	case services.EmailIdentifier:
+		return s.DB.FindUserByEmail(normalized)
+	case services.PhoneIdentifier:
+		user, err := s.DB.FindUserByPhone(normalized)
+		if err == mgo.ErrNotFound {
+			return s.DB.FindUserByUsername(strings.TrimSpace(identifier))
+		}
+		return user, err
+	default:
+		return s.DB.FindUserByUsername(normalized)
+	}
+}
+
 func (s *Server) handleLogout() gin.HandlerFunc {
 	return func(c *gin.Context) {
 
@@ -128,10 +275,12 @@ func (s *Server) handleLogout() gin.HandlerFunc {
 							RefreshToken string `json:"refresh_token,omitempty" binding:"required"`
 						}{}
 
-						if err := c.ShouldBindJSON(rt); err != nil {
-							log.Printf("no refresh token in request body: %v\n", err)
-							response.JSON(c, "", http.StatusBadRequest, nil, []string{"unauthorized"})
-							return
+						if rt.RefreshToken = services.GetTokenFromCookie(c, services.RefreshTokenCookie); rt.RefreshToken == "" {
+							if err := c.ShouldBindJSON(rt); err != nil {
+								log.Printf("no refresh token in request body: %v\n", err)
+								response.JSON(c, "", http.StatusBadRequest, nil, []string{"unauthorized"})
+								return
+							}
 						}
 
 						accBlacklist := &models.Blacklist{
@@ -159,6 +308,15 @@ func (s *Server) handleLogout() gin.HandlerFunc {
 							response.JSON(c, "logout failed", http.StatusInternalServerError, nil, []string{"couldn't revoke refresh token"})
 							return
 						}
+						if sid := c.GetString("session_id"); sid != "" {
+							if err := s.DB.RevokeSession(sid); err != nil {
+								log.Printf("revoke session error: %v\n", err)
+							}
+						}
+						if services.CookieMode() {
+							services.ClearTokenCookies(c)
+						}
+						s.audit(c, &audit.Event{Type: audit.Logout, Outcome: audit.Success, Subject: user.Email})
 						response.JSON(c, "logout successful", http.StatusOK, nil, nil)
 						return
 					}
@@ -197,20 +355,44 @@ func (s *Server) handleUpdateUserDetails() gin.HandlerFunc {
 		if userI, exists := c.Get("user"); exists {
 			if user, ok := userI.(*models.User); ok {
 
-				username, email := user.Username, user.Email
+				username, email, phone := user.Username, user.Email, user.Phone
+				id, status, roles, permissions := user.ID, user.Status, user.Roles, user.Permissions
+				memberships := user.Memberships
 				if errs := s.decode(c, user); errs != nil {
 					response.JSON(c, "", http.StatusBadRequest, nil, errs)
 					return
 				}
+				// phone numbers are stored in the E.164 format so users can
+				// log in with them, and can't be shared between users
+				if user.Phone != phone {
+					var err error
+					if user.Phone, err = services.NormalizePhone(user.Phone); err != nil {
+						response.JSON(c, "", http.StatusBadRequest, nil, []string{db.ValidationError{Field: "phone", Message: err.Error()}.Error()})
+						return
+					}
+					other, err := s.DB.FindUserByPhone(user.Phone)
+					if other != nil && other.ID != id {
+						response.JSON(c, "", http.StatusConflict, nil, []string{db.ValidationError{Field: "phone", Message: "already in use"}.Error()})
+						return
+					}
+					if other == nil && err != nil && err != mgo.ErrNotFound {
+						log.Printf("find user by phone error: %v\n", err)
+						response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+						return
+					}
+				}
 
 				//TODO try to eliminate this
 				user.Username, user.Email = username, email
+				user.ID, user.Status, user.Roles, user.Permissions = id, status, roles, permissions
+				user.Memberships = memberships
 				user.UpdatedAt = time.Now()
 				if err := s.DB.UpdateUser(user); err != nil {
 					log.Printf("update user error : %v\n", err)
 					response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
 					return
 				}
+				s.audit(c, &audit.Event{Type: audit.ProfileUpdate, Outcome: audit.Success, Subject: user.Email})
 				response.JSON(c, "user updated successfuly", http.StatusOK, nil, nil)
 				return
 			}
@@ -224,7 +406,13 @@ func (s *Server) handleGetUsers() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if userI, exists := c.Get("user"); exists {
 			if user, ok := userI.(*models.User); ok {
-				users, err := s.DB.FindAllUsersExcept(user.Email)
+				// users only see the members of their organization
+				orgID := middleware.OrgID(c)
+				if orgID == "" {
+					response.JSON(c, "retrieved users sucessfully", http.StatusOK, gin.H{"users": []models.User{}}, nil)
+					return
+				}
+				users, err := s.DB.FindOrgUsersExcept(orgID, user.Email)
 				if err != nil {
 					log.Printf("find users error : %v\n", err)
 					response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
@@ -242,25 +430,19 @@ func (s *Server) handleGetUsers() gin.HandlerFunc {
 
 func (s *Server) handleGetUserByUsername() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		name := &struct {
-			Username string `json:"username" binding:"required"`
-		}{}
-
-		if errs := s.decode(c, name); errs != nil {
-			response.JSON(c, "", http.StatusBadRequest, nil, errs)
-			return
-		}
-
-		user, err := s.DB.FindUserByUsername(name.Username)
+		user, err := s.DB.FindUserByUsername(c.Param("username"))
 		if err != nil {
-			if inactiveErr, ok := err.(servererrors.InActiveUserError); ok {
-				response.JSON(c, "", http.StatusBadRequest, nil, []string{inactiveErr.Error()})
-				return
-			}
+			// inactive users are reported as not found so the lookup
+			// can't be used to tell them apart from unknown ones
 			log.Printf("find user error : %v\n", err)
 			response.JSON(c, "user not found", http.StatusNotFound, nil, []string{"user not found"})
 			return
 		}
+		// users that can't see the details of someone don't learn they exist
+		if !middleware.Can(c, rbac.UsersRead, user) {
+			response.JSON(c, "user not found", http.StatusNotFound, nil, []string{"user not found"})
+			return
+		}
 
 		response.JSON(c, "user retrieved successfully", http.StatusOK, gin.H{
 			"email":      user.Email,
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/rbac"
+	"github.com/spankie/go-auth/server/middleware"
+	"github.com/spankie/go-auth/server/response"
+	"github.com/spankie/go-auth/services"
+)
+
+// impersonationValidity is how long an impersonation token can be used,
+// they can't be refreshed
+const impersonationValidity = 15 * time.Minute
+
+// handleImpersonate issues an access token letting an admin act as
+// another user. The token identifies the admin in an act claim as
+// described in RFC 8693.
+func (s *Server) handleImpersonate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if middleware.Actor(c) != "" {
+			response.JSON(c, "", http.StatusForbidden, nil, []string{"not allowed while impersonating a user"})
+			return
+		}
+		target, ok := s.adminTarget(c, rbac.Impersonate)
+		if !ok {
+			return
+		}
+		userI, _ := c.Get("user")
+		admin, _ := userI.(*models.User)
+		if isSelf(c, target) {
+			response.JSON(c, "", http.StatusBadRequest, nil, []string{"you can't impersonate yourself"})
+			return
+		}
+		if !target.IsActive() {
+			response.JSON(c, "", http.StatusBadRequest, nil, []string{"user is inactive"})
+			return
+		}
+
+		// stay in the organization the admin is looking at if possible
+		orgID := middleware.OrgID(c)
+		if target.Membership(orgID) == nil {
+			orgID = defaultOrgID(target)
+		}
+		// the token carries the permissions of the user, which the admin
+		// must already have
+		if !s.outranks(c, target, orgID) {
+			response.JSON(c, "", http.StatusForbidden, nil, []string{"forbidden"})
+			return
+		}
+		// the session shows up in the sessions of the user, who can end it
+		session, err := s.startSession(c, target, "Impersonation by "+admin.Email, impersonationValidity)
+		if err != nil {
+			log.Printf("create session error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		now := time.Now()
+		claims := services.AccessTokenClaims(target, orgID, now)
+		claims["typ"] = services.ImpersonationTokenType
+		claims["sid"] = session.ID.Hex()
+		claims["exp"] = now.Add(impersonationValidity).Unix()
+		claims["act"] = map[string]interface{}{"sub": admin.Email}
+
+		secret := os.Getenv("JWT_SECRET")
+		token, err := services.GenerateToken(jwt.SigningMethodHS256, claims, &secret)
+		if err != nil {
+			log.Printf("token generation error err: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		s.auditAdminAction(c, "started impersonating", target)
+		// the token is never set as a cookie so the admin's own session
+		// is left alone
+		response.JSON(c, "impersonation started", http.StatusOK, gin.H{
+			"access_token": *token,
+			"expires_in":   int(impersonationValidity.Seconds()),
+		}, nil)
+	}
+}
+
+// handleStopImpersonation revokes the impersonation token of the request
+func (s *Server) handleStopImpersonation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if middleware.Actor(c) == "" {
+			response.JSON(c, "", http.StatusBadRequest, nil, []string{"not impersonating a user"})
+			return
+		}
+		userI, _ := c.Get("user")
+		user, _ := userI.(*models.User)
+		// ending the session revokes the impersonation token
+		if err := s.DB.RevokeSession(c.GetString("session_id")); err != nil {
+			log.Printf("revoke session error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"couldn't revoke access token"})
+			return
+		}
+		s.auditAdminAction(c, "stopped impersonating", user)
+		response.JSON(c, "impersonation stopped", http.StatusOK, nil, nil)
+	}
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo"
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/rbac"
+	"github.com/spankie/go-auth/server/response"
+	"github.com/spankie/go-auth/servererrors"
+	"github.com/spankie/go-auth/services"
+)
+
+// invitationValidity is how long an invitation can be accepted for
+const invitationValidity = 7 * 24 * time.Hour
+
+// grantedPermissions returns the permissions of the user of the request,
+// global and within the organization they act for
+func grantedPermissions(c *gin.Context) []string {
+	permissionsI, _ := c.Get("permissions")
+	permissions, _ := permissionsI.([]string)
+	orgPermissionsI, _ := c.Get("org_permissions")
+	orgPermissions, _ := orgPermissionsI.([]string)
+	return append(append([]string{}, permissions...), orgPermissions...)
+}
+
+// grantable reports whether the user of the request holds every
+// permission roles grant, so nobody can invite people with more power
+// than they have
+func (s *Server) grantable(c *gin.Context, roles []string) bool {
+	for _, role := range roles {
+		if _, ok := s.Roles[role]; !ok {
+			return false
+		}
+	}
+	return rbac.Covers(grantedPermissions(c), s.Roles.Permissions(roles))
+}
+
+// handleCreateInvitation invites someone to join an organization by email
+func (s *Server) handleCreateInvitation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := s.orgFromParam(c, rbac.UsersManage)
+		if !ok {
+			return
+		}
+		inviteRequest := &struct {
+			Email string   `json:"email" binding:"required,email"`
+			Roles []string `json:"roles"`
+		}{}
+		if errs := s.decode(c, inviteRequest); errs != nil {
+			response.JSON(c, "", http.StatusBadRequest, nil, errs)
+			return
+		}
+		if len(inviteRequest.Roles) == 0 {
+			inviteRequest.Roles = []string{rbac.RoleUser}
+		}
+		if !s.grantable(c, inviteRequest.Roles) {
+			response.JSON(c, "", http.StatusForbidden, nil, []string{"you can't grant these roles"})
+			return
+		}
+
+		userI, _ := c.Get("user")
+		inviter, _ := userI.(*models.User)
+		invitation, err := s.DB.CreateInvitation(&models.Invitation{
+			OrgID:     org.ID,
+			Email:     services.NormalizeEmail(inviteRequest.Email),
+			Roles:     inviteRequest.Roles,
+			InvitedBy: inviter.Email,
+			Status:    models.InvitationPending,
+			ExpiresAt: time.Now().Add(invitationValidity),
+		})
+		if err != nil {
+			log.Printf("create invitation error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+
+		secret := os.Getenv("JWT_SECRET")
+		token, err := services.GenerateToken(jwt.SigningMethodHS256, jwt.MapClaims{
+			"typ":           services.InvitationTokenType,
+			"invitation_id": invitation.ID.Hex(),
+			"email":         invitation.Email,
+			"exp":           invitation.ExpiresAt.Unix(),
+		}, &secret)
+		if err != nil {
+			log.Printf("token generation error err: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+
+		body := fmt.Sprintf("Hi,\n\n%s invited you to join %s. Use this token to accept the invitation within the next week:\n\n%s\n", inviter.Email, org.Name, *token)
+		if inviteURL := os.Getenv("INVITATION_URL"); inviteURL != "" {
+			body = fmt.Sprintf("Hi,\n\n%s invited you to join %s. Follow this link to accept the invitation within the next week:\n\n%s?token=%s\n", inviter.Email, org.Name, inviteURL, url.QueryEscape(*token))
+		}
+		body += "\nIf you don't want to join, you can ignore this email.\n"
+		go func(to string) {
+			if err := s.Mailer.Send(to, "You're invited to join "+org.Name, body); err != nil {
+				log.Printf("send invitation email error: %v\n", err)
+			}
+		}(invitation.Email)
+
+		response.JSON(c, "invitation sent successfully", http.StatusCreated, gin.H{"invitation": invitation}, nil)
+	}
+}
+
+// handleListInvitations lists the pending invitations of an organization
+func (s *Server) handleListInvitations() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := s.orgFromParam(c, rbac.UsersManage)
+		if !ok {
+			return
+		}
+		invitations, err := s.DB.FindPendingInvitations(org.ID.Hex())
+		if err != nil {
+			log.Printf("find invitations error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		if invitations == nil {
+			invitations = []models.Invitation{}
+		}
+		response.JSON(c, "retrieved invitations successfully", http.StatusOK, gin.H{"invitations": invitations}, nil)
+	}
+}
+
+// handleRevokeInvitation revokes a pending invitation
+func (s *Server) handleRevokeInvitation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := s.orgFromParam(c, rbac.UsersManage)
+		if !ok {
+			return
+		}
+		invitation, err := s.DB.FindInvitationByID(c.Param("invitation_id"))
+		if err != nil || invitation.OrgID != org.ID {
+			log.Printf("find invitation error: %v\n", err)
+			response.JSON(c, "", http.StatusNotFound, nil, []string{"invitation not found"})
+			return
+		}
+		if err := s.DB.SetInvitationStatus(invitation.ID.Hex(), models.InvitationRevoked); err != nil {
+			if err == mgo.ErrNotFound {
+				response.JSON(c, "", http.StatusNotFound, nil, []string{"invitation not found"})
+				return
+			}
+			log.Printf("revoke invitation error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		response.JSON(c, "invitation revoked successfully", http.StatusOK, nil, nil)
+	}
+}
+
+// handleAcceptInvitation adds the invited person to the organization.
+// People who don't have an account yet sign up with the details in the
+// user field, using the email the invitation was sent to.
+func (s *Server) handleAcceptInvitation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		acceptRequest := &struct {
+			Token string       `json:"token" binding:"required"`
+			User  *models.User `json:"user"`
+		}{}
+		if errs := s.decode(c, acceptRequest); errs != nil {
+			response.JSON(c, "", http.StatusBadRequest, nil, errs)
+			return
+		}
+
+		invitation, ok := s.invitationFromToken(acceptRequest.Token)
+		if !ok {
+			response.JSON(c, "", http.StatusBadRequest, nil, []string{"invitation is invalid or has expired"})
+			return
+		}
+
+		user, err := s.DB.FindUserByEmail(invitation.Email)
+		register := false
+		switch err.(type) {
+		case nil:
+		case servererrors.InActiveUserError:
+			response.JSON(c, "", http.StatusForbidden, nil, []string{err.Error()})
+			return
+		default:
+			if err != mgo.ErrNotFound {
+				log.Printf("find user by email error: %v\n", err)
+				response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+				return
+			}
+			if acceptRequest.User == nil {
+				response.JSON(c, "", http.StatusBadRequest, nil, []string{"user details are required to sign up"})
+				return
+			}
+			register = true
+		}
+
+		// claim the invitation first so it can't be used twice, and give
+		// it back if accepting it fails so it can be tried again
+		if err := s.DB.SetInvitationStatus(invitation.ID.Hex(), models.InvitationAccepted); err != nil {
+			log.Printf("accept invitation error: %v\n", err)
+			response.JSON(c, "", http.StatusBadRequest, nil, []string{"invitation is invalid or has expired"})
+			return
+		}
+		if register {
+			// the invitation proves the email belongs to them
+			acceptRequest.User.Email = invitation.Email
+			if user, ok = s.registerUser(c, acceptRequest.User); !ok {
+				s.releaseInvitation(invitation)
+				return
+			}
+		}
+		membership := models.Membership{OrgID: invitation.OrgID, Roles: invitation.Roles}
+		if err := s.DB.AddMembership(user.ID.Hex(), membership); err != nil {
+			log.Printf("add membership error: %v\n", err)
+			s.releaseInvitation(invitation)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		response.JSON(c, "invitation accepted successfully", http.StatusOK, gin.H{"membership": membership}, nil)
+	}
+}
+
+// releaseInvitation makes an invitation claimed by a failed attempt to
+// accept it pending again
+func (s *Server) releaseInvitation(invitation *models.Invitation) {
+	if err := s.DB.ReleaseInvitation(invitation.ID.Hex()); err != nil {
+		log.Printf("release invitation error: %v\n", err)
+	}
+}
+
+// invitationFromToken returns the pending invitation token was issued for
+func (s *Server) invitationFromToken(token string) (*models.Invitation, bool) {
+	secret := os.Getenv("JWT_SECRET")
+	_, claims, err := services.AuthorizeToken(&token, &secret)
+	if err != nil {
+		log.Printf("authorize invitation token error: %v\n", err)
+		return nil, false
+	}
+	id, _ := claims["invitation_id"].(string)
+	email, _ := claims["email"].(string)
+	exp, _ := claims["exp"].(float64)
+	if services.TokenType(claims) != services.InvitationTokenType || id == "" || time.Now().Unix() > int64(exp) {
+		return nil, false
+	}
+	invitation, err := s.DB.FindInvitationByID(id)
+	if err != nil {
+		log.Printf("find invitation error: %v\n", err)
+		return nil, false
+	}
+	if !invitation.IsPending() || invitation.Email != email {
+		return nil, false
+	}
+	return invitation, true
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo"
+	"github.com/spankie/go-auth/audit"
+	"github.com/spankie/go-auth/models"
+)
+
+const (
+	defaultLockoutThreshold = 5
+	defaultLockoutDuration  = 15 * time.Minute
+)
+
+// lockoutPolicy returns the number of consecutive failed logins that lock
+// an account and how long it stays locked, from the LOCKOUT_THRESHOLD and
+// LOCKOUT_DURATION env vars. A threshold of 0 disables lockouts and a
+// duration of 0 keeps accounts locked until their status is changed.
+func lockoutPolicy() (int, time.Duration) {
+	threshold, duration := defaultLockoutThreshold, defaultLockoutDuration
+	if v := os.Getenv("LOCKOUT_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Printf("invalid LOCKOUT_THRESHOLD: %v\n", err)
+		} else {
+			threshold = n
+		}
+	}
+	if v := os.Getenv("LOCKOUT_DURATION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Printf("invalid LOCKOUT_DURATION: %v\n", err)
+		} else {
+			duration = d
+		}
+	}
+	return threshold, duration
+}
+
+// recordFailedLogin counts a failed login for user and locks the account
+// once there are too many in a row
+func (s *Server) recordFailedLogin(c *gin.Context, user *models.User) {
+	count, err := s.DB.IncrementFailedLogins(user.Email)
+	if err != nil {
+		log.Printf("increment failed logins error: %v\n", err)
+		return
+	}
+	threshold, duration := lockoutPolicy()
+	if threshold <= 0 || count < threshold {
+		return
+	}
+
+	until := time.Time{}
+	if duration > 0 {
+		until = time.Now().Add(duration)
+	}
+	// the user may have been changed since it was found, so only the
+	// lock is saved, and only if the user is still active
+	if err := s.DB.LockUser(user.Email, until); err != nil {
+		if err != mgo.ErrNotFound {
+			log.Printf("lock user error: %v\n", err)
+		}
+		return
+	}
+	user.Status = models.StatusLocked
+	user.FailedLogins = 0
+	user.LockedUntil = until
+	log.Printf("user %s locked after %d failed logins\n", user.Email, count)
+	s.audit(c, &audit.Event{
+		Type:    audit.AccountLocked,
+		Outcome: audit.Success,
+		Subject: user.Email,
+		Details: map[string]string{"failed_logins": strconv.Itoa(count)},
+	})
+
+	body := fmt.Sprintf("Hi %s,\n\nYour account was locked after %d failed login attempts.\n", user.FirstName, count)
+	if user.LockedUntil.IsZero() {
+		body += "Please contact support to unlock it.\n"
+	} else {
+		body += fmt.Sprintf("You can try again after %s.\n", user.LockedUntil.Format(time.RFC1123))
+	}
+	body += "If this wasn't you, consider changing your password once you can log in.\n"
+	go func(to string) {
+		if err := s.Mailer.Send(to, "Your account has been locked", body); err != nil {
+			log.Printf("send lockout email error: %v\n", err)
+		}
+	}(user.Email)
+}
+
+// resetFailedLogins clears the failed logins and any expired lock after a
+// successful login
+func (s *Server) resetFailedLogins(user *models.User) {
+	if user.FailedLogins == 0 && user.Status != models.StatusLocked {
+		return
+	}
+	if err := s.DB.ResetFailedLogins(user.Email); err != nil {
+		if err != mgo.ErrNotFound {
+			log.Printf("reset failed logins error: %v\n", err)
+		}
+		return
+	}
+	user.Status = models.StatusActive
+	user.FailedLogins = 0
+	user.LockedUntil = time.Time{}
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spankie/go-auth/audit"
+	"github.com/spankie/go-auth/models"
+)
+
+// RecordEvent fills in the details of event that come from the request
+// and records it with sink. The actor defaults to the admin impersonating
+// the user, or the user of the request. Errors are logged since failing
+// to audit shouldn't fail the request.
+func RecordEvent(c *gin.Context, sink audit.AuditSink, event *audit.Event) {
+	event.Time = time.Now()
+	event.IP = ClientIP(c)
+	event.UserAgent = c.Request.UserAgent()
+	if event.OrgID == "" {
+		event.OrgID = OrgID(c)
+	}
+	if event.Actor == "" {
+		if event.Actor = Actor(c); event.Actor == "" {
+			userI, _ := c.Get("user")
+			if user, ok := userI.(*models.User); ok {
+				event.Actor = user.Email
+			}
+		}
+	}
+	if err := sink.RecordEvent(event); err != nil {
+		log.Printf("record audit event error: %v\n", err)
+	}
+}
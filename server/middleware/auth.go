@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"os"
@@ -8,40 +9,63 @@ import (
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
+	"github.com/spankie/go-auth/audit"
 	"github.com/spankie/go-auth/models"
 	"github.com/spankie/go-auth/server/response"
 	"github.com/spankie/go-auth/servererrors"
 	"github.com/spankie/go-auth/services"
 )
 
-// Authorize authorizes a request
-func Authorize(findUserByEmail func(string) (*models.User, error), tokenInBlacklist func(*string) bool) gin.HandlerFunc {
+// sessionTouchInterval is how often the last use of a session is recorded
+const sessionTouchInterval = time.Minute
+
+// Sessions gives Authorize access to the server side records of sessions
+type Sessions interface {
+	FindSessionByID(id string) (*models.Session, error)
+	TouchSession(id string, seen time.Time, ip string) error
+}
+
+// Authorize authorizes a request. Tokens from revoked sessions are
+// rejected and access token refreshes are recorded with sink.
+func Authorize(findUserByEmail func(string) (*models.User, error), tokenInBlacklist func(*string) bool, sessions Sessions, sink audit.AuditSink) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		secret := os.Getenv("JWT_SECRET")
-		accToken := services.GetTokenFromHeader(c)
+		accToken := services.GetAccessToken(c)
 		accessToken, accessClaims, err := services.AuthorizeToken(&accToken, &secret)
 		if err != nil {
 			log.Printf("authorize access token error: %s\n", err.Error())
 			respondAndAbort(c, "", http.StatusUnauthorized, nil, []string{"unauthorized"})
 			return
 		}
+		if typ := services.TokenType(accessClaims); typ != services.AccessTokenType && typ != services.ImpersonationTokenType {
+			log.Printf("authorize access token error: unexpected token type %q\n", typ)
+			respondAndAbort(c, "", http.StatusUnauthorized, nil, []string{"unauthorized"})
+			return
+		}
 
 		//TODO find a way to make sure accesstoken wont be nil, because we allow
 		//a token is epired error to reach here accessToken will be nill
 		//when that happens
-		if tokenInBlacklist(&accessToken.Raw) || isTokenExpired(accessClaims) {
+		if tokenInBlacklist(&accessToken.Raw) || TokenExpired(accessClaims) {
+			email, _ := accessClaims["user_email"].(string)
+			refreshFailed := func(reason string) {
+				RecordEvent(c, sink, &audit.Event{Type: audit.TokenRefresh, Outcome: audit.Failure, Subject: email, Actor: email, Reason: reason})
+			}
 			rt := &struct {
 				RefreshToken string `json:"refresh_token,omitempty" binding:"required"`
 			}{}
 
-			if err := c.ShouldBindJSON(rt); err != nil {
-				log.Printf("no refresh token in request body: %v\n", err)
-				respondAndAbort(c, "", http.StatusBadRequest, nil, []string{"unauthorized"})
-				return
+			if rt.RefreshToken = services.GetTokenFromCookie(c, services.RefreshTokenCookie); rt.RefreshToken == "" {
+				if err := c.ShouldBindJSON(rt); err != nil {
+					log.Printf("no refresh token in request body: %v\n", err)
+					respondAndAbort(c, "", http.StatusBadRequest, nil, []string{"unauthorized"})
+					return
+				}
 			}
 
 			if tokenInBlacklist(&rt.RefreshToken) {
 				log.Printf("refresh token is blacklisted: %v\n", err)
+				refreshFailed("refresh token revoked")
 				respondAndAbort(c, "", http.StatusUnauthorized, nil, []string{"refresh token is invalid"})
 				return
 			}
@@ -49,30 +73,71 @@ func Authorize(findUserByEmail func(string) (*models.User, error), tokenInBlackl
 			_, rtClaims, err := services.AuthorizeToken(&rt.RefreshToken, &secret)
 			if err != nil {
 				log.Printf("authorize refresh token error: %v\n", err)
+				refreshFailed("invalid refresh token")
 				respondAndAbort(c, "", http.StatusUnauthorized, nil, []string{"refresh token is invalid"})
 				return
 			}
 
-			if isTokenExpired(rtClaims) {
+			if TokenExpired(rtClaims) {
 				log.Printf("refresh token is expired")
+				refreshFailed("refresh token expired")
 				respondAndAbort(c, "", http.StatusUnauthorized, nil, []string{"refresh token is invalid"})
 				return
 			}
 
-			if sub, ok := rtClaims["sub"].(float64); ok && sub != 1 {
-				log.Printf("invalid refresh token, the sub claim isn't correct")
+			if sid, _ := rtClaims["sid"].(string); services.TokenType(rtClaims) != services.RefreshTokenType || sid == "" {
+				log.Printf("invalid refresh token, the typ or sid claim isn't correct")
+				refreshFailed("invalid refresh token")
 				respondAndAbort(c, "", http.StatusUnauthorized, nil, []string{"refresh token is invalid"})
 				return
 			}
 
-			//generate a new access token, and rest its exp time
-			accessClaims["exp"] = time.Now().Add(services.AccessTokenValidity).Unix()
-			newAccessToken, err := services.GenerateToken(jwt.SigningMethodHS256, accessClaims, &secret)
+			// impersonation tokens are short lived on purpose
+			if services.ActorClaim(accessClaims) != "" {
+				log.Printf("impersonation token can't be refreshed")
+				refreshFailed("impersonation token")
+				respondAndAbort(c, "", http.StatusUnauthorized, nil, []string{"impersonation has ended"})
+				return
+			}
+
+			// the user may have been logged out everywhere since the
+			// session started
+			user, err := findUserByEmail(email)
+			if err == nil && !TokensRevoked(accessClaims, user) {
+				_, err = ActiveSession(sessions, rtClaims, user)
+			}
+			if err != nil || TokensRevoked(accessClaims, user) {
+				log.Printf("session can't be refreshed: %v\n", err)
+				refreshFailed("session revoked")
+				respondAndAbort(c, "", http.StatusUnauthorized, nil, []string{"refresh token is invalid"})
+				return
+			}
+
+			// the claims are built again from the user so that changes to
+			// their roles, permissions and memberships are picked up
+			orgID, _ := accessClaims["org_id"].(string)
+			if user.Membership(orgID) == nil {
+				orgID = ""
+			}
+			authTime, _ := accessClaims["auth_time"].(float64)
+			newClaims := services.AccessTokenClaims(user, orgID, time.Unix(int64(authTime), 0))
+			for _, claim := range []string{"sid", "client_id", "scope"} {
+				if value, ok := accessClaims[claim]; ok {
+					newClaims[claim] = value
+				}
+			}
+			newAccessToken, err := services.GenerateToken(jwt.SigningMethodHS256, newClaims, &secret)
 			if err != nil {
 				log.Printf("can't generate new access token: %v\n", err)
 				respondAndAbort(c, "", http.StatusUnauthorized, nil, []string{"can't generate new access token"})
 				return
 			}
+			RecordEvent(c, sink, &audit.Event{Type: audit.TokenRefresh, Outcome: audit.Success, Subject: email, Actor: email})
+			if services.CookieMode() {
+				services.SetTokenCookie(c, services.AccessTokenCookie, *newAccessToken, int(services.AccessTokenValidity.Seconds()))
+				respondAndAbort(c, "new access token generated", http.StatusOK, nil, []string{"access token is invalid"})
+				return
+			}
 			respondAndAbort(c, "new access token generated", http.StatusOK, gin.H{"access_token": *newAccessToken}, []string{"access token is invalid"})
 			return
 		}
@@ -94,9 +159,28 @@ func Authorize(findUserByEmail func(string) (*models.User, error), tokenInBlackl
 			return
 		}
 
+		if TokensRevoked(accessClaims, user) {
+			log.Printf("access token of %s was revoked\n", user.Email)
+			respondAndAbort(c, "", http.StatusUnauthorized, nil, []string{"unauthorized"})
+			return
+		}
+		session, err := ActiveSession(sessions, accessClaims, user)
+		if err != nil {
+			log.Printf("access token of %s rejected: %v\n", user.Email, err)
+			respondAndAbort(c, "", http.StatusUnauthorized, nil, []string{"unauthorized"})
+			return
+		}
+		if time.Since(session.LastSeenAt) > sessionTouchInterval {
+			if err := sessions.TouchSession(session.ID.Hex(), time.Now(), ClientIP(c)); err != nil {
+				log.Printf("touch session error: %v\n", err)
+			}
+		}
+		c.Set("session_id", session.ID.Hex())
+
 		// set the user and token as context parameters.
 		c.Set("user", user)
 		c.Set("access_token", accessToken.Raw)
+		c.Set("claims", accessClaims)
 		// calling next handler
 		c.Next()
 	}
@@ -109,9 +193,38 @@ func respondAndAbort(c *gin.Context, message string, status int, data interface{
 	c.Abort()
 }
 
-func isTokenExpired(claims jwt.MapClaims) bool {
+// TokenExpired reports whether the exp claim of a token is in the past or
+// missing
+func TokenExpired(claims jwt.MapClaims) bool {
 	if exp, ok := claims["exp"].(float64); ok {
 		return float64(time.Now().Unix()) > exp
 	}
 	return true
 }
+
+// TokensRevoked reports whether the session a token belongs to started
+// before the tokens of user were revoked
+func TokensRevoked(claims jwt.MapClaims, user *models.User) bool {
+	if user.TokensValidAfter.IsZero() {
+		return false
+	}
+	authTime, _ := claims["auth_time"].(float64)
+	return int64(authTime) < user.TokensValidAfter.Unix()
+}
+
+// ActiveSession returns the session a token was issued for, or an error if
+// it was revoked or the token has no session
+func ActiveSession(sessions Sessions, claims jwt.MapClaims, user *models.User) (*models.Session, error) {
+	sid, _ := claims["sid"].(string)
+	if sid == "" {
+		return nil, errors.New("token has no session")
+	}
+	session, err := sessions.FindSessionByID(sid)
+	if err != nil {
+		return nil, err
+	}
+	if session.UserID != user.ID || !session.IsActive() {
+		return nil, errors.New("session was revoked")
+	}
+	return session, nil
+}
@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultMaxBodySize is the largest request body accepted by default. The
+// API only takes small JSON and form bodies.
+const DefaultMaxBodySize = 64 << 10
+
+// MaxBodySize stops reading request bodies after limit bytes, making
+// their decoding fail, so that huge bodies can't be used to exhaust
+// memory or CPU
+func MaxBodySize(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Body != nil {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TrustedProxies are the networks of the proxies whose X-Forwarded-For
+// headers are believed when finding the IP address of clients
+type TrustedProxies []*net.IPNet
+
+// TrustedProxiesFromEnv returns the proxies in the comma separated
+// TRUSTED_PROXIES env var, given as IP addresses or CIDR ranges. No proxy
+// is trusted if it isn't set.
+func TrustedProxiesFromEnv() TrustedProxies {
+	var proxies TrustedProxies
+	for _, item := range splitList(os.Getenv("TRUSTED_PROXIES")) {
+		network, err := parseNetwork(item)
+		if err != nil {
+			log.Printf("invalid TRUSTED_PROXIES entry %q: %v\n", item, err)
+			continue
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies
+}
+
+// parseNetwork parses s as a CIDR range, or as a single IP address
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, &net.ParseError{Type: "IP address", Text: s}
+	}
+	bits := 8 * net.IPv4len
+	if ip.To4() == nil {
+		bits = 8 * net.IPv6len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// trusts reports whether ip belongs to one of the proxies
+func (p TrustedProxies) trusts(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range p {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address r came from. The X-Forwarded-For header is
+// only followed through the proxies in p, since anyone else can set it.
+func (p TrustedProxies) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		ip = strings.TrimSpace(r.RemoteAddr)
+	}
+	if !p.trusts(ip) {
+		return ip
+	}
+
+	// each proxy appends the address it got the request from, so the
+	// client is the last address that wasn't added by a trusted proxy
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !p.trusts(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// RealIP finds the IP address of the client of the request, trusting the
+// X-Forwarded-For header set by proxies, and keeps it for ClientIP
+func RealIP(proxies TrustedProxies) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("client_ip", proxies.clientIP(c.Request))
+		c.Next()
+	}
+}
+
+// ClientIP returns the IP address of the client found by RealIP, or the
+// address the request came from if RealIP wasn't used. It also keys rate
+// limits by client.
+func ClientIP(c *gin.Context) string {
+	if ip := c.GetString("client_ip"); ip != "" {
+		return ip
+	}
+	return TrustedProxies(nil).clientIP(c.Request)
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrustedProxiesFromEnv(t *testing.T) {
+	os.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.1, not-an-ip, 2001:db8::1")
+	defer os.Unsetenv("TRUSTED_PROXIES")
+
+	proxies := TrustedProxiesFromEnv()
+	assert.Len(t, proxies, 3)
+	assert.True(t, proxies.trusts("10.1.2.3"))
+	assert.True(t, proxies.trusts("192.0.2.1"))
+	assert.False(t, proxies.trusts("192.0.2.2"))
+	assert.True(t, proxies.trusts("2001:db8::1"))
+	assert.False(t, proxies.trusts("2001:db8::2"))
+}
+
+func TestClientIP(t *testing.T) {
+	proxies := TrustedProxies{}
+	for _, item := range []string{"10.0.0.0/8", "192.0.2.1"} {
+		network, err := parseNetwork(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxies = append(proxies, network)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		ip         string
+	}{
+		{name: "direct", remoteAddr: "203.0.113.7:1234", ip: "203.0.113.7"},
+		{name: "spoofed header", remoteAddr: "203.0.113.7:1234", forwarded: []string{"198.51.100.1"}, ip: "203.0.113.7"},
+		{name: "trusted proxy", remoteAddr: "192.0.2.1:1234", forwarded: []string{"198.51.100.1"}, ip: "198.51.100.1"},
+		{name: "chain of proxies", remoteAddr: "10.0.0.1:1234", forwarded: []string{"198.51.100.1, 10.0.0.2"}, ip: "198.51.100.1"},
+		{name: "spoofed header through a proxy", remoteAddr: "192.0.2.1:1234", forwarded: []string{"1.1.1.1, 198.51.100.1"}, ip: "198.51.100.1"},
+		{name: "several headers", remoteAddr: "192.0.2.1:1234", forwarded: []string{"1.1.1.1", "198.51.100.1"}, ip: "198.51.100.1"},
+		{name: "garbage", remoteAddr: "192.0.2.1:1234", forwarded: []string{"198.51.100.1, garbage"}, ip: "192.0.2.1"},
+		{name: "no header", remoteAddr: "192.0.2.1:1234", ip: "192.0.2.1"},
+		{name: "only proxies", remoteAddr: "10.0.0.1:1234", forwarded: []string{"10.0.0.2"}, ip: "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			assert.Equal(t, tt.ip, proxies.clientIP(req))
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+// CORSPolicy describes the cross-origin requests allowed by the server
+type CORSPolicy struct {
+	// AllowedOrigins are either exact origins like https://app.example.com,
+	// or patterns like https://*.example.com matching any subdomain.
+	// "*" allows any origin but can't be used with AllowCredentials.
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// DefaultCORSPolicy returns a policy allowing the methods and headers the
+// API uses, for no origin
+func DefaultCORSPolicy() *CORSPolicy {
+	return &CORSPolicy{
+		AllowedMethods:   []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", "X-CSRF-Token"},
+		ExposedHeaders:   []string{"Content-Length", "Retry-After"},
+		AllowCredentials: true,
+		MaxAge:           12 * time.Hour,
+	}
+}
+
+// CORSPolicyFromEnv returns the default policy updated with the comma
+// separated CORS_ALLOWED_ORIGINS and CORS_ALLOWED_HEADERS env vars, and
+// the CORS_ALLOW_CREDENTIALS and CORS_MAX_AGE env vars
+func CORSPolicyFromEnv() *CORSPolicy {
+	p := DefaultCORSPolicy()
+	p.AllowedOrigins = splitList(os.Getenv("CORS_ALLOWED_ORIGINS"))
+	p.AllowedHeaders = append(p.AllowedHeaders, splitList(os.Getenv("CORS_ALLOWED_HEADERS"))...)
+	if v := os.Getenv("CORS_ALLOW_CREDENTIALS"); v != "" {
+		p.AllowCredentials = v == "true"
+	}
+	if v := os.Getenv("CORS_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Printf("invalid CORS_MAX_AGE: %v\n", err)
+		} else {
+			p.MaxAge = d
+		}
+	}
+	return p
+}
+
+// CORSOverridesFromEnv returns the overrides of policy in the CORS_OVERRIDES
+// env var, given as semicolon separated path prefixes with the comma
+// separated origins they allow, e.g.
+// "/api/v1/oauth/jwks=*;/api/v1/auth=https://login.example.com". The
+// overrides are otherwise the same as policy, except that those allowing
+// any origin don't allow credentials. Invalid entries are logged and
+// skipped.
+func CORSOverridesFromEnv(policy *CORSPolicy) map[string]*CORSPolicy {
+	overrides := map[string]*CORSPolicy{}
+	for _, entry := range strings.Split(os.Getenv("CORS_OVERRIDES"), ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		prefix := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || !strings.HasPrefix(prefix, "/") {
+			log.Printf("invalid CORS_OVERRIDES entry %q: expected /path=origins\n", entry)
+			continue
+		}
+		override := *policy
+		override.AllowedOrigins = splitList(parts[1])
+		for _, origin := range override.AllowedOrigins {
+			if origin == "*" {
+				override.AllowCredentials = false
+			}
+		}
+		if err := override.Validate(); err != nil {
+			log.Printf("invalid CORS_OVERRIDES entry %q: %v\n", entry, err)
+			continue
+		}
+		overrides[prefix] = &override
+	}
+	return overrides
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Validate checks that the allowed origins are well formed
+func (p *CORSPolicy) Validate() error {
+	for _, pattern := range p.AllowedOrigins {
+		if pattern == "*" {
+			if p.AllowCredentials {
+				return fmt.Errorf("cors: any origin can't be allowed along with credentials")
+			}
+			continue
+		}
+		u, err := url.Parse(pattern)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("cors: invalid origin %q", pattern)
+		}
+		if strings.Contains(strings.TrimPrefix(u.Host, "*."), "*") {
+			return fmt.Errorf("cors: only the first label of %q can be a wildcard", pattern)
+		}
+	}
+	return nil
+}
+
+// AllowsOrigin reports whether requests from origin are allowed
+func (p *CORSPolicy) AllowsOrigin(origin string) bool {
+	o, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range p.AllowedOrigins {
+		if pattern == "*" || strings.TrimSuffix(pattern, "/") == origin {
+			return true
+		}
+		u, err := url.Parse(pattern)
+		if err != nil || !strings.HasPrefix(u.Host, "*.") {
+			continue
+		}
+		suffix := u.Hostname()[1:]
+		host := o.Hostname()
+		if o.Scheme == u.Scheme && o.Port() == u.Port() &&
+			strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *CORSPolicy) handler() gin.HandlerFunc {
+	if err := p.Validate(); err != nil {
+		panic(err)
+	}
+	return cors.New(cors.Config{
+		AllowOriginFunc:  p.AllowsOrigin,
+		AllowMethods:     p.AllowedMethods,
+		AllowHeaders:     p.AllowedHeaders,
+		ExposeHeaders:    p.ExposedHeaders,
+		AllowCredentials: p.AllowCredentials,
+		MaxAge:           p.MaxAge,
+	})
+}
+
+// CORS applies policy to cross-origin requests, or the policy in
+// overrides registered for the longest prefix of the request path, e.g.
+// "/api/v1/auth". It must be used on the engine so preflight requests
+// reach it.
+func CORS(policy *CORSPolicy, overrides map[string]*CORSPolicy) gin.HandlerFunc {
+	defaultHandler := policy.handler()
+	handlers := make(map[string]gin.HandlerFunc, len(overrides))
+	for prefix, override := range overrides {
+		handlers[prefix] = override.handler()
+	}
+
+	return func(c *gin.Context) {
+		handler, longest := defaultHandler, -1
+		for prefix, h := range handlers {
+			if strings.HasPrefix(c.Request.URL.Path, prefix) && len(prefix) > longest {
+				handler, longest = h, len(prefix)
+			}
+		}
+		handler(c)
+	}
+}
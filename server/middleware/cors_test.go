@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORSPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     []string
+		credentials bool
+		wantErr     bool
+	}{
+		{name: "exact", origins: []string{"https://app.example.com", "http://localhost:3000/"}, credentials: true},
+		{name: "subdomains", origins: []string{"https://*.example.com"}, credentials: true},
+		{name: "any origin", origins: []string{"*"}},
+		{name: "any origin with credentials", origins: []string{"*"}, credentials: true, wantErr: true},
+		{name: "no scheme", origins: []string{"app.example.com"}, wantErr: true},
+		{name: "path", origins: []string{"https://app.example.com/login"}, wantErr: true},
+		{name: "inner wildcard", origins: []string{"https://app.*.com"}, wantErr: true},
+		{name: "double wildcard", origins: []string{"https://*.*.example.com"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &CORSPolicy{AllowedOrigins: tt.origins, AllowCredentials: tt.credentials}
+			if tt.wantErr {
+				assert.Error(t, p.Validate())
+			} else {
+				assert.NoError(t, p.Validate())
+			}
+		})
+	}
+}
+
+func TestCORSPolicyAllowsOrigin(t *testing.T) {
+	p := &CORSPolicy{AllowedOrigins: []string{"https://app.example.com/", "https://*.example.org", "http://*.localhost:3000"}}
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{origin: "https://app.example.com", allowed: true},
+		{origin: "http://app.example.com", allowed: false},
+		{origin: "https://app.example.com:8443", allowed: false},
+		{origin: "https://evil.com", allowed: false},
+		{origin: "https://app.example.com.evil.com", allowed: false},
+		{origin: "https://a.example.org", allowed: true},
+		{origin: "https://a.b.example.org", allowed: true},
+		{origin: "https://example.org", allowed: false},
+		{origin: "https://evilexample.org", allowed: false},
+		{origin: "http://a.example.org", allowed: false},
+		{origin: "http://app.localhost:3000", allowed: true},
+		{origin: "http://app.localhost:4000", allowed: false},
+		{origin: "null", allowed: false},
+		{origin: "%zz", allowed: false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.allowed, p.AllowsOrigin(tt.origin), tt.origin)
+	}
+	assert.True(t, (&CORSPolicy{AllowedOrigins: []string{"*"}}).AllowsOrigin("https://evil.com"))
+}
+
+func TestCORSOverrides(t *testing.T) {
+	policy := DefaultCORSPolicy()
+	policy.AllowedOrigins = []string{"https://app.example.com"}
+	auth := DefaultCORSPolicy()
+	auth.AllowedOrigins = []string{"https://login.example.com"}
+	router := gin.New()
+	router.Use(CORS(policy, map[string]*CORSPolicy{"/api/v1/auth": auth}))
+	router.GET("/*path", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		path   string
+		origin string
+		status int
+	}{
+		{path: "/api/v1/me", origin: "https://app.example.com", status: http.StatusNoContent},
+		{path: "/api/v1/me", origin: "https://login.example.com", status: http.StatusForbidden},
+		{path: "/api/v1/auth/login", origin: "https://login.example.com", status: http.StatusNoContent},
+		{path: "/api/v1/auth/login", origin: "https://app.example.com", status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", tt.path, nil)
+		req.Header.Set("Origin", tt.origin)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, tt.status, w.Code, "%s from %s", tt.path, tt.origin)
+		if tt.status == http.StatusNoContent {
+			assert.Equal(t, tt.origin, w.Header().Get("Access-Control-Allow-Origin"))
+		}
+	}
+}
+
+func TestCORSOverridesFromEnv(t *testing.T) {
+	os.Setenv("CORS_OVERRIDES", " /api/v1/oauth/jwks=* ; /api/v1/auth=https://login.example.com, https://admin.example.com;api=https://app.example.com;/bad;/invalid=app.example.com")
+	defer os.Unsetenv("CORS_OVERRIDES")
+
+	policy := DefaultCORSPolicy()
+	policy.AllowedOrigins = []string{"https://app.example.com"}
+	overrides := CORSOverridesFromEnv(policy)
+	assert.Len(t, overrides, 2)
+
+	jwks := overrides["/api/v1/oauth/jwks"]
+	if assert.NotNil(t, jwks) {
+		assert.Equal(t, []string{"*"}, jwks.AllowedOrigins)
+		assert.False(t, jwks.AllowCredentials)
+		assert.Equal(t, policy.AllowedMethods, jwks.AllowedMethods)
+	}
+	auth := overrides["/api/v1/auth"]
+	if assert.NotNil(t, auth) {
+		assert.Equal(t, []string{"https://login.example.com", "https://admin.example.com"}, auth.AllowedOrigins)
+		assert.True(t, auth.AllowCredentials)
+	}
+	assert.Equal(t, []string{"https://app.example.com"}, policy.AllowedOrigins)
+}
+
+func TestCORSPanicsOnInvalidPolicy(t *testing.T) {
+	assert.Panics(t, func() {
+		CORS(&CORSPolicy{AllowedOrigins: []string{"*"}, AllowCredentials: true}, nil)
+	})
+}
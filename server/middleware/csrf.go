@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spankie/go-auth/services"
+)
+
+// CSRF rejects unsafe requests authenticated by cookies that don't send
+// the CSRF token issued at login for their session in the X-CSRF-Token
+// header. It must run after Authorize, which finds the session. Requests
+// using an authorization header can't be forged by other sites and are
+// let through.
+func CSRF() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		if !services.CookieMode() || services.GetTokenFromHeader(c) != "" {
+			c.Next()
+			return
+		}
+		if services.GetTokenFromCookie(c, services.AccessTokenCookie) == "" &&
+			services.GetTokenFromCookie(c, services.RefreshTokenCookie) == "" {
+			c.Next()
+			return
+		}
+
+		cookie, _ := c.Cookie(services.CSRFTokenCookie)
+		if !services.ValidCSRFToken(cookie, c.GetHeader(services.CSRFTokenHeader), os.Getenv("JWT_SECRET"), c.GetString("session_id")) {
+			log.Printf("invalid csrf token on %s %s\n", c.Request.Method, c.Request.URL.Path)
+			respondAndAbort(c, "", http.StatusForbidden, nil, []string{"invalid csrf token"})
+			return
+		}
+		c.Next()
+	}
+}
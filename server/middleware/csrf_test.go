@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spankie/go-auth/services"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSRF(t *testing.T) {
+	os.Setenv("JWT_SECRET", "test-secret")
+	os.Setenv("AUTH_COOKIES", "true")
+	defer os.Unsetenv("AUTH_COOKIES")
+
+	token, err := services.NewCSRFToken("test-secret", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("session_id", "session")
+	}, CSRF())
+	router.Any("/", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name          string
+		method        string
+		authorization string
+		cookies       map[string]string
+		header        string
+		status        int
+	}{
+		{
+			name:    "safe method",
+			method:  http.MethodGet,
+			cookies: map[string]string{services.AccessTokenCookie: "access"},
+			status:  http.StatusNoContent,
+		},
+		{
+			name:    "valid token",
+			method:  http.MethodPost,
+			cookies: map[string]string{services.AccessTokenCookie: "access", services.CSRFTokenCookie: token},
+			header:  token,
+			status:  http.StatusNoContent,
+		},
+		{
+			name:    "no token",
+			method:  http.MethodPost,
+			cookies: map[string]string{services.AccessTokenCookie: "access", services.CSRFTokenCookie: token},
+			status:  http.StatusForbidden,
+		},
+		{
+			name:    "refresh token cookie",
+			method:  http.MethodDelete,
+			cookies: map[string]string{services.RefreshTokenCookie: "refresh"},
+			header:  token,
+			status:  http.StatusForbidden,
+		},
+		{
+			name:          "authorization header",
+			method:        http.MethodPost,
+			authorization: "Bearer access-token",
+			cookies:       map[string]string{services.AccessTokenCookie: "access"},
+			status:        http.StatusNoContent,
+		},
+		{
+			name:   "no auth cookies",
+			method: http.MethodPost,
+			status: http.StatusNoContent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(tt.method, "/", nil)
+			for name, value := range tt.cookies {
+				req.AddCookie(&http.Cookie{Name: name, Value: value})
+			}
+			if tt.header != "" {
+				req.Header.Set(services.CSRFTokenHeader, tt.header)
+			}
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.status, w.Code)
+		})
+	}
+}
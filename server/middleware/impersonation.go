@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/services"
+)
+
+// Impersonation marks requests made with impersonation tokens. It must be
+// used after Authorize. The admin impersonating the user is set as the
+// "actor" context parameter and every such request is logged.
+func Impersonation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claimsI, _ := c.Get("claims")
+		claims, _ := claimsI.(jwt.MapClaims)
+		if actor := services.ActorClaim(claims); actor != "" {
+			userI, _ := c.Get("user")
+			if user, ok := userI.(*models.User); ok {
+				log.Printf("impersonation: %s acting as %s: %s %s\n", actor, user.Email, c.Request.Method, c.Request.URL.Path)
+			}
+			c.Set("actor", actor)
+		}
+		c.Next()
+	}
+}
+
+// Actor returns the admin impersonating the user of the request, if any
+func Actor(c *gin.Context) string {
+	return c.GetString("actor")
+}
+
+// NotImpersonating blocks sensitive actions during impersonation. It must
+// be used after Impersonation.
+func NotImpersonating() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if actor := Actor(c); actor != "" {
+			log.Printf("impersonation: %s was blocked from %s %s\n", actor, c.Request.Method, c.Request.URL.Path)
+			respondAndAbort(c, "", http.StatusForbidden, nil, []string{"not allowed while impersonating a user"})
+			return
+		}
+		c.Next()
+	}
+}
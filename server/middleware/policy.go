@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/policy"
+	"github.com/spankie/go-auth/rbac"
+)
+
+// Policies makes engine available to Can and RequirePolicy and resolves
+// the effective permissions of the user, global and within their
+// organization. It must be used after Authorize and TenantIsolation.
+func Policies(engine *policy.Engine, resolver *rbac.Resolver) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, err := EffectivePermissions(c, resolver); err != nil {
+			log.Printf("resolve permissions error: %v\n", err)
+			respondAndAbort(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		if _, err := OrgPermissions(c, resolver); err != nil {
+			log.Printf("resolve organization permissions error: %v\n", err)
+			respondAndAbort(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		c.Set("policy", engine)
+		c.Next()
+	}
+}
+
+// Can reports whether the user of the request may perform action on
+// resource. It is always false unless Policies was used.
+func Can(c *gin.Context, action string, resource interface{}) bool {
+	engineI, _ := c.Get("policy")
+	engine, ok := engineI.(*policy.Engine)
+	if !ok {
+		log.Printf("no policy engine in context\n")
+		return false
+	}
+	userI, _ := c.Get("user")
+	user, _ := userI.(*models.User)
+	permissionsI, _ := c.Get("permissions")
+	permissions, _ := permissionsI.([]string)
+	orgPermissionsI, _ := c.Get("org_permissions")
+	orgPermissions, _ := orgPermissionsI.([]string)
+
+	allowed, rule := engine.Evaluate(&policy.Request{
+		Subject:        user,
+		Permissions:    permissions,
+		OrgPermissions: orgPermissions,
+		Action:         action,
+		Resource:       resource,
+		Context: map[string]interface{}{
+			"ip":     ClientIP(c),
+			"method": c.Request.Method,
+			"path":   c.FullPath(),
+			"org_id": OrgID(c),
+		},
+	})
+	if !allowed {
+		log.Printf("policy denied %s (rule: %q)\n", action, rule)
+	}
+	return allowed
+}
+
+// RequirePolicy only lets requests through if the user may perform
+// action on the resource returned by resource, which may be nil for
+// actions that aren't about a particular resource
+func RequirePolicy(action string, resource func(*gin.Context) interface{}) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var r interface{}
+		if resource != nil {
+			r = resource(c)
+		}
+		if !Can(c, action, r) {
+			respondAndAbort(c, "", http.StatusForbidden, nil, []string{"forbidden"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spankie/go-auth/ratelimit"
+	"github.com/spankie/go-auth/services"
+)
+
+// RateLimit throttles requests with limiter using the key returned by key.
+// Requests answered with a 401 count as failures and make the limiter back
+// off. Only handlers that check credentials know when to clear the
+// failures, they do it with ClearFailures.
+func RateLimit(limiter *ratelimit.Limiter, key func(*gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		k := key(c)
+		if k == "" {
+			c.Next()
+			return
+		}
+
+		if !Throttle(c, limiter, k) {
+			return
+		}
+
+		c.Set(rateLimitKey(limiter), k)
+		c.Next()
+
+		if c.Writer.Status() == http.StatusUnauthorized {
+			if err := limiter.Fail(k); err != nil {
+				log.Printf("rate limit error: %v\n", err)
+			}
+		}
+	}
+}
+
+// Throttle takes a request for key from limiter, responding with a 429 and
+// aborting if there are none left. It's for handlers that only know the
+// key once they have looked at the request, RateLimit uses it for the
+// others.
+func Throttle(c *gin.Context, limiter *ratelimit.Limiter, key string) bool {
+	wait, err := limiter.Allow(key)
+	if err != nil {
+		// don't lock everyone out because the store is unavailable
+		log.Printf("rate limit error: %v\n", err)
+		return true
+	}
+	if wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		respondAndAbort(c, "", http.StatusTooManyRequests, nil, []string{"too many requests, try again later"})
+		return false
+	}
+	return true
+}
+
+// ClearFailures clears the failures limiter recorded for the key of the
+// request, once its credentials have been checked. It does nothing if
+// limiter wasn't applied to the request.
+func ClearFailures(c *gin.Context, limiter *ratelimit.Limiter) {
+	if limiter == nil {
+		return
+	}
+	k := c.GetString(rateLimitKey(limiter))
+	if k == "" {
+		return
+	}
+	if err := limiter.Succeed(k); err != nil {
+		log.Printf("rate limit error: %v\n", err)
+	}
+}
+
+// rateLimitKey is where RateLimit keeps the key limiter used for a request
+func rateLimitKey(limiter *ratelimit.Limiter) string {
+	return "rate_limit_key:" + limiter.Name
+}
+
+// LoginIdentifier keys rate limits by the normalized identifier (or
+// username) in the JSON or form body of a login request. The body is left
+// intact for the handler.
+func LoginIdentifier(c *gin.Context) string {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	login := &struct {
+		Identifier string `json:"identifier"`
+		Username   string `json:"username"`
+	}{}
+	if err := json.Unmarshal(body, login); err != nil {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return ""
+		}
+		login.Identifier = form.Get("identifier")
+	}
+	if login.Identifier == "" {
+		login.Identifier = login.Username
+	}
+	if login.Identifier == "" {
+		return ""
+	}
+	// usernames are matched ignoring case, so they are throttled that way too
+	identifier, _ := services.ParseIdentifier(login.Identifier)
+	return strings.ToLower(identifier)
+}
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/rbac"
+	"github.com/spankie/go-auth/services"
+)
+
+// RequirePermission only lets requests through if the effective
+// permissions of the user grant all of permissions. It must be used after
+// Authorize and TenantIsolation.
+func RequirePermission(resolver *rbac.Resolver, permissions ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		granted, err := EffectivePermissions(c, resolver)
+		if err != nil {
+			log.Printf("resolve permissions error: %v\n", err)
+			respondAndAbort(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+
+		for _, permission := range permissions {
+			if !rbac.Allowed(granted, permission) {
+				log.Printf("permission %s denied\n", permission)
+				respondAndAbort(c, "", http.StatusForbidden, nil, []string{"forbidden"})
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// RequireOrgPermission only lets requests through if the effective
+// permissions of the user, global or within the organization they act
+// for, grant all of permissions. It is meant for routes that only deal
+// with the resources of that organization, and must be used after
+// Authorize and TenantIsolation.
+func RequireOrgPermission(resolver *rbac.Resolver, permissions ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		granted, err := EffectivePermissions(c, resolver)
+		if err != nil {
+			log.Printf("resolve permissions error: %v\n", err)
+			respondAndAbort(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		orgGranted, err := OrgPermissions(c, resolver)
+		if err != nil {
+			log.Printf("resolve organization permissions error: %v\n", err)
+			respondAndAbort(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+
+		for _, permission := range permissions {
+			if !rbac.Allowed(granted, permission) && !rbac.Allowed(orgGranted, permission) {
+				log.Printf("permission %s denied\n", permission)
+				respondAndAbort(c, "", http.StatusForbidden, nil, []string{"forbidden"})
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// EffectivePermissions returns the global permissions granted to the user
+// of the request by the roles and permissions in their access token. They
+// are resolved once per request and kept as the "permissions" context
+// parameter, next to the "user" set by Authorize.
+func EffectivePermissions(c *gin.Context, resolver *rbac.Resolver) ([]string, error) {
+	if permissionsI, exists := c.Get("permissions"); exists {
+		if permissions, ok := permissionsI.([]string); ok {
+			return permissions, nil
+		}
+	}
+
+	claimsI, _ := c.Get("claims")
+	claims, ok := claimsI.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("can't get claims from context")
+	}
+	roles := rbac.UserRoles(services.StringsClaim(claims, "roles"))
+	permissions := resolver.Resolve(roles, services.StringsClaim(claims, "permissions"))
+	c.Set("permissions", permissions)
+	return permissions, nil
+}
+
+// OrgPermissions returns the permissions the user of the request has
+// within the organization they act for, from the org_roles claim of their
+// access token and the groups they belong to there. They only apply to the resources of that organization.
+// They are resolved once per request and kept as the "org_permissions"
+// context parameter.
+func OrgPermissions(c *gin.Context, resolver *rbac.Resolver) ([]string, error) {
+	if permissionsI, exists := c.Get("org_permissions"); exists {
+		if permissions, ok := permissionsI.([]string); ok {
+			return permissions, nil
+		}
+	}
+
+	claimsI, _ := c.Get("claims")
+	claims, ok := claimsI.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("can't get claims from context")
+	}
+	userI, _ := c.Get("user")
+	user, _ := userI.(*models.User)
+	permissions, err := resolver.ResolveOrg(user, OrgID(c), services.StringsClaim(claims, "org_roles"))
+	if err != nil {
+		return nil, err
+	}
+	if permissions == nil {
+		permissions = []string{}
+	}
+	c.Set("org_permissions", permissions)
+	return permissions, nil
+}
@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+// FirstParty only lets through requests made with tokens the API issued
+// to its own users. Tokens issued to OAuth clients only grant what their
+// scope covers, which is served outside of the routes it guards. It must
+// be used after Authorize.
+func FirstParty() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claimsI, _ := c.Get("claims")
+		claims, _ := claimsI.(jwt.MapClaims)
+		if clientID, _ := claims["client_id"].(string); clientID != "" {
+			log.Printf("token of client %s used outside of its scope: %s %s\n", clientID, c.Request.Method, c.Request.URL.Path)
+			c.Header("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+			respondAndAbort(c, "", http.StatusForbidden, nil, []string{"insufficient scope"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/spankie/go-auth/models"
+)
+
+// TenantIsolation only lets requests through if the user is still a
+// member of the organization in the org_id claim of their access token.
+// It must be used after Authorize. The organization is set as the
+// "org_id" context parameter, which is empty for users who aren't
+// acting for an organization.
+func TenantIsolation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claimsI, _ := c.Get("claims")
+		claims, ok := claimsI.(jwt.MapClaims)
+		userI, _ := c.Get("user")
+		user, isUser := userI.(*models.User)
+		if !ok || !isUser {
+			log.Printf("can't get claims or user from context\n")
+			respondAndAbort(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+
+		orgID, _ := claims["org_id"].(string)
+		if orgID != "" && user.Membership(orgID) == nil {
+			log.Printf("%s is not a member of organization %s\n", user.Email, orgID)
+			respondAndAbort(c, "", http.StatusForbidden, nil, []string{"not a member of this organization"})
+			return
+		}
+		c.Set("org_id", orgID)
+		c.Next()
+	}
+}
+
+// OrgID returns the organization the request is made for, set by
+// TenantIsolation
+func OrgID(c *gin.Context) string {
+	return c.GetString("org_id")
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/spankie/go-auth/audit"
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/server/middleware"
+	"github.com/spankie/go-auth/services"
+)
+
+// Token type hints from RFC 7009
+const (
+	accessTokenHint  = "access_token"
+	refreshTokenHint = "refresh_token"
+)
+
+// oauthError responds with an error as described in RFC 6749 section 5.2
+func oauthError(c *gin.Context, status int, code, description string) {
+	c.JSON(status, gin.H{"error": code, "error_description": description})
+}
+
+// tokenType tells access tokens from refresh tokens by their typ claim.
+// Impersonation tokens are access tokens too.
+func tokenType(claims jwt.MapClaims) string {
+	switch services.TokenType(claims) {
+	case services.AccessTokenType, services.ImpersonationTokenType:
+		return accessTokenHint
+	case services.RefreshTokenType:
+		return refreshTokenHint
+	}
+	return ""
+}
+
+// clientCredentialsSent reports whether the client calling an endpoint
+// identified itself
+func clientCredentialsSent(c *gin.Context) bool {
+	_, _, basic := c.Request.BasicAuth()
+	return basic || c.PostForm("client_id") != ""
+}
+
+// handleRevoke revokes an access or refresh token as described in RFC
+// 7009. Invalid, expired and unknown tokens get the same response as
+// revoked ones so the endpoint can be called again safely. Revoking a
+// refresh token ends its session, which revokes the access tokens issued
+// with it too. The token_type_hint parameter is ignored as tokens are
+// self-contained. Tokens issued to a client can only be revoked by it,
+// while those issued by the API itself can't be revoked by clients.
+func (s *Server) handleRevoke() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var client *models.Client
+		if clientCredentialsSent(c) {
+			var ok bool
+			if client, ok = s.tokenClient(c); !ok {
+				return
+			}
+		}
+		token := c.PostForm("token")
+		if token == "" {
+			oauthError(c, http.StatusBadRequest, "invalid_request", "token is required")
+			return
+		}
+
+		secret := os.Getenv("JWT_SECRET")
+		_, claims, err := services.AuthorizeToken(&token, &secret)
+		if err != nil || s.DB.TokenInBlacklist(&token) {
+			c.Status(http.StatusOK)
+			return
+		}
+		kind := tokenType(claims)
+		if kind == "" {
+			oauthError(c, http.StatusBadRequest, "unsupported_token_type", "only access and refresh tokens can be revoked")
+			return
+		}
+		clientID, _ := claims["client_id"].(string)
+		if clientID != "" && client == nil {
+			oauthError(c, http.StatusUnauthorized, "invalid_client", "client authentication is required")
+			return
+		}
+		if client != nil && client.ID.Hex() != clientID {
+			oauthError(c, http.StatusBadRequest, "invalid_request", "the token wasn't issued to this client")
+			return
+		}
+
+		email, _ := claims["user_email"].(string)
+		if err := s.DB.AddToBlackList(&models.Blacklist{Email: email, Token: token, CreatedAt: time.Now()}); err != nil {
+			log.Printf("can't add token to blacklist: %v\n", err)
+			oauthError(c, http.StatusServiceUnavailable, "temporarily_unavailable", "the token couldn't be revoked")
+			return
+		}
+		if sid, _ := claims["sid"].(string); sid != "" && kind == refreshTokenHint {
+			if err := s.DB.RevokeSession(sid); err != nil {
+				log.Printf("revoke session error: %v\n", err)
+			}
+		}
+		s.audit(c, &audit.Event{
+			Type:    audit.TokenRevoke,
+			Outcome: audit.Success,
+			Subject: email,
+			Details: map[string]string{"token_type": kind},
+		})
+		c.Status(http.StatusOK)
+	}
+}
+
+// handleIntrospect tells the client calling it whether a token is active
+// and who it was issued to, as described in RFC 7662. Only resource
+// servers can introspect the tokens of other clients, which are reported
+// as inactive to the rest.
+func (s *Server) handleIntrospect() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, ok := s.authenticateClient(c)
+		if !ok || !middleware.Throttle(c, s.clientLimiter, client.ID.Hex()) {
+			return
+		}
+		token := c.PostForm("token")
+		if token == "" {
+			oauthError(c, http.StatusBadRequest, "invalid_request", "token is required")
+			return
+		}
+
+		inactive := gin.H{"active": false}
+		secret := os.Getenv("JWT_SECRET")
+		_, claims, err := services.AuthorizeToken(&token, &secret)
+		if err != nil || middleware.TokenExpired(claims) || s.DB.TokenInBlacklist(&token) {
+			c.JSON(http.StatusOK, inactive)
+			return
+		}
+		if clientID, _ := claims["client_id"].(string); !client.ResourceServer && clientID != client.ID.Hex() {
+			c.JSON(http.StatusOK, inactive)
+			return
+		}
+		kind := tokenType(claims)
+		var user *models.User
+		switch kind {
+		case accessTokenHint:
+			email, _ := claims["user_email"].(string)
+			user, err = s.DB.FindUserByEmail(email)
+			if err == nil && middleware.TokensRevoked(claims, user) {
+				err = errors.New("tokens were revoked")
+			}
+			if err == nil {
+				_, err = middleware.ActiveSession(s.DB, claims, user)
+			}
+		case refreshTokenHint:
+			_, user, err = s.refreshTokenSession(claims)
+		default:
+			err = errors.New("unsupported token type")
+		}
+		if err != nil {
+			c.JSON(http.StatusOK, inactive)
+			return
+		}
+
+		info := gin.H{
+			"active":   true,
+			"sub":      user.ID.Hex(),
+			"username": user.Username,
+		}
+		if exp, ok := claims["exp"].(float64); ok {
+			info["exp"] = int64(exp)
+		}
+		if kind == accessTokenHint {
+			info["token_type"] = "Bearer"
+		}
+		disclosed := []string{"scope", "client_id"}
+		if client.ResourceServer {
+			disclosed = append(disclosed, "org_id", "act")
+		}
+		for _, claim := range disclosed {
+			if value, ok := claims[claim]; ok {
+				info[claim] = value
+			}
+		}
+		c.JSON(http.StatusOK, info)
+	}
+}
+
+// refreshTokenSession returns the session a refresh token was issued for
+// and its user, or an error if the session or the user is no longer
+// active
+func (s *Server) refreshTokenSession(claims jwt.MapClaims) (*models.Session, *models.User, error) {
+	sid, _ := claims["sid"].(string)
+	session, err := s.DB.FindSessionByID(sid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !session.IsActive() {
+		return nil, nil, errors.New("session was revoked")
+	}
+	user, err := s.DB.FindUserByID(session.UserID.Hex())
+	if err != nil {
+		return nil, nil, err
+	}
+	if !user.IsActive() {
+		return nil, nil, errors.New("user is inactive")
+	}
+	if session.CreatedAt.Before(user.TokensValidAfter) {
+		return nil, nil, errors.New("tokens were revoked")
+	}
+	return session, user, nil
+}
+
+// refreshClientToken issues a new access token to client for the session
+// of a refresh token it was given, as described in RFC 6749 section 6.
+// The scope can be narrowed but not widened. The refresh token stays the
+// same.
+func (s *Server) refreshClientToken(c *gin.Context, client *models.Client) {
+	invalidGrant := func() {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "the refresh token is invalid")
+	}
+	token := c.PostForm("refresh_token")
+	secret := os.Getenv("JWT_SECRET")
+	_, claims, err := services.AuthorizeToken(&token, &secret)
+	if err != nil || tokenType(claims) != refreshTokenHint || middleware.TokenExpired(claims) || s.DB.TokenInBlacklist(&token) {
+		invalidGrant()
+		return
+	}
+	if clientID, _ := claims["client_id"].(string); clientID != client.ID.Hex() {
+		invalidGrant()
+		return
+	}
+	session, user, err := s.refreshTokenSession(claims)
+	if err != nil {
+		log.Printf("refresh client token error: %v\n", err)
+		invalidGrant()
+		return
+	}
+	scope, _ := claims["scope"].(string)
+	if requested := c.PostForm("scope"); requested != "" {
+		for _, name := range strings.Fields(requested) {
+			if !hasScope(scope, name) {
+				oauthError(c, http.StatusBadRequest, "invalid_scope", "the scope can't be wider than the one granted")
+				return
+			}
+		}
+		scope = requested
+	}
+
+	accessClaims := services.AccessTokenClaims(user, defaultOrgID(user), session.CreatedAt)
+	accessClaims["sid"] = session.ID.Hex()
+	accessClaims["client_id"] = client.ID.Hex()
+	if scope != "" {
+		accessClaims["scope"] = scope
+	}
+	accToken, err := services.GenerateToken(jwt.SigningMethodHS256, accessClaims, &secret)
+	if err != nil {
+		log.Printf("token generation error err: %v\n", err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "internal server error")
+		return
+	}
+	tokens := gin.H{
+		"access_token": *accToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(services.AccessTokenValidity.Seconds()),
+	}
+	if scope != "" {
+		tokens["scope"] = scope
+	}
+	c.JSON(http.StatusOK, tokens)
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/services"
+)
+
+// idTokenValidity is how long ID tokens are valid for
+const idTokenValidity = time.Hour
+
+// scopeOpenID asks for an ID token
+const scopeOpenID = "openid"
+
+// scopeClaims maps the scopes clients can ask for to the claims about the
+// user they give access to
+var scopeClaims = map[string][]string{
+	scopeOpenID: {"sub"},
+	"profile":   {"name", "given_name", "family_name", "preferred_username", "picture", "updated_at"},
+	"email":     {"email"},
+	"phone":     {"phone_number"},
+}
+
+// validScope reports whether every scope in the space separated scope is
+// supported. The openid scope is only supported when there is a key to
+// sign ID tokens with.
+func (s *Server) validScope(scope string) bool {
+	for _, sc := range strings.Fields(scope) {
+		if _, ok := scopeClaims[sc]; !ok || (sc == scopeOpenID && s.SigningKey == nil) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasScope reports whether the space separated scope contains want
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+// userClaims returns the standard OIDC claims about user the scopes in the
+// space separated scope give access to
+func userClaims(user *models.User, scope string) gin.H {
+	all := gin.H{
+		"sub":                user.ID.Hex(),
+		"name":               strings.TrimSpace(user.FirstName + " " + user.LastName),
+		"given_name":         user.FirstName,
+		"family_name":        user.LastName,
+		"preferred_username": user.Username,
+		"picture":            user.Image,
+		"email":              user.Email,
+		"phone_number":       user.Phone,
+	}
+	if !user.UpdatedAt.IsZero() {
+		all["updated_at"] = user.UpdatedAt.Unix()
+	}
+	claims := gin.H{}
+	for _, s := range strings.Fields(scope) {
+		for _, claim := range scopeClaims[s] {
+			// claims without a value are left out rather than empty
+			if value, ok := all[claim]; ok && value != "" {
+				claims[claim] = value
+			}
+		}
+	}
+	return claims
+}
+
+// issuer returns the URL identifying the server in ID tokens. The
+// discovery document is served under it, so it shouldn't have a path.
+func (s *Server) issuer() string {
+	return strings.TrimSuffix(s.Issuer, "/")
+}
+
+// idToken returns an ID token telling client that user logged in with the
+// authorization code
+func (s *Server) idToken(c *gin.Context, user *models.User, client *models.Client, code *models.AuthorizationCode) (string, error) {
+	key := s.SigningKey
+	if key == nil {
+		return "", errors.New("no signing key")
+	}
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":       s.issuer(),
+		"sub":       user.ID.Hex(),
+		"aud":       client.ID.Hex(),
+		"exp":       now.Add(idTokenValidity).Unix(),
+		"iat":       now.Unix(),
+		"auth_time": code.CreatedAt.Unix(),
+	}
+	if code.Nonce != "" {
+		claims["nonce"] = code.Nonce
+	}
+	for claim, value := range userClaims(user, code.Scope) {
+		claims[claim] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = services.KeyID(&key.PublicKey)
+	return token.SignedString(key)
+}
+
+// handleDiscovery serves the OpenID provider metadata described in OpenID
+// Connect Discovery 1.0
+func (s *Server) handleDiscovery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		iss := s.issuer()
+		var scopes []string
+		claims := []string{"iss", "aud", "exp", "iat", "auth_time", "nonce"}
+		for scope, scopeClaims := range scopeClaims {
+			if s.validScope(scope) {
+				scopes = append(scopes, scope)
+				claims = append(claims, scopeClaims...)
+			}
+		}
+		// the order of the map changes between requests
+		sort.Strings(scopes)
+		sort.Strings(claims)
+		metadata := gin.H{
+			"issuer":                                iss,
+			"authorization_endpoint":                iss + "/api/v1/oauth/authorize",
+			"token_endpoint":                        iss + "/api/v1/oauth/token",
+			"jwks_uri":                              iss + "/api/v1/oauth/jwks",
+			"revocation_endpoint":                   iss + "/api/v1/oauth/revoke",
+			"introspection_endpoint":                iss + "/api/v1/oauth/introspect",
+			"scopes_supported":                      scopes,
+			"response_types_supported":              []string{"code"},
+			"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+			"subject_types_supported":               []string{"public"},
+			"code_challenge_methods_supported":      []string{"S256"},
+			"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		}
+		// without a signing key the server is only an OAuth server
+		if s.SigningKey != nil {
+			metadata["userinfo_endpoint"] = iss + "/api/v1/userinfo"
+			metadata["claims_supported"] = claims
+			metadata["id_token_signing_alg_values_supported"] = []string{"RS256"}
+		}
+		c.JSON(http.StatusOK, metadata)
+	}
+}
+
+// handleJWKS serves the public key ID tokens are signed with
+func (s *Server) handleJWKS() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keys := []map[string]string{}
+		if key := s.SigningKey; key != nil {
+			keys = append(keys, services.JWK(&key.PublicKey))
+		}
+		c.JSON(http.StatusOK, gin.H{"keys": keys})
+	}
+}
+
+// handleUserInfo returns the claims about the user the scope of the access
+// token gives access to
+func (s *Server) handleUserInfo() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userI, _ := c.Get("user")
+		user, ok := userI.(*models.User)
+		claimsI, _ := c.Get("claims")
+		claims, ok2 := claimsI.(jwt.MapClaims)
+		if !ok || !ok2 {
+			log.Printf("can't get user from context\n")
+			oauthError(c, http.StatusInternalServerError, "server_error", "internal server error")
+			return
+		}
+		scope, _ := claims["scope"].(string)
+		if !hasScope(scope, scopeOpenID) {
+			c.Header("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+			oauthError(c, http.StatusForbidden, "insufficient_scope", "the access token wasn't issued for the openid scope")
+			return
+		}
+		c.JSON(http.StatusOK, userClaims(user, scope))
+	}
+}
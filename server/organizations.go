@@ -0,0 +1,169 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo"
+	"github.com/spankie/go-auth/db"
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/rbac"
+	"github.com/spankie/go-auth/server/middleware"
+	"github.com/spankie/go-auth/server/response"
+	"github.com/spankie/go-auth/services"
+)
+
+// defaultOrgID returns the organization users log into when they don't
+// pick one
+func defaultOrgID(user *models.User) string {
+	if len(user.Memberships) == 0 {
+		return ""
+	}
+	return user.Memberships[0].OrgID.Hex()
+}
+
+// handleCreateOrganization creates an organization managed by the user
+// creating it
+func (s *Server) handleCreateOrganization() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userI, _ := c.Get("user")
+		user, ok := userI.(*models.User)
+		if !ok {
+			log.Printf("can't get user from context\n")
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+
+		org := &models.Organization{}
+		if errs := s.decode(c, org); errs != nil {
+			response.JSON(c, "", http.StatusBadRequest, nil, errs)
+			return
+		}
+		org.CreatedBy = user.Email
+
+		org, err := s.DB.CreateOrganization(org)
+		if err != nil {
+			log.Printf("create organization error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		membership := models.Membership{OrgID: org.ID, Roles: []string{rbac.RoleOrgAdmin}}
+		if err := s.DB.AddMembership(user.ID.Hex(), membership); err != nil {
+			log.Printf("add membership error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		response.JSON(c, "organization created successfully", http.StatusCreated, gin.H{"organization": org}, nil)
+	}
+}
+
+// handleSwitchOrganization issues an access token for another
+// organization the user is a member of
+func (s *Server) handleSwitchOrganization() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userI, _ := c.Get("user")
+		user, ok := userI.(*models.User)
+		claimsI, _ := c.Get("claims")
+		claims, hasClaims := claimsI.(jwt.MapClaims)
+		if !ok || !hasClaims {
+			log.Printf("can't get user or claims from context\n")
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+
+		switchRequest := &struct {
+			OrgID string `json:"org_id" binding:"required"`
+		}{}
+		if errs := s.decode(c, switchRequest); errs != nil {
+			response.JSON(c, "", http.StatusBadRequest, nil, errs)
+			return
+		}
+		if user.Membership(switchRequest.OrgID) == nil {
+			response.JSON(c, "", http.StatusForbidden, nil, []string{"not a member of this organization"})
+			return
+		}
+
+		// the session carries on, only the organization changes
+		authTime, _ := claims["auth_time"].(float64)
+		accessClaims := services.AccessTokenClaims(user, switchRequest.OrgID, time.Unix(int64(authTime), 0))
+		if sid, ok := claims["sid"]; ok {
+			accessClaims["sid"] = sid
+		}
+		secret := os.Getenv("JWT_SECRET")
+		accToken, err := services.GenerateToken(jwt.SigningMethodHS256, accessClaims, &secret)
+		if err != nil {
+			log.Printf("token generation error err: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		if services.CookieMode() {
+			services.SetTokenCookie(c, services.AccessTokenCookie, *accToken, int(services.AccessTokenValidity.Seconds()))
+			response.JSON(c, "organization switched successfully", http.StatusOK, nil, nil)
+			return
+		}
+		response.JSON(c, "organization switched successfully", http.StatusOK, gin.H{"access_token": *accToken}, nil)
+	}
+}
+
+// orgFromParam loads the organization the :id parameter refers to,
+// responding with an error if it can't or if the user may not perform
+// action on it
+func (s *Server) orgFromParam(c *gin.Context, action string) (*models.Organization, bool) {
+	org, err := s.DB.FindOrganizationByID(c.Param("id"))
+	switch err {
+	case nil:
+		if !middleware.Can(c, action, org) {
+			response.JSON(c, "", http.StatusNotFound, nil, []string{"organization not found"})
+			return nil, false
+		}
+		return org, true
+	case db.ErrInvalidID, mgo.ErrNotFound:
+		response.JSON(c, "", http.StatusNotFound, nil, []string{"organization not found"})
+	default:
+		log.Printf("find organization error: %v\n", err)
+		response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+	}
+	return nil, false
+}
+
+// handleRemoveMember removes a user from an organization. Org admins use
+// it to manage their members, as they can't act on their accounts.
+func (s *Server) handleRemoveMember() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, ok := s.orgFromParam(c, rbac.UsersManage)
+		if !ok {
+			return
+		}
+		member, err := s.DB.FindUserByID(c.Param("user_id"))
+		if err != nil && err != db.ErrInvalidID && err != mgo.ErrNotFound {
+			log.Printf("find user by id error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		if err != nil || member.Membership(org.ID.Hex()) == nil {
+			response.JSON(c, "", http.StatusNotFound, nil, []string{"member not found"})
+			return
+		}
+		if isSelf(c, member) {
+			response.JSON(c, "", http.StatusBadRequest, nil, []string{"you can't remove yourself"})
+			return
+		}
+		if !s.outranks(c, member, org.ID.Hex()) {
+			response.JSON(c, "", http.StatusForbidden, nil, []string{"forbidden"})
+			return
+		}
+
+		if err := s.DB.RemoveMembership(member.ID.Hex(), org.ID.Hex()); err != nil {
+			log.Printf("remove membership error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		s.Groups.Invalidate(org.ID.Hex())
+		s.auditAdminAction(c, "removed from organization", member)
+		response.JSON(c, "member removed successfully", http.StatusOK, nil, nil)
+	}
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spankie/go-auth/audit"
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/server/response"
+	"github.com/spankie/go-auth/servererrors"
+	"github.com/spankie/go-auth/services"
+)
+
+// resetTokenValidity is how long a password reset token can be used for
+const resetTokenValidity = time.Hour
+
+// verifyPassword reports whether password is the password of user
+func (s *Server) verifyPassword(user *models.User, password string) bool {
+	ok, err := s.PasswordHasher.Verify(password, user.Password)
+	if err != nil {
+		log.Printf("verify password error: %v\n", err)
+		return false
+	}
+	if !ok {
+		log.Printf("passwords do not match\n")
+	}
+	return ok
+}
+
+// compareDummyPassword verifies password against a throwaway hash so that
+// logins for unknown users take as long as logins for known ones
+func (s *Server) compareDummyPassword(password string) {
+	s.dummyHashOnce.Do(func() {
+		var err error
+		s.dummyHash, err = s.PasswordHasher.Hash("dummy password")
+		if err != nil {
+			log.Printf("generate dummy hash error: %v\n", err)
+		}
+	})
+	s.PasswordHasher.Verify(password, s.dummyHash)
+}
+
+// upgradePasswordHash rehashes the password of user if its hash was made
+// with an outdated algorithm or parameters. It must only be called once
+// password has been verified.
+func (s *Server) upgradePasswordHash(user *models.User, password string) {
+	if !s.PasswordHasher.NeedsRehash(user.Password) {
+		return
+	}
+	hash, err := s.PasswordHasher.Hash(password)
+	if err != nil {
+		log.Printf("rehash password error: %v\n", err)
+		return
+	}
+	user.Password = hash
+	if err := s.DB.UpdateUser(user); err != nil {
+		log.Printf("update rehashed password error: %v\n", err)
+	}
+}
+
+// handleChangePassword changes the password of the logged in user
+func (s *Server) handleChangePassword() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if userI, exists := c.Get("user"); exists {
+			if user, ok := userI.(*models.User); ok {
+				passwordRequest := &struct {
+					CurrentPassword string `json:"current_password" binding:"required"`
+					NewPassword     string `json:"new_password" binding:"required"`
+				}{}
+
+				if errs := s.decode(c, passwordRequest); errs != nil {
+					response.JSON(c, "", http.StatusBadRequest, nil, errs)
+					return
+				}
+
+				if !s.verifyPassword(user, passwordRequest.CurrentPassword) {
+					s.audit(c, &audit.Event{Type: audit.PasswordChange, Outcome: audit.Failure, Subject: user.Email, Reason: "wrong current password"})
+					response.JSON(c, "", http.StatusBadRequest, nil, []string{"current password is incorrect"})
+					return
+				}
+
+				if errs := s.PasswordPolicy.Check("NewPassword", passwordRequest.NewPassword, user); errs != nil {
+					response.JSON(c, "", http.StatusBadRequest, nil, servererrors.FieldErrorStrings(errs))
+					return
+				}
+
+				var err error
+				user.Password, err = s.PasswordHasher.Hash(passwordRequest.NewPassword)
+				if err != nil {
+					log.Printf("hash password err: %v\n", err)
+					response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+					return
+				}
+				user.UpdatedAt = time.Now()
+				if err := s.DB.UpdateUser(user); err != nil {
+					log.Printf("update user error : %v\n", err)
+					response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+					return
+				}
+				s.audit(c, &audit.Event{Type: audit.PasswordChange, Outcome: audit.Success, Subject: user.Email})
+				response.JSON(c, "password changed successfully", http.StatusOK, nil, nil)
+				return
+			}
+		}
+		log.Printf("can't get user from context\n")
+		response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+	}
+}
+
+// handleForgotPassword emails a password reset token to the user
+func (s *Server) handleForgotPassword() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		forgotRequest := &struct {
+			Identifier string `json:"identifier" binding:"required"`
+		}{}
+
+		if errs := s.decode(c, forgotRequest); errs != nil {
+			response.JSON(c, "", http.StatusBadRequest, nil, errs)
+			return
+		}
+
+		// respond the same way whether the user exists or not so this
+		// can't be used to find out which accounts exist
+		const message = "if the account exists, a password reset email has been sent"
+		user, err := s.findUserByIdentifier(forgotRequest.Identifier)
+		if err != nil {
+			log.Printf("forgot password for unknown user: %v\n", err)
+			response.JSON(c, message, http.StatusOK, nil, nil)
+			return
+		}
+
+		token, err := services.RandomToken(32)
+		if err != nil {
+			log.Printf("generate reset token error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		user.Reset = services.HashToken(token)
+		user.ResetExpiresAt = time.Now().Add(resetTokenValidity)
+		if err := s.DB.UpdateUser(user); err != nil {
+			log.Printf("update user error : %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+
+		body := fmt.Sprintf("Hi %s,\n\nUse this token to reset your password within the next hour:\n\n%s\n", user.FirstName, token)
+		if resetURL := os.Getenv("PASSWORD_RESET_URL"); resetURL != "" {
+			body = fmt.Sprintf("Hi %s,\n\nFollow this link to reset your password within the next hour:\n\n%s?token=%s\n", user.FirstName, resetURL, url.QueryEscape(token))
+		}
+		body += "\nIf you didn't ask for this, you can ignore this email.\n"
+		s.audit(c, &audit.Event{
+			Type:    audit.PasswordReset,
+			Outcome: audit.Success,
+			Subject: user.Email,
+			Details: map[string]string{"step": "requested"},
+		})
+		go func(to string) {
+			if err := s.Mailer.Send(to, "Reset your password", body); err != nil {
+				log.Printf("send reset email error: %v\n", err)
+			}
+		}(user.Email)
+
+		response.JSON(c, message, http.StatusOK, nil, nil)
+	}
+}
+
+// handleResetPassword sets a new password using a reset token
+func (s *Server) handleResetPassword() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		resetRequest := &struct {
+			Token    string `json:"token" binding:"required"`
+			Password string `json:"password" binding:"required"`
+		}{}
+
+		if errs := s.decode(c, resetRequest); errs != nil {
+			response.JSON(c, "", http.StatusBadRequest, nil, errs)
+			return
+		}
+
+		user, err := s.DB.FindUserByResetToken(services.HashToken(resetRequest.Token))
+		if err != nil || time.Now().After(user.ResetExpiresAt) {
+			log.Printf("invalid reset token: %v\n", err)
+			s.audit(c, &audit.Event{Type: audit.PasswordReset, Outcome: audit.Failure, Reason: "invalid reset token"})
+			response.JSON(c, "", http.StatusBadRequest, nil, []string{"reset token is invalid or expired"})
+			return
+		}
+
+		if errs := s.PasswordPolicy.Check("Password", resetRequest.Password, user); errs != nil {
+			response.JSON(c, "", http.StatusBadRequest, nil, servererrors.FieldErrorStrings(errs))
+			return
+		}
+
+		user.Password, err = s.PasswordHasher.Hash(resetRequest.Password)
+		if err != nil {
+			log.Printf("hash password err: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		user.Reset = ""
+		user.ResetExpiresAt = time.Time{}
+		user.UpdatedAt = time.Now()
+		if err := s.DB.UpdateUser(user); err != nil {
+			log.Printf("update user error : %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		s.audit(c, &audit.Event{Type: audit.PasswordReset, Outcome: audit.Success, Subject: user.Email, Actor: user.Email})
+		response.JSON(c, "password reset successful", http.StatusOK, nil, nil)
+	}
+}
@@ -2,17 +2,25 @@ package server
 
 import (
 	"context"
+	"crypto/rsa"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/spankie/go-auth/audit"
 	"github.com/spankie/go-auth/db"
+	"github.com/spankie/go-auth/mailer"
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/passwords"
+	"github.com/spankie/go-auth/policy"
+	"github.com/spankie/go-auth/ratelimit"
+	"github.com/spankie/go-auth/rbac"
 	"github.com/spankie/go-auth/router"
 	"github.com/spankie/go-auth/server/middleware"
 )
@@ -21,35 +29,213 @@ import (
 type Server struct {
 	DB     db.DB
 	Router *router.Router
+	// RateLimitStore holds the state of the rate limiters, it defaults to
+	// an in-memory store
+	RateLimitStore ratelimit.Store
+	// Mailer sends emails to users, it defaults to logging them
+	Mailer mailer.Mailer
+	// PasswordPolicy is checked whenever a password is set, it defaults
+	// to the policy configured in the env
+	PasswordPolicy *passwords.Policy
+	// PasswordHasher hashes and verifies passwords, it defaults to the
+	// hasher configured in the env
+	PasswordHasher passwords.PasswordHasher
+	// CORS is the policy for cross-origin requests, it defaults to the
+	// policy configured in the env
+	CORS *middleware.CORSPolicy
+	// CORSOverrides replace CORS for the paths starting with their key,
+	// they default to the overrides configured in the env
+	CORSOverrides map[string]*middleware.CORSPolicy
+	// TrustedProxies are the proxies whose X-Forwarded-For headers are
+	// used to find the IP address of clients, they default to the ones
+	// configured in the env
+	TrustedProxies middleware.TrustedProxies
+	// SecurityHeaders are set on every response, they default to the
+	// headers configured in the env
+	SecurityHeaders *middleware.SecurityHeaders
+	// Roles maps role names to the permissions they grant, it defaults to
+	// the built in roles
+	Roles rbac.Roles
+	// Policy decides what users may do with resources, it defaults to
+	// policy.DefaultEngine
+	Policy *policy.Engine
+	// Audit records security events, it defaults to the log
+	Audit audit.AuditSink
+	// Groups caches the groups of organizations used to resolve
+	// permissions, it defaults to caching DB.FindOrgGroups for
+	// rbac.DefaultGroupCacheTTL
+	Groups *rbac.GroupCache
+	// SigningKey signs ID tokens. OpenID Connect is off if it isn't set:
+	// the openid scope is rejected and no ID tokens are issued.
+	SigningKey *rsa.PrivateKey
+	// Issuer is the URL identifying the server in ID tokens, e.g.
+	// https://auth.example.com
+	Issuer string
+
+	// loginLimiter throttles logins per identifier, its failures are
+	// cleared when a login succeeds
+	loginLimiter *ratelimit.Limiter
+	// clientLimiter throttles the OAuth clients calling the token and
+	// introspection endpoints
+	clientLimiter *ratelimit.Limiter
+
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+}
+
+// setDefaults fills in the optional dependencies that weren't provided
+func (s *Server) setDefaults() {
+	if s.RateLimitStore == nil {
+		s.RateLimitStore = ratelimit.NewMemoryStore()
+	}
+	if s.Mailer == nil {
+		s.Mailer = mailer.LogMailer{}
+	}
+	if s.PasswordPolicy == nil {
+		s.PasswordPolicy = passwords.PolicyFromEnv()
+	}
+	if s.PasswordHasher == nil {
+		s.PasswordHasher = passwords.HasherFromEnv()
+	}
+	if s.CORS == nil {
+		s.CORS = middleware.CORSPolicyFromEnv()
+	}
+	if s.CORSOverrides == nil {
+		s.CORSOverrides = middleware.CORSOverridesFromEnv(s.CORS)
+	}
+	if s.TrustedProxies == nil {
+		s.TrustedProxies = middleware.TrustedProxiesFromEnv()
+	}
+	if s.SecurityHeaders == nil {
+		s.SecurityHeaders = middleware.SecurityHeadersFromEnv()
+	}
+	if s.Roles == nil {
+		s.Roles = rbac.DefaultRoles()
+	}
+	if s.Policy == nil {
+		s.Policy = policy.DefaultEngine()
+	}
+	if s.Audit == nil {
+		s.Audit = audit.LogSink{}
+	}
+	if s.Groups == nil {
+		s.Groups = rbac.NewGroupCache(s.DB.FindOrgGroups, rbac.DefaultGroupCacheTTL)
+	}
 }
 
 func (s *Server) defineRoutes(router *gin.Engine) {
+	router.Use(middleware.SecureHeaders(s.SecurityHeaders), middleware.MaxBodySize(middleware.DefaultMaxBodySize))
+	router.GET("/.well-known/openid-configuration", s.handleDiscovery())
 	apirouter := router.Group("/api/v1")
-	apirouter.POST("/auth/signup", s.handleSignup())
-	apirouter.POST("/auth/login", s.handleLogin())
+
+	ipLimiter := newLimiter(s.RateLimitStore, "ip", "RATE_LIMIT_IP", "30/1m")
+	s.loginLimiter = newLimiter(s.RateLimitStore, "login", "RATE_LIMIT_LOGIN", "5/1m")
+	s.clientLimiter = newLimiter(s.RateLimitStore, "client", "RATE_LIMIT_CLIENT", "600/1m")
+
+	auth := apirouter.Group("/auth")
+	auth.Use(middleware.NoStore(), middleware.RateLimit(ipLimiter, middleware.ClientIP))
+	auth.POST("/signup", s.handleSignup())
+	auth.POST("/login", middleware.RateLimit(s.loginLimiter, middleware.LoginIdentifier), s.handleLogin())
+	auth.POST("/password/forgot", s.handleForgotPassword())
+	auth.POST("/password/reset", s.handleResetPassword())
+	auth.POST("/invitations/accept", s.handleAcceptInvitation())
+
+	// the endpoints OAuth clients call from their servers are throttled
+	// per client once it is authenticated, many users may share the IP
+	// address of a client
+	oauth := apirouter.Group("/oauth")
+	oauth.Use(middleware.NoStore())
+	oauth.POST("/introspect", s.handleIntrospect())
+	oauth.POST("/token", s.handleToken())
+	oauth.GET("/jwks", s.handleJWKS())
+
+	oauthIP := oauth.Group("/")
+	oauthIP.Use(middleware.RateLimit(ipLimiter, middleware.ClientIP))
+	oauthIP.POST("/revoke", s.handleRevoke())
+	oauthIP.GET("/authorize", s.handleAuthorize())
+	oauthIP.POST("/authorize", middleware.RateLimit(s.loginLimiter, middleware.LoginIdentifier), s.handleAuthorizeConsent())
+
+	// users get the roles of their groups in their organization on top of
+	// those in their token
+	resolver := &rbac.Resolver{Roles: s.Roles, Groups: s.Groups.Find}
+	authorize := middleware.Authorize(s.DB.FindUserByEmail, s.DB.TokenInBlacklist, s.DB, s.Audit)
+
+	// OAuth clients can only use their tokens on the routes their scope
+	// covers
+	scoped := apirouter.Group("/")
+	scoped.Use(middleware.NoStore(), authorize, middleware.CSRF())
+	scoped.GET("/userinfo", s.handleUserInfo())
+	scoped.POST("/userinfo", s.handleUserInfo())
 
 	authorized := apirouter.Group("/")
-	authorized.Use(middleware.Authorize(s.DB.FindUserByEmail, s.DB.TokenInBlacklist))
-	authorized.POST("/logout", s.handleLogout())
-	authorized.GET("/users", s.handleGetUsers())
-	authorized.PUT("/me/update", s.handleUpdateUserDetails())
+	// CSRF tokens are checked against the session Authorize finds
+	authorized.Use(middleware.NoStore(), authorize, middleware.CSRF(), middleware.FirstParty(), middleware.Impersonation(), middleware.TenantIsolation(), middleware.Policies(s.Policy, resolver))
+	authorized.POST("/logout", middleware.NotImpersonating(), s.handleLogout())
+	authorized.GET("/users", middleware.RequireOrgPermission(resolver, rbac.UsersList), s.handleGetUsers())
+	authorized.GET("/users/:username", s.handleGetUserByUsername())
+	authorized.PUT("/me/update", middleware.NotImpersonating(), s.handleUpdateUserDetails())
 	authorized.GET("/me", s.handleShowProfile())
+	authorized.PUT("/me/password", middleware.NotImpersonating(), s.handleChangePassword())
+	authorized.PUT("/me/organization", middleware.NotImpersonating(), s.handleSwitchOrganization())
+	authorized.GET("/me/sessions", s.handleListSessions())
+	authorized.DELETE("/me/sessions", middleware.NotImpersonating(), s.handleRevokeAllSessions())
+	authorized.DELETE("/me/sessions/:id", middleware.NotImpersonating(), s.handleRevokeSession())
+	authorized.POST("/orgs", middleware.NotImpersonating(), s.handleCreateOrganization())
+	authorized.POST("/impersonation/stop", s.handleStopImpersonation())
+	authorized.DELETE("/orgs/:id/members/:user_id", middleware.NotImpersonating(), s.handleRemoveMember())
+	authorized.GET("/orgs/:id/invitations", s.handleListInvitations())
+	authorized.POST("/orgs/:id/invitations", middleware.NotImpersonating(), s.handleCreateInvitation())
+	authorized.DELETE("/orgs/:id/invitations/:invitation_id", middleware.NotImpersonating(), s.handleRevokeInvitation())
+	authorized.GET("/orgs/:id/groups", s.handleListGroups())
+	authorized.POST("/orgs/:id/groups", middleware.NotImpersonating(), s.handleCreateGroup())
+	authorized.DELETE("/orgs/:id/groups/:group_id", middleware.NotImpersonating(), s.handleDeleteGroup())
+	authorized.POST("/orgs/:id/groups/:group_id/members", middleware.NotImpersonating(), s.handleAddGroupMember())
+	authorized.DELETE("/orgs/:id/groups/:group_id/members/:user_id", middleware.NotImpersonating(), s.handleRemoveGroupMember())
+
+	admin := authorized.Group("/admin")
+	admin.GET("/users", middleware.RequireOrgPermission(resolver, rbac.UsersList), s.handleAdminListUsers())
+	admin.GET("/users/:id", middleware.RequireOrgPermission(resolver, rbac.UsersRead), s.handleAdminShowUser())
+	manage := admin.Group("/users/:id", middleware.RequirePermission(resolver, rbac.UsersManage))
+	manage.POST("/deactivate", s.handleAdminSetStatus(models.StatusInactive))
+	manage.POST("/reactivate", s.handleAdminSetStatus(models.StatusActive))
+	manage.POST("/logout", s.handleAdminLogoutUser())
+	manage.DELETE("", s.handleAdminDeleteUser())
+	admin.GET("/audit", middleware.RequirePermission(resolver, rbac.AuditRead), s.handleListAuditEvents())
+	admin.POST("/users/:id/impersonate", middleware.RequirePermission(resolver, rbac.Impersonate), s.handleImpersonate())
+	admin.POST("/clients", middleware.RequirePermission(resolver, rbac.ClientsManage), s.handleRegisterClient())
+}
+
+// newLimiter creates a limiter with the rate in the env var, or
+// defaultRate if it isn't set or is invalid
+func newLimiter(store ratelimit.Store, name, env, defaultRate string) *ratelimit.Limiter {
+	rate := os.Getenv(env)
+	if rate == "" {
+		rate = defaultRate
+	}
+	burst, interval, err := ratelimit.ParseRate(rate)
+	if err != nil {
+		log.Printf("invalid %s: %v, using %s\n", env, err, defaultRate)
+		burst, interval, _ = ratelimit.ParseRate(defaultRate)
+	}
+	return ratelimit.NewLimiter(store, name, burst, interval)
 }
 
 func (s *Server) setupRouter() *gin.Engine {
+	s.setDefaults()
 	ginMode := os.Getenv("GIN_MODE")
 	if ginMode == "test" {
-		r := gin.New()
+		r := newEngine(s.TrustedProxies)
 		s.defineRoutes(r)
 		return r
 	}
-	r := gin.New()
+	r := newEngine(s.TrustedProxies)
 	// LoggerWithFormatter middleware will write the logs to gin.DefaultWriter
 	// By default gin.DefaultWriter = os.Stdout
 	r.Use(gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
 		// your custom format
+		clientIP, _ := param.Keys["client_ip"].(string)
 		return fmt.Sprintf("%s - [%s] \"%s %s %s %d %s \"%s\" %s\"\n",
-			param.ClientIP,
+			clientIP,
 			param.TimeStamp.Format(time.RFC1123),
 			param.Method,
 			param.Path,
@@ -62,21 +248,21 @@ func (s *Server) setupRouter() *gin.Engine {
 	}))
 	r.Use(gin.Recovery())
 	// setup cors
-	r.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"POST", "GET", "PUT", "PATCH"},
-		AllowHeaders:     []string{"*"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		// AllowOriginFunc: func(origin string) bool {
-		// 	return origin == "https://github.com"
-		// },
-		MaxAge: 12 * time.Hour,
-	}))
+	r.Use(middleware.CORS(s.CORS, s.CORSOverrides))
 	s.defineRoutes(r)
 	return r
 }
 
+// newEngine returns an engine finding the IP address of clients with
+// middleware.RealIP. Gin's own lookup trusts X-Forwarded-For from anyone,
+// so it's turned off.
+func newEngine(proxies middleware.TrustedProxies) *gin.Engine {
+	r := gin.New()
+	r.ForwardedByClientIP = false
+	r.Use(middleware.RealIP(proxies))
+	return r
+}
+
 // Start starts the whole server by preparing everything it needs
 // like router
 func (s *Server) Start() {
@@ -102,7 +288,7 @@ func (s *Server) Start() {
 
 	// Wait for interrupt signal to gracefully shutdown the server with
 	// a timeout of 5 seconds.
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	// kill (no param) default send syscall.SIGTERM
 	// kill -2 is syscall.SIGINT
 	// kill -9 is syscall.SIGKILL but can't be catch, so don't need add it
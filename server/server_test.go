@@ -1,34 +1,66 @@
 package server
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
 	"github.com/golang/mock/gomock"
+	"github.com/spankie/go-auth/audit"
 	"github.com/spankie/go-auth/db"
 	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/passwords"
+	"github.com/spankie/go-auth/rbac"
 	"github.com/spankie/go-auth/router"
+	"github.com/spankie/go-auth/server/middleware"
+	"github.com/spankie/go-auth/servererrors"
+	"github.com/spankie/go-auth/services"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
-func TestSignupWithCorrectDetails(t *testing.T) {
+func TestMain(m *testing.M) {
+	os.Setenv("JWT_SECRET", "test-secret")
+	os.Setenv("DEFAULT_PHONE_COUNTRY_CODE", "234")
+	os.Exit(m.Run())
+}
+
+// newTestServer returns a server backed by a mock DB, along with the mock.
+// Its fields can be set until its router is set up. Expected calls that
+// weren't made fail the test when it ends.
+func newTestServer(t *testing.T) (*Server, *db.MockDB) {
 	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
 	m := db.NewMockDB(ctrl)
+	return &Server{DB: m, Router: router.NewRouter()}, m
+}
 
-	s := &Server{
-		DB:     m,
-		Router: router.NewRouter(),
-	}
+func TestSignupWithCorrectDetails(t *testing.T) {
+	s, m := newTestServer(t)
 	router := s.setupRouter()
 
 	user := models.User{
 		FirstName:      "Spankie",
 		LastName:       "Dee",
-		PasswordString: "password",
+		PasswordString: "v9#Lq2!zRw",
 		Username:       "spankie",
 		Email:          "spankie_signup@gmail.com",
 		Phone:          "08909876787",
@@ -50,13 +82,7 @@ func TestSignupWithCorrectDetails(t *testing.T) {
 }
 
 func TestSignupWithInCorrectDetails(t *testing.T) {
-	ctrl := gomock.NewController(t)
-	m := db.NewMockDB(ctrl)
-
-	s := &Server{
-		DB:     m,
-		Router: router.NewRouter(),
-	}
+	s, _ := newTestServer(t)
 	router := s.setupRouter()
 
 	user := models.User{
@@ -82,3 +108,1868 @@ func TestSignupWithInCorrectDetails(t *testing.T) {
 	assert.Contains(t, bodyString, fmt.Sprintf("validation failed on field 'Email', condition: email, actual: %s", user.Email))
 	assert.Contains(t, bodyString, "validation failed on field 'Username', condition: required")
 }
+
+func TestLoginWithIdentifier(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{
+		Username: "spankie",
+		Email:    "spankie@gmail.com",
+		Phone:    "+2348909876787",
+		Password: hash,
+		Status:   "active",
+	}
+
+	tests := []struct {
+		name       string
+		identifier string
+		expect     func(m *db.MockDB)
+	}{
+		{"username", "Spankie", func(m *db.MockDB) {
+			m.EXPECT().FindUserByUsername("Spankie").Return(user, nil)
+		}},
+		{"email", " Spankie@Gmail.com", func(m *db.MockDB) {
+			m.EXPECT().FindUserByEmail("spankie@gmail.com").Return(user, nil)
+		}},
+		{"phone", "0890 987 6787", func(m *db.MockDB) {
+			m.EXPECT().FindUserByPhone("+2348909876787").Return(user, nil)
+		}},
+		{"numeric username", "12345678", func(m *db.MockDB) {
+			m.EXPECT().FindUserByPhone("+12345678").Return(nil, mgo.ErrNotFound)
+			m.EXPECT().FindUserByUsername("12345678").Return(user, nil)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the bcrypt hash gets upgraded to argon2id on every login
+			user.Password = hash
+			s, m := newTestServer(t)
+			expectSessions(m)
+			tt.expect(m)
+			m.EXPECT().UpdateUser(user).Return(nil)
+
+			router := s.setupRouter()
+
+			body := fmt.Sprintf(`{"identifier":%q,"password":"password"}`, tt.identifier)
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(body))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Contains(t, w.Body.String(), "login successful")
+		})
+	}
+}
+
+func TestUpdatingPhoneNumber(t *testing.T) {
+	user := &models.User{ID: bson.NewObjectId(), FirstName: "Spankie", LastName: "Dee", Username: "spankie", Email: "spankie@gmail.com", Phone: "+2348909876787", Status: models.StatusActive}
+	other := &models.User{ID: bson.NewObjectId(), Email: "other@gmail.com", Phone: "+2348000000000", Status: models.StatusInactive}
+
+	s, m := newTestServer(t)
+	sessions := expectSessions(m)
+	m.EXPECT().TokenInBlacklist(gomock.Any()).Return(false).AnyTimes()
+	m.EXPECT().FindUserByEmail(user.Email).DoAndReturn(func(string) (*models.User, error) {
+		copied := *user
+		return &copied, nil
+	}).AnyTimes()
+	m.EXPECT().FindUserByPhone(other.Phone).Return(other, servererrors.NewInActiveUserError("user is inactive"))
+	m.EXPECT().FindUserByPhone("+2348011111111").Return(nil, mgo.ErrNotFound)
+	var saved string
+	m.EXPECT().UpdateUser(gomock.Any()).DoAndReturn(func(u *models.User) error {
+		saved = u.Phone
+		return nil
+	}).Times(2)
+	router := s.setupRouter()
+	token := accessToken(t, sessions, user)
+
+	tests := []struct {
+		name   string
+		phone  string
+		status int
+		saved  string
+	}{
+		{"unchanged", user.Phone, http.StatusOK, user.Phone},
+		{"invalid", "0809 CALL ME", http.StatusBadRequest, ""},
+		{"taken by an inactive user", "0800 000 0000", http.StatusConflict, ""},
+		{"national format", "0801 111 1111", http.StatusOK, "+2348011111111"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved = ""
+			body := fmt.Sprintf(`{"first_name":"Spankie","last_name":"Dee","username":"spankie","email":"spankie@gmail.com","password":"password","phone":%q}`, tt.phone)
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("PUT", "/api/v1/me/update", strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.status, w.Code, w.Body.String())
+			assert.Equal(t, tt.saved, saved)
+		})
+	}
+}
+
+func TestLoginFailuresLookTheSame(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := &models.User{Username: "spankie", Password: hash, Status: "active"}
+	inactive := &models.User{Username: "dee", Password: hash, Status: "inactive"}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		expect   func(m *db.MockDB)
+	}{
+		{"unknown user", "nobody", "password", func(m *db.MockDB) {
+			m.EXPECT().FindUserByUsername("nobody").Return(nil, errors.New("not found"))
+		}},
+		{"wrong password", "spankie", "wrong", func(m *db.MockDB) {
+			m.EXPECT().FindUserByUsername("spankie").Return(active, nil)
+			m.EXPECT().IncrementFailedLogins(active.Email).Return(1, nil)
+		}},
+		{"inactive user", "dee", "password", func(m *db.MockDB) {
+			m.EXPECT().FindUserByUsername("dee").Return(inactive, servererrors.NewInActiveUserError("user is inactive"))
+		}},
+	}
+
+	var bodies []string
+	for _, tt := range tests {
+		s, m := newTestServer(t)
+		tt.expect(m)
+
+		router := s.setupRouter()
+
+		body := fmt.Sprintf(`{"identifier":%q,"password":%q}`, tt.username, tt.password)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(body))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code, tt.name)
+		bodies = append(bodies, w.Body.String())
+	}
+	for _, body := range bodies[1:] {
+		assert.Equal(t, bodies[0], body)
+	}
+}
+
+func TestLoginIsRateLimitedPerUser(t *testing.T) {
+	os.Setenv("RATE_LIMIT_LOGIN", "2/1h")
+	defer os.Unsetenv("RATE_LIMIT_LOGIN")
+
+	s, m := newTestServer(t)
+	m.EXPECT().FindUserByUsername("nobody").Return(nil, errors.New("not found")).Times(2)
+
+	router := s.setupRouter()
+
+	for i, identifier := range []string{"nobody", "nobody", "NoBody"} {
+		body := fmt.Sprintf(`{"identifier":%q,"password":"password"}`, identifier)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(body))
+		router.ServeHTTP(w, req)
+
+		if i < 2 {
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+			continue
+		}
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestIPRateLimitIgnoresForwardedHeaders(t *testing.T) {
+	os.Setenv("RATE_LIMIT_IP", "2/1h")
+	defer os.Unsetenv("RATE_LIMIT_IP")
+
+	s, m := newTestServer(t)
+	m.EXPECT().FindUserByUsername("nobody").Return(nil, errors.New("not found")).Times(2)
+
+	router := s.setupRouter()
+
+	for i, forwarded := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/auth/password/forgot", strings.NewReader(`{"identifier":"nobody"}`))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Forwarded-For", forwarded)
+		router.ServeHTTP(w, req)
+
+		if i < 2 {
+			assert.Equal(t, http.StatusOK, w.Code)
+			continue
+		}
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	}
+}
+
+func TestIPBackoffIsNotClearedByOtherRequests(t *testing.T) {
+	s, m := newTestServer(t)
+	m.EXPECT().FindUserByUsername("nobody").Return(nil, errors.New("not found")).AnyTimes()
+
+	router := s.setupRouter()
+
+	post := func(path, body string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	login := `{"identifier":"nobody","password":"password"}`
+
+	// the free failures, then a request that succeeds without checking
+	// any credentials
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, post("/api/v1/auth/login", login))
+	}
+	assert.Equal(t, http.StatusOK, post("/api/v1/auth/password/forgot", `{"identifier":"nobody"}`))
+
+	assert.Equal(t, http.StatusUnauthorized, post("/api/v1/auth/login", login))
+	assert.Equal(t, http.StatusTooManyRequests, post("/api/v1/auth/password/forgot", `{"identifier":"nobody"}`))
+}
+
+func TestLoginLocksAccountAfterRepeatedFailures(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{Username: "spankie", Email: "spankie@gmail.com", Password: hash, Status: models.StatusActive, FailedLogins: 4}
+
+	s, m := newTestServer(t)
+	m.EXPECT().FindUserByUsername("spankie").Return(user, nil)
+	m.EXPECT().IncrementFailedLogins(user.Email).Return(5, nil)
+	m.EXPECT().LockUser(user.Email, gomock.Any()).DoAndReturn(func(email string, until time.Time) error {
+		assert.WithinDuration(t, time.Now().Add(defaultLockoutDuration), until, time.Minute)
+		return nil
+	})
+
+	router := s.setupRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{"identifier":"spankie","password":"wrong"}`))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestLoginResetsFailedLogins(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{Username: "spankie", Email: "spankie@gmail.com", Password: hash, Status: models.StatusLocked, LockedUntil: time.Now().Add(-time.Minute), FailedLogins: 2}
+
+	s, m := newTestServer(t)
+	expectSessions(m)
+	m.EXPECT().FindUserByUsername("spankie").Return(user, nil)
+	m.EXPECT().ResetFailedLogins(user.Email).Return(nil)
+
+	s.PasswordHasher = &passwords.Hasher{Algorithm: passwords.Bcrypt, BcryptCost: bcrypt.MinCost}
+	router := s.setupRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{"identifier":"spankie","password":"password"}`))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, models.StatusActive, user.Status)
+	assert.Zero(t, user.FailedLogins)
+}
+
+func TestSignupRejectsWeakPassword(t *testing.T) {
+	s, _ := newTestServer(t)
+	router := s.setupRouter()
+
+	user := models.User{
+		FirstName:      "Spankie",
+		LastName:       "Dee",
+		PasswordString: "Spankie2020",
+		Username:       "spankie",
+		Email:          "spankie_signup@gmail.com",
+		Phone:          "08909876787",
+	}
+
+	jsonuser, err := json.Marshal(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/auth/signup", strings.NewReader(string(jsonuser)))
+	router.ServeHTTP(w, req)
+
+	bodyString := w.Body.String()
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, bodyString, "validation failed on field 'PasswordString', condition: excludes_username")
+	assert.Contains(t, bodyString, "validation failed on field 'PasswordString', condition: strength { 2 }")
+}
+
+func TestSignupRejectsHugePasswords(t *testing.T) {
+	s, _ := newTestServer(t)
+	router := s.setupRouter()
+
+	signup := func(password string) *httptest.ResponseRecorder {
+		user := models.User{
+			FirstName:      "Spankie",
+			LastName:       "Dee",
+			PasswordString: password,
+			Username:       "spankie",
+			Email:          "spankie_signup@gmail.com",
+			Phone:          "08909876787",
+		}
+		jsonuser, err := json.Marshal(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/auth/signup", bytes.NewReader(jsonuser))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// only the length is reported for passwords over the maximum
+	w := signup(strings.Repeat("é", 40))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "condition: max { 72 }")
+	assert.NotContains(t, w.Body.String(), "strength")
+
+	w = signup(strings.Repeat("a", middleware.DefaultMaxBodySize))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "request body too large")
+}
+
+func TestSignupRejectsBreachedPassword(t *testing.T) {
+	const breached = "Gk7$mPq2xWz"
+	sum := sha1.Sum([]byte(breached))
+	list := fmt.Sprintf("%X:42\n", sum)
+
+	filter := passwords.NewBloomFilter(1, 0.001)
+	if _, err := filter.AddHashList(strings.NewReader(list)); err != nil {
+		t.Fatal(err)
+	}
+	var file bytes.Buffer
+	if _, err := filter.WriteTo(&file); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := passwords.ReadBloomFilter(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ := newTestServer(t)
+
+	policy := passwords.DefaultPolicy()
+	policy.Breached = loaded
+	s.PasswordPolicy = policy
+	router := s.setupRouter()
+
+	user := models.User{
+		FirstName:      "Spankie",
+		LastName:       "Dee",
+		PasswordString: breached,
+		Username:       "spankie",
+		Email:          "spankie_signup@gmail.com",
+		Phone:          "08909876787",
+	}
+
+	jsonuser, err := json.Marshal(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/auth/signup", strings.NewReader(string(jsonuser)))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "validation failed on field 'PasswordString', condition: not_breached")
+}
+
+func TestLoginUpgradesOutdatedHash(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{Username: "spankie", Email: "spankie@gmail.com", Password: hash, Status: models.StatusActive}
+	hasher := passwords.DefaultHasher()
+	hasher.Argon2.Memory = 1024
+
+	s, m := newTestServer(t)
+	expectSessions(m)
+	m.EXPECT().FindUserByUsername("spankie").Return(user, nil).Times(2)
+	m.EXPECT().UpdateUser(gomock.Any()).DoAndReturn(func(u *models.User) error {
+		assert.True(t, strings.HasPrefix(string(u.Password), "$argon2id$v=19$m=1024,t=3,p=2$"))
+		assert.False(t, hasher.NeedsRehash(u.Password))
+		return nil
+	})
+
+	s.PasswordHasher = hasher
+	router := s.setupRouter()
+
+	// the second login uses the upgraded hash and doesn't rehash again
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{"identifier":"spankie","password":"password"}`))
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+}
+
+func TestLoginUpgradesRotatedPepper(t *testing.T) {
+	hasher := passwords.DefaultHasher()
+	hasher.Argon2.Memory = 1024
+	old := &passwords.PepperedHasher{
+		Hasher:  hasher,
+		Peppers: map[int][]byte{1: []byte("first pepper, 16+ bytes")},
+		Current: 1,
+	}
+	hash, err := old.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{Username: "spankie", Email: "spankie@gmail.com", Password: hash, Status: models.StatusActive}
+
+	rotated := &passwords.PepperedHasher{
+		Hasher: hasher,
+		Peppers: map[int][]byte{
+			1: []byte("first pepper, 16+ bytes"),
+			2: []byte("second pepper, 16+ bytes"),
+		},
+		Current: 2,
+	}
+
+	s, m := newTestServer(t)
+	expectSessions(m)
+	m.EXPECT().FindUserByUsername("spankie").Return(user, nil)
+	m.EXPECT().UpdateUser(gomock.Any()).DoAndReturn(func(u *models.User) error {
+		assert.True(t, strings.HasPrefix(string(u.Password), "$pepper$k=2$argon2id$"))
+		ok, err := rotated.Verify("password", u.Password)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		return nil
+	})
+
+	s.PasswordHasher = rotated
+	router := s.setupRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{"identifier":"spankie","password":"password"}`))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestCookieMode(t *testing.T) {
+	os.Setenv("AUTH_COOKIES", "true")
+	defer os.Unsetenv("AUTH_COOKIES")
+
+	hasher := passwords.DefaultHasher()
+	hasher.Argon2.Memory = 1024
+	hash, err := hasher.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{Username: "spankie", Email: "spankie@gmail.com", Password: hash, Status: models.StatusActive}
+
+	s, m := newTestServer(t)
+	expectSessions(m)
+	m.EXPECT().FindUserByUsername("spankie").Return(user, nil)
+	m.EXPECT().FindUserByEmail(user.Email).Return(user, nil)
+	m.EXPECT().TokenInBlacklist(gomock.Any()).Return(false)
+
+	s.PasswordHasher = hasher
+	router := s.setupRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{"identifier":"spankie","password":"password"}`))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "access_token")
+	cookies := w.Result().Cookies()
+	assert.Len(t, cookies, 3)
+	for _, cookie := range cookies {
+		// scripts need to read the CSRF token
+		assert.Equal(t, cookie.Name != "csrf_token", cookie.HttpOnly)
+		assert.True(t, cookie.Secure)
+		assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+	}
+
+	// the access token cookie is used when there is no authorization header
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/me", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "spankie@gmail.com")
+}
+
+func TestCSRFProtectsCookieRequests(t *testing.T) {
+	os.Setenv("AUTH_COOKIES", "true")
+	defer os.Unsetenv("AUTH_COOKIES")
+
+	hasher := passwords.DefaultHasher()
+	hasher.Argon2.Memory = 1024
+	hash, err := hasher.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{Username: "spankie", Email: "spankie@gmail.com", Password: hash, Status: models.StatusActive}
+
+	s, m := newTestServer(t)
+	expectSessions(m)
+	m.EXPECT().FindUserByUsername("spankie").Return(user, nil)
+	m.EXPECT().FindUserByEmail(user.Email).Return(user, nil).AnyTimes()
+	m.EXPECT().TokenInBlacklist(gomock.Any()).Return(false).AnyTimes()
+	m.EXPECT().AddToBlackList(gomock.Any()).Return(nil).Times(2)
+
+	s.PasswordHasher = hasher
+	router := s.setupRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{"identifier":"spankie","password":"password"}`))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	cookies := w.Result().Cookies()
+
+	var csrfToken string
+	for _, cookie := range cookies {
+		if cookie.Name == "csrf_token" {
+			assert.False(t, cookie.HttpOnly)
+			csrfToken = cookie.Value
+		}
+	}
+	assert.NotEmpty(t, csrfToken)
+
+	// a valid token of another session, planted in the cookie by another
+	// subdomain, doesn't pass
+	planted, err := services.NewCSRFToken(os.Getenv("JWT_SECRET"), bson.NewObjectId().Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, header := range []string{"", "forged", planted, csrfToken} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/api/v1/logout", nil)
+		for _, cookie := range cookies {
+			if cookie.Name == "csrf_token" && header == planted {
+				cookie = &http.Cookie{Name: cookie.Name, Value: planted}
+			}
+			req.AddCookie(cookie)
+		}
+		if header != "" {
+			req.Header.Set("X-CSRF-Token", header)
+		}
+		router.ServeHTTP(w, req)
+
+		if header == csrfToken {
+			assert.Equal(t, http.StatusOK, w.Code)
+		} else {
+			assert.Equal(t, http.StatusForbidden, w.Code)
+		}
+	}
+}
+
+func TestCORSPolicy(t *testing.T) {
+	policy := middleware.DefaultCORSPolicy()
+	policy.AllowedOrigins = []string{"https://app.example.com", "https://*.example.org"}
+	public := middleware.DefaultCORSPolicy()
+	public.AllowedOrigins = []string{"*"}
+	public.AllowCredentials = false
+
+	r := gin.New()
+	r.Use(middleware.CORS(policy, map[string]*middleware.CORSPolicy{"/public": public}))
+	r.GET("/private", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/public/info", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		path, origin string
+		allowed      bool
+	}{
+		{"/private", "https://app.example.com", true},
+		{"/private", "https://eu.example.org", true},
+		{"/private", "http://eu.example.org", false},
+		{"/private", "https://example.org", false},
+		{"/private", "https://evilexample.org", false},
+		{"/private", "https://evil.com", false},
+		{"/public/info", "https://evil.com", true},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("OPTIONS", tt.path, nil)
+		req.Header.Set("Origin", tt.origin)
+		req.Header.Set("Access-Control-Request-Method", "DELETE")
+		r.ServeHTTP(w, req)
+
+		if !tt.allowed {
+			assert.Equal(t, http.StatusForbidden, w.Code, tt.origin)
+			continue
+		}
+		assert.Equal(t, http.StatusNoContent, w.Code, tt.origin)
+		assert.Contains(t, w.Header().Get("Access-Control-Allow-Methods"), "DELETE")
+		assert.Equal(t, tt.path == "/private", w.Header().Get("Access-Control-Allow-Credentials") == "true")
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	s, _ := newTestServer(t)
+	router := s.setupRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{}`))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "DENY", w.Header().Get("X-Frame-Options"))
+	assert.Contains(t, w.Header().Get("Content-Security-Policy"), "frame-ancestors 'none'")
+	assert.Equal(t, "no-referrer", w.Header().Get("Referrer-Policy"))
+	assert.Contains(t, w.Header().Get("Strict-Transport-Security"), "max-age=")
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+
+	// routes can override the headers, removing those left empty
+	framed := *s.SecurityHeaders
+	framed.FrameOptions = ""
+	framed.ContentSecurityPolicy = "default-src 'none'; frame-ancestors https://app.example.com"
+	router.GET("/framed", middleware.SecureHeaders(&framed), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/framed", nil)
+	router.ServeHTTP(w, req)
+
+	assert.NotContains(t, w.Header(), "X-Frame-Options")
+	assert.Equal(t, framed.ContentSecurityPolicy, w.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+}
+
+// accessToken returns an access token for user like the ones issued at login
+// expectSessions backs the session methods of m with a map
+func expectSessions(m *db.MockDB) map[string]*models.Session {
+	sessions := map[string]*models.Session{}
+	m.EXPECT().CreateSession(gomock.Any()).DoAndReturn(func(session *models.Session) (*models.Session, error) {
+		session.ID = bson.NewObjectId()
+		sessions[session.ID.Hex()] = session
+		return session, nil
+	}).AnyTimes()
+	m.EXPECT().FindSessionByID(gomock.Any()).DoAndReturn(func(id string) (*models.Session, error) {
+		if session, ok := sessions[id]; ok {
+			return session, nil
+		}
+		return nil, mgo.ErrNotFound
+	}).AnyTimes()
+	m.EXPECT().TouchSession(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	m.EXPECT().RevokeSession(gomock.Any()).DoAndReturn(func(id string) error {
+		if session, ok := sessions[id]; ok {
+			session.RevokedAt = time.Now()
+		}
+		return nil
+	}).AnyTimes()
+	return sessions
+}
+
+// accessToken returns an access token for user, tied to a new session
+// added to sessions
+func accessToken(t *testing.T, sessions map[string]*models.Session, user *models.User) string {
+	session := &models.Session{ID: bson.NewObjectId(), UserID: user.ID, LastSeenAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+	sessions[session.ID.Hex()] = session
+	claims := services.AccessTokenClaims(user, defaultOrgID(user), time.Now())
+	claims["sid"] = session.ID.Hex()
+	secret := os.Getenv("JWT_SECRET")
+	token, err := services.GenerateToken(jwt.SigningMethodHS256, claims, &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *token
+}
+
+func TestListingUsersRequiresPermission(t *testing.T) {
+	org := bson.NewObjectId()
+	tests := []struct {
+		name   string
+		user   *models.User
+		status int
+	}{
+		{"user", &models.User{Email: "user@gmail.com", Status: models.StatusActive, Memberships: []models.Membership{{OrgID: org}}}, http.StatusForbidden},
+		{"admin", &models.User{Email: "admin@gmail.com", Status: models.StatusActive, Roles: []string{rbac.RoleAdmin}, Memberships: []models.Membership{{OrgID: org}}}, http.StatusOK},
+		{"granted", &models.User{Email: "support@gmail.com", Status: models.StatusActive, Permissions: []string{"users:*"}, Memberships: []models.Membership{{OrgID: org}}}, http.StatusOK},
+		{"org admin", &models.User{Email: "manager@gmail.com", Status: models.StatusActive, Memberships: []models.Membership{{OrgID: org, Roles: []string{rbac.RoleOrgAdmin}}}}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, m := newTestServer(t)
+			sessions := expectSessions(m)
+			m.EXPECT().TokenInBlacklist(gomock.Any()).Return(false)
+			m.EXPECT().FindOrgGroups(gomock.Any()).Return(nil, nil).AnyTimes()
+			m.EXPECT().FindUserByEmail(tt.user.Email).Return(tt.user, nil)
+			if tt.status == http.StatusOK {
+				m.EXPECT().FindOrgUsersExcept(org.Hex(), tt.user.Email).Return([]models.User{}, nil)
+			}
+
+			router := s.setupRouter()
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/v1/users", nil)
+			req.Header.Set("Authorization", "Bearer "+accessToken(t, sessions, tt.user))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.status, w.Code)
+		})
+	}
+}
+
+func TestAdminDeactivateRevokesTokens(t *testing.T) {
+	s, m := newTestServer(t)
+	sessions := expectSessions(m)
+	admin := &models.User{ID: bson.NewObjectId(), Email: "admin@gmail.com", Status: models.StatusActive, Roles: []string{rbac.RoleAdmin}}
+	user := &models.User{ID: bson.NewObjectId(), Email: "user@gmail.com", Status: models.StatusActive}
+	token := accessToken(t, sessions, user)
+	// auth_time has a precision of one second
+	time.Sleep(time.Second)
+
+	m.EXPECT().TokenInBlacklist(gomock.Any()).Return(false).AnyTimes()
+	m.EXPECT().FindUserByEmail(admin.Email).Return(admin, nil)
+	m.EXPECT().FindUserByID(user.ID.Hex()).Return(user, nil)
+	m.EXPECT().SetUserStatus(user.ID.Hex(), models.StatusInactive).Return(nil)
+	m.EXPECT().RevokeUserTokens(user.ID.Hex(), gomock.Any()).DoAndReturn(func(id string, before time.Time) error {
+		user.TokensValidAfter = before
+		return nil
+	})
+
+	router := s.setupRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/admin/users/"+user.ID.Hex()+"/deactivate", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken(t, sessions, admin))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// tokens issued before the deactivation no longer work
+	m.EXPECT().FindUserByEmail(user.Email).Return(user, nil)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/me", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// admins can't deactivate themselves
+	m.EXPECT().FindUserByEmail(admin.Email).Return(admin, nil)
+	m.EXPECT().FindUserByID(admin.ID.Hex()).Return(admin, nil)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/admin/users/"+admin.ID.Hex()+"/deactivate", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken(t, sessions, admin))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestUsersCanOnlyReadThemselves(t *testing.T) {
+	user := &models.User{Email: "user@gmail.com", Username: "user", Status: models.StatusActive}
+	other := &models.User{Email: "other@gmail.com", Username: "other", Status: models.StatusActive}
+	admin := &models.User{Email: "admin@gmail.com", Username: "admin", Status: models.StatusActive, Roles: []string{rbac.RoleAdmin}}
+	tests := []struct {
+		name    string
+		subject *models.User
+		target  *models.User
+		status  int
+	}{
+		{"self", user, user, http.StatusOK},
+		{"other", user, other, http.StatusNotFound},
+		{"admin", admin, other, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, m := newTestServer(t)
+			sessions := expectSessions(m)
+			m.EXPECT().TokenInBlacklist(gomock.Any()).Return(false)
+			m.EXPECT().FindUserByEmail(tt.subject.Email).Return(tt.subject, nil)
+			m.EXPECT().FindUserByUsername(tt.target.Username).Return(tt.target, nil)
+
+			router := s.setupRouter()
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/v1/users/"+tt.target.Username, nil)
+			req.Header.Set("Authorization", "Bearer "+accessToken(t, sessions, tt.subject))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.status, w.Code)
+		})
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	orgA, orgB := bson.NewObjectId(), bson.NewObjectId()
+	manager := &models.User{ID: bson.NewObjectId(), Email: "manager@gmail.com", Status: models.StatusActive, Memberships: []models.Membership{{OrgID: orgA, Roles: []string{rbac.RoleOrgAdmin}}}}
+	colleague := &models.User{ID: bson.NewObjectId(), Email: "colleague@gmail.com", Username: "colleague", Status: models.StatusActive, Memberships: []models.Membership{{OrgID: orgA}}}
+	outsider := &models.User{ID: bson.NewObjectId(), Email: "outsider@gmail.com", Username: "outsider", Status: models.StatusActive, Memberships: []models.Membership{{OrgID: orgB}}}
+	admin := &models.User{ID: bson.NewObjectId(), Email: "admin@gmail.com", Status: models.StatusActive, Roles: []string{rbac.RoleAdmin}, Memberships: []models.Membership{{OrgID: orgA}}}
+
+	s, m := newTestServer(t)
+	sessions := expectSessions(m)
+	m.EXPECT().TokenInBlacklist(gomock.Any()).Return(false).AnyTimes()
+	m.EXPECT().FindOrgGroups(gomock.Any()).Return(nil, nil).AnyTimes()
+	router := s.setupRouter()
+	request := func(method, path string, user *models.User, token string) int {
+		m.EXPECT().FindUserByEmail(user.Email).Return(user, nil)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// members of the same organization can see each other
+	m.EXPECT().FindUserByUsername(colleague.Username).Return(colleague, nil)
+	assert.Equal(t, http.StatusOK, request("GET", "/api/v1/users/colleague", manager, accessToken(t, sessions, manager)))
+
+	// but not the members of other organizations, even if they manage users
+	m.EXPECT().FindUserByUsername(outsider.Username).Return(outsider, nil)
+	assert.Equal(t, http.StatusNotFound, request("GET", "/api/v1/users/outsider", manager, accessToken(t, sessions, manager)))
+
+	// org admins can't act on accounts, not even those of their members
+	assert.Equal(t, http.StatusForbidden, request("POST", "/api/v1/admin/users/"+colleague.ID.Hex()+"/deactivate", manager, accessToken(t, sessions, manager)))
+	assert.Equal(t, http.StatusForbidden, request("DELETE", "/api/v1/admin/users/"+colleague.ID.Hex(), manager, accessToken(t, sessions, manager)))
+
+	// they remove them from the organization instead
+	m.EXPECT().FindOrganizationByID(orgA.Hex()).Return(&models.Organization{ID: orgA}, nil).AnyTimes()
+	m.EXPECT().FindUserByID(colleague.ID.Hex()).Return(colleague, nil)
+	m.EXPECT().RemoveMembership(colleague.ID.Hex(), orgA.Hex()).Return(nil)
+	assert.Equal(t, http.StatusOK, request("DELETE", "/api/v1/orgs/"+orgA.Hex()+"/members/"+colleague.ID.Hex(), manager, accessToken(t, sessions, manager)))
+
+	// but only if they aren't more powerful than them
+	m.EXPECT().FindUserByID(admin.ID.Hex()).Return(admin, nil)
+	assert.Equal(t, http.StatusForbidden, request("DELETE", "/api/v1/orgs/"+orgA.Hex()+"/members/"+admin.ID.Hex(), manager, accessToken(t, sessions, manager)))
+	m.EXPECT().FindUserByID(outsider.ID.Hex()).Return(outsider, nil)
+	assert.Equal(t, http.StatusNotFound, request("DELETE", "/api/v1/orgs/"+orgA.Hex()+"/members/"+outsider.ID.Hex(), manager, accessToken(t, sessions, manager)))
+
+	// tokens for an organization the user was removed from are rejected
+	token := accessToken(t, sessions, colleague)
+	colleague.Memberships = nil
+	assert.Equal(t, http.StatusForbidden, request("GET", "/api/v1/me", colleague, token))
+}
+
+// recordingMailer passes the emails it is asked to send to a channel
+type recordingMailer chan string
+
+func (m recordingMailer) Send(to, subject, body string) error {
+	m <- body
+	return nil
+}
+
+func TestInvitingSomeoneToAnOrganization(t *testing.T) {
+	org := &models.Organization{ID: bson.NewObjectId(), Name: "Acme"}
+	manager := &models.User{ID: bson.NewObjectId(), Email: "manager@gmail.com", Status: models.StatusActive, Memberships: []models.Membership{{OrgID: org.ID, Roles: []string{rbac.RoleOrgAdmin}}}}
+	var invitation *models.Invitation
+
+	s, m := newTestServer(t)
+	sessions := expectSessions(m)
+	m.EXPECT().TokenInBlacklist(gomock.Any()).Return(false).AnyTimes()
+	m.EXPECT().FindOrgGroups(gomock.Any()).Return(nil, nil).AnyTimes()
+	m.EXPECT().FindUserByEmail(manager.Email).Return(manager, nil).AnyTimes()
+	m.EXPECT().FindOrgGroups(manager.Memberships[0].OrgID.Hex()).Return(nil, nil).AnyTimes()
+	m.EXPECT().FindOrganizationByID(org.ID.Hex()).Return(org, nil).AnyTimes()
+	m.EXPECT().CreateInvitation(gomock.Any()).DoAndReturn(func(i *models.Invitation) (*models.Invitation, error) {
+		i.ID = bson.NewObjectId()
+		invitation = i
+		return i, nil
+	})
+	mails := make(recordingMailer, 1)
+	s.Mailer = mails
+	router := s.setupRouter()
+	invite := func(body string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/orgs/"+org.ID.Hex()+"/invitations", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+accessToken(t, sessions, manager))
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// org admins can't hand out more power than they have
+	assert.Equal(t, http.StatusForbidden, invite(`{"email": "new@gmail.com", "roles": ["admin"]}`))
+	assert.Equal(t, http.StatusCreated, invite(`{"email": "New@gmail.com"}`))
+	assert.Equal(t, "new@gmail.com", invitation.Email)
+	assert.Equal(t, []string{rbac.RoleUser}, invitation.Roles)
+
+	var body string
+	select {
+	case body = <-mails:
+	case <-time.After(time.Second):
+		t.Fatal("invitation wasn't sent")
+	}
+	lines := strings.Split(strings.TrimSpace(strings.Split(body, "\n\nIf")[0]), "\n")
+	token := lines[len(lines)-1]
+
+	// people without an account sign up when accepting, the invitation
+	// is claimed first and given back if signing up fails
+	newUser := &models.User{ID: bson.NewObjectId(), Email: invitation.Email}
+	m.EXPECT().FindInvitationByID(invitation.ID.Hex()).Return(invitation, nil).Times(2)
+	m.EXPECT().FindUserByEmail(invitation.Email).Return(nil, mgo.ErrNotFound).Times(2)
+	gomock.InOrder(
+		m.EXPECT().SetInvitationStatus(invitation.ID.Hex(), models.InvitationAccepted).Return(nil),
+		m.EXPECT().CreateUser(gomock.Any()).DoAndReturn(func(u *models.User) (*models.User, error) {
+			return u, db.ValidationError{Field: "username", Message: "already in use"}
+		}),
+		m.EXPECT().ReleaseInvitation(invitation.ID.Hex()).Return(nil),
+		m.EXPECT().SetInvitationStatus(invitation.ID.Hex(), models.InvitationAccepted).Return(nil),
+		m.EXPECT().CreateUser(gomock.Any()).DoAndReturn(func(u *models.User) (*models.User, error) {
+			assert.Equal(t, invitation.Email, u.Email)
+			return newUser, nil
+		}),
+		m.EXPECT().AddMembership(newUser.ID.Hex(), models.Membership{OrgID: org.ID, Roles: invitation.Roles}).Return(nil),
+	)
+
+	accept := func(username string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/auth/invitations/accept", strings.NewReader(`{
+			"token": "`+token+`",
+			"user": {"first_name": "New", "last_name": "Member", "phone": "08012345678", "email": "whatever@gmail.com", "username": "`+username+`", "password": "v9#Lq2!zRw"}
+		}`))
+		router.ServeHTTP(w, req)
+		return w
+	}
+	w := accept("taken")
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	w = accept("newmember")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func TestGroupMembersInheritRoles(t *testing.T) {
+	org := bson.NewObjectId()
+	member := &models.User{ID: bson.NewObjectId(), Email: "member@gmail.com", Status: models.StatusActive, Memberships: []models.Membership{{OrgID: org}}}
+	support := models.Group{ID: bson.NewObjectId(), OrgID: org, Name: "Support", Roles: []string{"support"}}
+	tier2 := models.Group{ID: bson.NewObjectId(), OrgID: org, ParentID: support.ID, Name: "Tier 2", Members: []bson.ObjectId{member.ID}}
+
+	s, m := newTestServer(t)
+	sessions := expectSessions(m)
+	m.EXPECT().TokenInBlacklist(gomock.Any()).Return(false).AnyTimes()
+	m.EXPECT().FindUserByEmail(member.Email).Return(member, nil).Times(3)
+	// groups are cached until they change
+	m.EXPECT().FindOrgGroups(org.Hex()).DoAndReturn(func(string) ([]models.Group, error) {
+		return []models.Group{support, tier2}, nil
+	}).Times(2)
+	m.EXPECT().FindOrgUsersExcept(org.Hex(), member.Email).Return([]models.User{}, nil)
+
+	s.Roles = rbac.Roles{rbac.RoleUser: {}, "support": {rbac.UsersList, rbac.AuditRead}}
+	router := s.setupRouter()
+	request := func(path string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken(t, sessions, member))
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, request("/api/v1/users"))
+
+	// the roles only apply within the organization
+	assert.Equal(t, http.StatusForbidden, request("/api/v1/admin/audit"))
+
+	// roles aren't inherited from subgroups
+	support.Members, tier2.Members = []bson.ObjectId{member.ID}, nil
+	support.Roles, tier2.Roles = nil, []string{"support"}
+	s.Groups.Invalidate(org.Hex())
+	assert.Equal(t, http.StatusForbidden, request("/api/v1/users"))
+}
+
+func TestRevokingGroupRoles(t *testing.T) {
+	org := &models.Organization{ID: bson.NewObjectId(), Name: "Acme"}
+	manager := &models.User{ID: bson.NewObjectId(), Email: "manager@gmail.com", Status: models.StatusActive, Memberships: []models.Membership{{OrgID: org.ID, Roles: []string{rbac.RoleOrgAdmin}}}}
+	member := &models.User{ID: bson.NewObjectId(), Email: "member@gmail.com", Status: models.StatusActive, Memberships: []models.Membership{{OrgID: org.ID}}}
+	admin := &models.User{ID: bson.NewObjectId(), Email: "admin@gmail.com", Status: models.StatusActive, Roles: []string{rbac.RoleAdmin}, Memberships: []models.Membership{{OrgID: org.ID}}}
+	admins := &models.Group{ID: bson.NewObjectId(), OrgID: org.ID, Name: "Admins", Roles: []string{rbac.RoleAdmin}, Members: []bson.ObjectId{admin.ID}}
+	staff := &models.Group{ID: bson.NewObjectId(), OrgID: org.ID, Name: "Staff", Roles: []string{rbac.RoleUser}, Members: []bson.ObjectId{member.ID, admin.ID}}
+
+	s, m := newTestServer(t)
+	sessions := expectSessions(m)
+	m.EXPECT().TokenInBlacklist(gomock.Any()).Return(false).AnyTimes()
+	m.EXPECT().FindUserByEmail(manager.Email).Return(manager, nil).AnyTimes()
+	m.EXPECT().FindOrganizationByID(org.ID.Hex()).Return(org, nil).AnyTimes()
+	m.EXPECT().FindOrgGroups(org.ID.Hex()).Return([]models.Group{*admins, *staff}, nil).AnyTimes()
+	m.EXPECT().FindGroupByID(admins.ID.Hex()).Return(admins, nil).AnyTimes()
+	m.EXPECT().FindGroupByID(staff.ID.Hex()).Return(staff, nil).AnyTimes()
+	m.EXPECT().FindUserByID(member.ID.Hex()).Return(member, nil).AnyTimes()
+	m.EXPECT().FindUserByID(admin.ID.Hex()).Return(admin, nil).AnyTimes()
+	m.EXPECT().RemoveGroupMember(staff.ID.Hex(), member.ID.Hex()).Return(nil)
+
+	router := s.setupRouter()
+	request := func(path string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/api/v1/orgs/"+org.ID.Hex()+"/groups/"+path, nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken(t, sessions, manager))
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// org admins can't take away roles they couldn't grant
+	assert.Equal(t, http.StatusForbidden, request(admins.ID.Hex()))
+	assert.Equal(t, http.StatusForbidden, request(admins.ID.Hex()+"/members/"+admin.ID.Hex()))
+	// nor take anything from users with more permissions than them
+	assert.Equal(t, http.StatusForbidden, request(staff.ID.Hex()))
+	assert.Equal(t, http.StatusForbidden, request(staff.ID.Hex()+"/members/"+admin.ID.Hex()))
+
+	assert.Equal(t, http.StatusOK, request(staff.ID.Hex()+"/members/"+member.ID.Hex()))
+}
+
+func TestImpersonation(t *testing.T) {
+	admin := &models.User{ID: bson.NewObjectId(), Email: "admin@gmail.com", Status: models.StatusActive, Roles: []string{rbac.RoleAdmin}}
+	user := &models.User{ID: bson.NewObjectId(), Email: "user@gmail.com", Status: models.StatusActive}
+
+	s, m := newTestServer(t)
+	sessions := expectSessions(m)
+	m.EXPECT().TokenInBlacklist(gomock.Any()).Return(false).AnyTimes()
+	m.EXPECT().FindUserByEmail(admin.Email).Return(admin, nil).AnyTimes()
+	m.EXPECT().FindUserByEmail(user.Email).Return(user, nil).AnyTimes()
+	m.EXPECT().FindUserByID(user.ID.Hex()).Return(user, nil)
+	router := s.setupRouter()
+	request := func(method, path, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(`{"current_password": "old", "new_password": "v9#Lq2!zRw"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("POST", "/api/v1/admin/users/"+user.ID.Hex()+"/impersonate", accessToken(t, sessions, admin))
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := &struct {
+		Data struct {
+			AccessToken string `json:"access_token"`
+		} `json:"data"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), body); err != nil {
+		t.Fatal(err)
+	}
+	token := body.Data.AccessToken
+	secret := os.Getenv("JWT_SECRET")
+	_, claims, err := services.AuthorizeToken(&token, &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, user.Email, claims["user_email"])
+	assert.Equal(t, admin.Email, services.ActorClaim(claims))
+
+	assert.Equal(t, http.StatusOK, request("GET", "/api/v1/me", token).Code)
+	// sensitive actions are blocked
+	assert.Equal(t, http.StatusForbidden, request("PUT", "/api/v1/me/password", token).Code)
+	assert.Equal(t, http.StatusForbidden, request("POST", "/api/v1/admin/users/"+admin.ID.Hex()+"/impersonate", token).Code)
+	for _, path := range []string{"/api/v1/me/organization", "/api/v1/me/update"} {
+		assert.Equal(t, http.StatusForbidden, request("PUT", path, token).Code, path)
+	}
+	for _, path := range []string{"/api/v1/orgs", "/api/v1/logout"} {
+		assert.Equal(t, http.StatusForbidden, request("POST", path, token).Code, path)
+	}
+
+	// stopping ends the session of the impersonation token
+	assert.Equal(t, http.StatusOK, request("POST", "/api/v1/impersonation/stop", token).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "/api/v1/me", token).Code)
+
+	// managing the users of an organization doesn't let anyone impersonate
+	// them
+	manager := &models.User{ID: bson.NewObjectId(), Email: "manager@gmail.com", Status: models.StatusActive, Memberships: []models.Membership{{OrgID: bson.NewObjectId(), Roles: []string{rbac.RoleOrgAdmin}}}}
+	m.EXPECT().FindUserByEmail(manager.Email).Return(manager, nil).AnyTimes()
+	m.EXPECT().FindOrgGroups(manager.Memberships[0].OrgID.Hex()).Return(nil, nil).AnyTimes()
+	assert.Equal(t, http.StatusForbidden, request("POST", "/api/v1/admin/users/"+user.ID.Hex()+"/impersonate", accessToken(t, sessions, manager)).Code)
+
+	// and admins can't impersonate users with more permissions than them
+	support := &models.User{ID: bson.NewObjectId(), Email: "support@gmail.com", Status: models.StatusActive, Permissions: []string{rbac.Impersonate}}
+	m.EXPECT().FindUserByEmail(support.Email).Return(support, nil).AnyTimes()
+	m.EXPECT().FindUserByID(admin.ID.Hex()).Return(admin, nil)
+	assert.Equal(t, http.StatusForbidden, request("POST", "/api/v1/admin/users/"+admin.ID.Hex()+"/impersonate", accessToken(t, sessions, support)).Code)
+}
+
+// blacklistMatcher matches blacklist entries for a token
+type blacklistMatcher struct {
+	token string
+}
+
+func (b *blacklistMatcher) Matches(x interface{}) bool {
+	blacklist, ok := x.(*models.Blacklist)
+	return ok && blacklist.Token == b.token
+}
+
+func (b *blacklistMatcher) String() string {
+	return "is a blacklist entry for " + b.token
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sink, err := audit.NewFileSink(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	admin := &models.User{Email: "admin@gmail.com", Status: models.StatusActive, Roles: []string{rbac.RoleAdmin}}
+	s, m := newTestServer(t)
+	sessions := expectSessions(m)
+	m.EXPECT().TokenInBlacklist(gomock.Any()).Return(false).AnyTimes()
+	m.EXPECT().FindUserByEmail(admin.Email).Return(admin, nil)
+	m.EXPECT().FindUserByEmail("nobody@gmail.com").Return(nil, mgo.ErrNotFound)
+	s.Audit = sink
+	router := s.setupRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{"identifier": "nobody@gmail.com", "password": "secret"}`))
+	req.Header.Set("User-Agent", "audit-test")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/admin/audit?type=login&outcome=failure", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken(t, sessions, admin))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	body := &struct {
+		Data struct {
+			Events []audit.Event `json:"events"`
+			Total  int           `json:"total"`
+		} `json:"data"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), body); err != nil {
+		t.Fatal(err)
+	}
+	if assert.Equal(t, 1, body.Data.Total) {
+		event := body.Data.Events[0]
+		assert.Equal(t, "nobody@gmail.com", event.Subject)
+		assert.Equal(t, "unknown user", event.Reason)
+		assert.Equal(t, "audit-test", event.UserAgent)
+	}
+}
+
+func TestRevokingSessions(t *testing.T) {
+	hasher := passwords.DefaultHasher()
+	hasher.Argon2.Memory = 1024
+	hash, err := hasher.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{ID: bson.NewObjectId(), Username: "spankie", Email: "spankie@gmail.com", Password: hash, Status: models.StatusActive}
+
+	s, m := newTestServer(t)
+	sessions := expectSessions(m)
+	m.EXPECT().FindUserByUsername("spankie").Return(user, nil).AnyTimes()
+	m.EXPECT().FindUserByEmail(user.Email).Return(user, nil).AnyTimes()
+	m.EXPECT().TokenInBlacklist(gomock.Any()).Return(false).AnyTimes()
+	m.EXPECT().FindUserSessions(user.ID.Hex()).DoAndReturn(func(string) ([]models.Session, error) {
+		var active []models.Session
+		for _, session := range sessions {
+			if session.IsActive() {
+				active = append(active, *session)
+			}
+		}
+		return active, nil
+	}).AnyTimes()
+	s.PasswordHasher = hasher
+	router := s.setupRouter()
+
+	login := func(userAgent string) string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{"identifier":"spankie","password":"password"}`))
+		req.Header.Set("User-Agent", userAgent)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		body := &struct {
+			Data struct {
+				AccessToken string `json:"access_token"`
+			} `json:"data"`
+		}{}
+		if err := json.Unmarshal(w.Body.Bytes(), body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Data.AccessToken
+	}
+	request := func(method, path, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, req)
+		return w
+	}
+	laptop := login("Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0")
+	phone := login("Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Version/17.0 Mobile/15E148 Safari/604.1")
+
+	w := request("GET", "/api/v1/me/sessions", laptop)
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := &struct {
+		Data struct {
+			Sessions []struct {
+				ID      string `json:"id"`
+				Device  string `json:"device"`
+				Current bool   `json:"current"`
+			} `json:"sessions"`
+		} `json:"data"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), body); err != nil {
+		t.Fatal(err)
+	}
+	var phoneSession string
+	if assert.Len(t, body.Data.Sessions, 2) {
+		for _, session := range body.Data.Sessions {
+			if session.Device == "Safari on iPhone" {
+				phoneSession = session.ID
+				assert.False(t, session.Current)
+			} else {
+				assert.Equal(t, "Firefox on Linux", session.Device)
+				assert.True(t, session.Current)
+			}
+		}
+	}
+
+	// the revoked session can't be used anymore, the other one can
+	assert.Equal(t, http.StatusOK, request("DELETE", "/api/v1/me/sessions/"+phoneSession, laptop).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "/api/v1/me", phone).Code)
+	assert.Equal(t, http.StatusOK, request("GET", "/api/v1/me", laptop).Code)
+
+	m.EXPECT().RevokeUserSessions(user.ID.Hex()).DoAndReturn(func(string) error {
+		for _, session := range sessions {
+			session.RevokedAt = time.Now()
+		}
+		return nil
+	})
+	m.EXPECT().RevokeUserTokens(user.ID.Hex(), gomock.Any()).Return(nil)
+	assert.Equal(t, http.StatusOK, request("DELETE", "/api/v1/me/sessions", laptop).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "/api/v1/me", laptop).Code)
+}
+
+func TestRevokingTokens(t *testing.T) {
+	hasher := passwords.DefaultHasher()
+	hasher.Argon2.Memory = 1024
+	hash, err := hasher.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{ID: bson.NewObjectId(), Username: "spankie", Email: "spankie@gmail.com", Password: hash, Status: models.StatusActive}
+
+	s, m := newTestServer(t)
+	expectSessions(m)
+	m.EXPECT().FindUserByUsername("spankie").Return(user, nil).AnyTimes()
+	m.EXPECT().FindUserByEmail(user.Email).Return(user, nil).AnyTimes()
+	m.EXPECT().TokenInBlacklist(gomock.Any()).Return(false).AnyTimes()
+	s.PasswordHasher = hasher
+	router := s.setupRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{"identifier":"spankie","password":"password"}`))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := &struct {
+		Data struct {
+			AccessToken  string `json:"access_token"`
+			RefreshToken string `json:"refresh_token"`
+		} `json:"data"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), body); err != nil {
+		t.Fatal(err)
+	}
+
+	revoke := func(form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/oauth/revoke", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(t, http.StatusBadRequest, revoke(url.Values{}).Code)
+	assert.Equal(t, http.StatusOK, revoke(url.Values{"token": {"not-a-token"}}).Code)
+
+	// revoking the refresh token ends the session its access token belongs to
+	m.EXPECT().AddToBlackList(&blacklistMatcher{body.Data.RefreshToken}).Return(nil)
+	w = revoke(url.Values{"token": {body.Data.RefreshToken}, "token_type_hint": {"refresh_token"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/me", nil)
+	req.Header.Set("Authorization", "Bearer "+body.Data.AccessToken)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// the tokens of a client can only be revoked by it
+	client := &models.Client{ID: bson.NewObjectId(), Name: "app", SecretHash: services.HashToken("secret")}
+	other := &models.Client{ID: bson.NewObjectId(), Name: "other", SecretHash: services.HashToken("other")}
+	m.EXPECT().FindClientByID(client.ID.Hex()).Return(client, nil).AnyTimes()
+	m.EXPECT().FindClientByID(other.ID.Hex()).Return(other, nil).AnyTimes()
+	secret := os.Getenv("JWT_SECRET")
+	clientToken, err := services.GenerateToken(jwt.SigningMethodHS256, jwt.MapClaims{
+		"typ":       services.RefreshTokenType,
+		"exp":       time.Now().Add(time.Hour).Unix(),
+		"sid":       bson.NewObjectId().Hex(),
+		"client_id": client.ID.Hex(),
+	}, &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusUnauthorized, revoke(url.Values{"token": {*clientToken}}).Code)
+	assert.Equal(t, http.StatusUnauthorized, revoke(url.Values{"token": {*clientToken}, "client_id": {client.ID.Hex()}, "client_secret": {"wrong"}}).Code)
+	assert.Equal(t, http.StatusBadRequest, revoke(url.Values{"token": {*clientToken}, "client_id": {other.ID.Hex()}, "client_secret": {"other"}}).Code)
+	m.EXPECT().AddToBlackList(&blacklistMatcher{*clientToken}).Return(nil)
+	assert.Equal(t, http.StatusOK, revoke(url.Values{"token": {*clientToken}, "client_id": {client.ID.Hex()}, "client_secret": {"secret"}}).Code)
+}
+
+func TestIntrospection(t *testing.T) {
+	user := &models.User{ID: bson.NewObjectId(), Username: "spankie", Email: "spankie@gmail.com", Status: models.StatusActive}
+	client := &models.Client{ID: bson.NewObjectId(), Name: "api", SecretHash: services.HashToken("secret"), ResourceServer: true}
+	app := &models.Client{ID: bson.NewObjectId(), Name: "app", SecretHash: services.HashToken("secret")}
+
+	s, m := newTestServer(t)
+	sessions := expectSessions(m)
+	m.EXPECT().FindClientByID(client.ID.Hex()).Return(client, nil).AnyTimes()
+	m.EXPECT().FindClientByID(app.ID.Hex()).Return(app, nil).AnyTimes()
+	m.EXPECT().FindUserByEmail(user.Email).Return(user, nil).AnyTimes()
+	m.EXPECT().TokenInBlacklist(gomock.Any()).Return(false).AnyTimes()
+	router := s.setupRouter()
+
+	introspectAs := func(client *models.Client, token, secret string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/oauth/introspect", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID.Hex(), secret)
+		router.ServeHTTP(w, req)
+		info := map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &info)
+		return w, info
+	}
+	introspect := func(token, secret string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		return introspectAs(client, token, secret)
+	}
+	token := accessToken(t, sessions, user)
+
+	w, _ := introspect(token, "wrong")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w, info := introspect(token, "secret")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, true, info["active"])
+	assert.Equal(t, user.ID.Hex(), info["sub"])
+	assert.Equal(t, "spankie", info["username"])
+	assert.NotNil(t, info["exp"])
+
+	_, info = introspect("not-a-token", "secret")
+	assert.Equal(t, map[string]interface{}{"active": false}, info)
+
+	// expired tokens are inactive
+	secret := os.Getenv("JWT_SECRET")
+	_, claims, err := services.AuthorizeToken(&token, &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	expired, err := services.GenerateToken(jwt.SigningMethodHS256, claims, &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, info = introspect(*expired, "secret")
+	assert.Equal(t, map[string]interface{}{"active": false}, info)
+
+	// clients that aren't resource servers only learn about their tokens
+	_, info = introspectAs(app, token, "secret")
+	assert.Equal(t, map[string]interface{}{"active": false}, info)
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+	claims["client_id"] = app.ID.Hex()
+	claims["act"] = map[string]interface{}{"sub": "admin@gmail.com"}
+	appToken, err := services.GenerateToken(jwt.SigningMethodHS256, claims, &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, info = introspectAs(app, *appToken, "secret")
+	assert.Equal(t, true, info["active"])
+	assert.Nil(t, info["act"])
+	_, info = introspect(*appToken, "secret")
+	assert.NotNil(t, info["act"])
+}
+
+func TestIntrospectionIsRateLimitedPerClient(t *testing.T) {
+	os.Setenv("RATE_LIMIT_CLIENT", "2/1h")
+	defer os.Unsetenv("RATE_LIMIT_CLIENT")
+	os.Setenv("RATE_LIMIT_IP", "1/1h")
+	defer os.Unsetenv("RATE_LIMIT_IP")
+
+	api := &models.Client{ID: bson.NewObjectId(), Name: "api", SecretHash: services.HashToken("secret"), ResourceServer: true}
+	other := &models.Client{ID: bson.NewObjectId(), Name: "other", SecretHash: services.HashToken("secret"), ResourceServer: true}
+
+	s, m := newTestServer(t)
+	m.EXPECT().FindClientByID(api.ID.Hex()).Return(api, nil).AnyTimes()
+	m.EXPECT().FindClientByID(other.ID.Hex()).Return(other, nil).AnyTimes()
+	router := s.setupRouter()
+
+	introspect := func(client *models.Client, secret string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/oauth/introspect", strings.NewReader(url.Values{"token": {"not-a-token"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.SetBasicAuth(client.ID.Hex(), secret)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// clients are throttled once they're authenticated, whatever their IP
+	// address
+	assert.Equal(t, http.StatusUnauthorized, introspect(api, "wrong"))
+	assert.Equal(t, http.StatusOK, introspect(api, "secret"))
+	assert.Equal(t, http.StatusOK, introspect(api, "secret"))
+	assert.Equal(t, http.StatusTooManyRequests, introspect(api, "secret"))
+	assert.Equal(t, http.StatusOK, introspect(other, "secret"))
+}
+
+// formTokenPattern finds the token of the login and consent page
+var formTokenPattern = regexp.MustCompile(`name="form_token" value="([^"]+)"`)
+
+// consent loads the login and consent page of the authorization request
+// params and submits it as the user with identifier and password
+func consent(t *testing.T, router http.Handler, params url.Values, identifier, password string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/oauth/authorize?"+params.Encode(), nil)
+	router.ServeHTTP(w, req)
+	match := formTokenPattern.FindStringSubmatch(w.Body.String())
+	if w.Code != http.StatusOK || match == nil {
+		t.Fatalf("can't load the authorize page: %d %s", w.Code, w.Body.String())
+	}
+
+	form := url.Values{"form_token": {match[1]}, "identifier": {identifier}, "password": {password}, "consent": {"allow"}}
+	for name, values := range params {
+		form[name] = values
+	}
+	req, _ = http.NewRequest("POST", "/api/v1/oauth/authorize", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	hasher := passwords.DefaultHasher()
+	hasher.Argon2.Memory = 1024
+	hash, err := hasher.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{ID: bson.NewObjectId(), Username: "spankie", Email: "spankie@gmail.com", Password: hash, Status: models.StatusActive}
+	client := &models.Client{ID: bson.NewObjectId(), Name: "Notes", Public: true, RedirectURIs: []string{"https://notes.example.com/callback"}}
+	other := &models.Client{ID: bson.NewObjectId(), Name: "Other", Public: true, RedirectURIs: []string{"https://notes.example.com/callback"}}
+
+	s, m := newTestServer(t)
+	expectSessions(m)
+	m.EXPECT().FindClientByID(client.ID.Hex()).Return(client, nil).AnyTimes()
+	m.EXPECT().FindClientByID(other.ID.Hex()).Return(other, nil).AnyTimes()
+	m.EXPECT().FindUserByUsername("spankie").Return(user, nil).AnyTimes()
+	m.EXPECT().FindUserByEmail(user.Email).Return(user, nil).AnyTimes()
+	m.EXPECT().FindUserByID(user.ID.Hex()).Return(user, nil).AnyTimes()
+	m.EXPECT().TokenInBlacklist(gomock.Any()).Return(false).AnyTimes()
+	codes := map[string]*models.AuthorizationCode{}
+	m.EXPECT().CreateAuthorizationCode(gomock.Any()).DoAndReturn(func(code *models.AuthorizationCode) (*models.AuthorizationCode, error) {
+		codes[code.CodeHash] = code
+		return code, nil
+	}).Times(2)
+	m.EXPECT().ConsumeAuthorizationCode(gomock.Any(), gomock.Any()).DoAndReturn(func(hash, clientID string) (*models.AuthorizationCode, error) {
+		code, ok := codes[hash]
+		if !ok || !code.UsedAt.IsZero() || code.ClientID.Hex() != clientID {
+			return nil, mgo.ErrNotFound
+		}
+		code.UsedAt = time.Now()
+		return code, nil
+	}).Times(4)
+	s.PasswordHasher = hasher
+	router := s.setupRouter()
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ID.Hex()},
+		"redirect_uri":          {"https://notes.example.com/callback"},
+		"state":                 {"xyz"},
+		"code_challenge":        {services.S256Challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/oauth/authorize?"+params.Encode(), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Sign in to continue to Notes")
+
+	// codes are never sent to unregistered redirect URIs
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/oauth/authorize?"+strings.Replace(params.Encode(), "notes.example.com", "evil.example.com", 1), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, w.Header().Get("Location"))
+
+	// code challenges must be S256 hashes
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/oauth/authorize?"+strings.Replace(params.Encode(), services.S256Challenge(verifier), "short", 1), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Contains(t, w.Header().Get("Location"), "error=invalid_request")
+
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// the page can't be submitted from elsewhere, so nobody can be logged
+	// in to a client with someone else's account
+	form := url.Values{"identifier": {"spankie"}, "password": {"password"}, "consent": {"allow"}}
+	for name, values := range params {
+		form[name] = values
+	}
+	w = post("/api/v1/oauth/authorize", form)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = consent(t, router, params, "spankie", "password")
+	assert.Equal(t, http.StatusFound, w.Code)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "notes.example.com", location.Host)
+	assert.Equal(t, "xyz", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	assert.NotEmpty(t, code)
+
+	exchange := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {"https://notes.example.com/callback"},
+		"client_id":     {client.ID.Hex()},
+		"code_verifier": {verifier},
+	}
+	// other clients can't use the code, nor use it up
+	exchange.Set("client_id", other.ID.Hex())
+	w = post("/api/v1/oauth/token", exchange)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_grant")
+
+	exchange.Set("client_id", client.ID.Hex())
+	w = post("/api/v1/oauth/token", exchange)
+	assert.Equal(t, http.StatusOK, w.Code)
+	tokens := &struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), tokens); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Bearer", tokens.TokenType)
+	assert.NotEmpty(t, tokens.RefreshToken)
+
+	// the token of a client only grants what its scope covers
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/me", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// codes can only be used once
+	w = post("/api/v1/oauth/token", exchange)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_grant")
+
+	// the refresh token gets new access tokens, without a wider scope
+	refresh := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {tokens.RefreshToken},
+		"client_id":     {client.ID.Hex()},
+	}
+	w = post("/api/v1/oauth/token", refresh)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "access_token")
+	refresh.Set("scope", "openid")
+	w = post("/api/v1/oauth/token", refresh)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_scope")
+
+	// the redirect URI must be sent again if it was in the authorization
+	// request
+	w = consent(t, router, params, "spankie", "password")
+	location, err = url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange.Set("code", location.Query().Get("code"))
+	exchange.Del("redirect_uri")
+	w = post("/api/v1/oauth/token", exchange)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_grant")
+}
+
+func TestOpenIDConnect(t *testing.T) {
+	hasher := passwords.DefaultHasher()
+	hasher.Argon2.Memory = 1024
+	hash, err := hasher.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{ID: bson.NewObjectId(), FirstName: "Spankie", LastName: "Dee", Username: "spankie", Email: "spankie@gmail.com", Password: hash, Status: models.StatusActive}
+	client := &models.Client{ID: bson.NewObjectId(), Name: "Notes", Public: true, RedirectURIs: []string{"https://notes.example.com/callback"}}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, m := newTestServer(t)
+	sessions := expectSessions(m)
+	m.EXPECT().FindClientByID(client.ID.Hex()).Return(client, nil).AnyTimes()
+	m.EXPECT().FindUserByUsername("spankie").Return(user, nil).AnyTimes()
+	m.EXPECT().FindUserByEmail(user.Email).Return(user, nil).AnyTimes()
+	m.EXPECT().FindUserByID(user.ID.Hex()).Return(user, nil).AnyTimes()
+	m.EXPECT().TokenInBlacklist(gomock.Any()).Return(false).AnyTimes()
+	var code *models.AuthorizationCode
+	m.EXPECT().CreateAuthorizationCode(gomock.Any()).DoAndReturn(func(c *models.AuthorizationCode) (*models.AuthorizationCode, error) {
+		code = c
+		return c, nil
+	})
+	m.EXPECT().ConsumeAuthorizationCode(gomock.Any(), gomock.Any()).DoAndReturn(func(string, string) (*models.AuthorizationCode, error) {
+		return code, nil
+	})
+	s.PasswordHasher = hasher
+	s.SigningKey = key
+	s.Issuer = "http://auth.example.com"
+	router := s.setupRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/.well-known/openid-configuration", nil)
+	// the issuer doesn't come from the request
+	req.Host = "evil.example.com"
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	discovery := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &discovery); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "http://auth.example.com", discovery["issuer"])
+	assert.Equal(t, "http://auth.example.com/api/v1/oauth/token", discovery["token_endpoint"])
+	assert.Equal(t, []interface{}{"authorization_code", "refresh_token"}, discovery["grant_types_supported"])
+	assert.Equal(t, []interface{}{"email", "openid", "phone", "profile"}, discovery["scopes_supported"])
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ID.Hex()},
+		"scope":                 {"openid email"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {services.S256Challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/oauth/authorize?"+strings.Replace(params.Encode(), "email", "address", 1), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Contains(t, w.Header().Get("Location"), "error=invalid_scope")
+
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	w = consent(t, router, params, "spankie", "password")
+	assert.Equal(t, http.StatusFound, w.Code)
+	location, _ := url.Parse(w.Header().Get("Location"))
+	w = post("/api/v1/oauth/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {location.Query().Get("code")},
+		"client_id":     {client.ID.Hex()},
+		"code_verifier": {verifier},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	tokens := &struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), tokens); err != nil {
+		t.Fatal(err)
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(tokens.IDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		return &key.PublicKey, nil
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "http://auth.example.com", claims["iss"])
+		assert.Equal(t, client.ID.Hex(), claims["aud"])
+		assert.Equal(t, user.ID.Hex(), claims["sub"])
+		assert.Equal(t, "n-0S6_WzA2Mj", claims["nonce"])
+		assert.Equal(t, user.Email, claims["email"])
+	}
+
+	// only the claims of the granted scopes are returned
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	info := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]interface{}{"sub": user.ID.Hex(), "email": user.Email}, info)
+
+	// tokens from a plain login have no scope
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken(t, sessions, user))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestOpenIDConnectIsOffWithoutSigningKey(t *testing.T) {
+	client := &models.Client{ID: bson.NewObjectId(), Name: "Notes", Public: true, RedirectURIs: []string{"https://notes.example.com/callback"}}
+
+	s, m := newTestServer(t)
+	m.EXPECT().FindClientByID(client.ID.Hex()).Return(client, nil).AnyTimes()
+	s.Issuer = "http://auth.example.com"
+	router := s.setupRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/.well-known/openid-configuration", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	discovery := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &discovery); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []interface{}{"email", "phone", "profile"}, discovery["scopes_supported"])
+	assert.NotContains(t, discovery, "id_token_signing_alg_values_supported")
+	assert.NotContains(t, discovery, "userinfo_endpoint")
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ID.Hex()},
+		"scope":                 {"openid email"},
+		"code_challenge":        {services.S256Challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")},
+		"code_challenge_method": {"S256"},
+	}
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/oauth/authorize?"+params.Encode(), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Contains(t, w.Header().Get("Location"), "error=invalid_scope")
+}
+func TestRefreshPicksUpRoleChanges(t *testing.T) {
+	hasher := passwords.DefaultHasher()
+	hasher.Argon2.Memory = 1024
+	hash, err := hasher.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{ID: bson.NewObjectId(), Username: "spankie", Email: "spankie@gmail.com", Password: hash, Status: models.StatusActive, Roles: []string{rbac.RoleAdmin}}
+
+	s, m := newTestServer(t)
+	expectSessions(m)
+	m.EXPECT().FindUserByUsername("spankie").Return(user, nil)
+	m.EXPECT().FindUserByEmail(user.Email).Return(user, nil).AnyTimes()
+	m.EXPECT().TokenInBlacklist(gomock.Any()).Return(false).AnyTimes()
+	s.PasswordHasher = hasher
+	router := s.setupRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{"identifier":"spankie","password":"password"}`))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := &struct {
+		Data struct {
+			AccessToken  string `json:"access_token"`
+			RefreshToken string `json:"refresh_token"`
+		} `json:"data"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), body); err != nil {
+		t.Fatal(err)
+	}
+
+	// the admin role is taken away and the access token expires
+	user.Roles = nil
+	secret := os.Getenv("JWT_SECRET")
+	_, claims, err := services.AuthorizeToken(&body.Data.AccessToken, &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	expired, err := services.GenerateToken(jwt.SigningMethodHS256, claims, &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/me", strings.NewReader(`{"refresh_token":"`+body.Data.RefreshToken+`"}`))
+	req.Header.Set("Authorization", "Bearer "+*expired)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	refreshed := &struct {
+		Data struct {
+			AccessToken string `json:"access_token"`
+		} `json:"data"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), refreshed); err != nil {
+		t.Fatal(err)
+	}
+	_, claims, err = services.AuthorizeToken(&refreshed.Data.AccessToken, &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []interface{}{rbac.RoleUser}, claims["roles"])
+	assert.NotEmpty(t, claims["sid"])
+}
+
+func TestTokensCantBeUsedAsAnotherType(t *testing.T) {
+	user := &models.User{ID: bson.NewObjectId(), Email: "spankie@gmail.com", Status: models.StatusActive}
+
+	s, m := newTestServer(t)
+	m.EXPECT().TokenInBlacklist(gomock.Any()).Return(false).AnyTimes()
+	m.EXPECT().FindUserByEmail(user.Email).Return(user, nil).AnyTimes()
+	router := s.setupRouter()
+
+	secret := os.Getenv("JWT_SECRET")
+	invitation, err := services.GenerateToken(jwt.SigningMethodHS256, jwt.MapClaims{
+		"typ":           services.InvitationTokenType,
+		"invitation_id": bson.NewObjectId().Hex(),
+		"email":         user.Email,
+		"exp":           time.Now().Add(time.Hour).Unix(),
+	}, &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := services.AccessTokenClaims(user, "", time.Now())
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	expired, err := services.GenerateToken(jwt.SigningMethodHS256, claims, &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an invitation token is neither a refresh token
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/me", strings.NewReader(`{"refresh_token":"`+*invitation+`"}`))
+	req.Header.Set("Authorization", "Bearer "+*expired)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// nor an access token
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/me", nil)
+	req.Header.Set("Authorization", "Bearer "+*invitation)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// and access tokens must belong to a session
+	noSession, err := services.GenerateToken(jwt.SigningMethodHS256, services.AccessTokenClaims(user, "", time.Now()), &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/me", nil)
+	req.Header.Set("Authorization", "Bearer "+*noSession)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spankie/go-auth/audit"
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/server/middleware"
+	"github.com/spankie/go-auth/server/response"
+	"github.com/spankie/go-auth/services"
+)
+
+// startSession records a new session for user logging in from the device
+// of the request, lasting for validity
+func (s *Server) startSession(c *gin.Context, user *models.User, device string, validity time.Duration) (*models.Session, error) {
+	if device == "" {
+		device = services.DeviceName(c.Request.UserAgent())
+	}
+	now := time.Now()
+	return s.DB.CreateSession(&models.Session{
+		UserID:     user.ID,
+		Device:     device,
+		IP:         middleware.ClientIP(c),
+		UserAgent:  c.Request.UserAgent(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(validity),
+	})
+}
+
+// handleListSessions lists the active sessions of the user
+func (s *Server) handleListSessions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userI, _ := c.Get("user")
+		user, ok := userI.(*models.User)
+		if !ok {
+			log.Printf("can't get user from context\n")
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		sessions, err := s.DB.FindUserSessions(user.ID.Hex())
+		if err != nil {
+			log.Printf("find sessions error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+
+		type session struct {
+			models.Session
+			Current bool `json:"current"`
+		}
+		list := make([]session, 0, len(sessions))
+		for _, s := range sessions {
+			list = append(list, session{s, s.ID.Hex() == c.GetString("session_id")})
+		}
+		response.JSON(c, "retrieved sessions successfully", http.StatusOK, gin.H{"sessions": list}, nil)
+	}
+}
+
+// handleRevokeSession logs the user out of one of their sessions
+func (s *Server) handleRevokeSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userI, _ := c.Get("user")
+		user, ok := userI.(*models.User)
+		if !ok {
+			log.Printf("can't get user from context\n")
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		session, err := s.DB.FindSessionByID(c.Param("id"))
+		if err != nil || session.UserID != user.ID || !session.IsActive() {
+			log.Printf("find session error: %v\n", err)
+			response.JSON(c, "", http.StatusNotFound, nil, []string{"session not found"})
+			return
+		}
+		if err := s.DB.RevokeSession(session.ID.Hex()); err != nil {
+			log.Printf("revoke session error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		s.audit(c, &audit.Event{
+			Type:    audit.Logout,
+			Outcome: audit.Success,
+			Subject: user.Email,
+			Details: map[string]string{"session_id": session.ID.Hex()},
+		})
+		response.JSON(c, "session revoked successfully", http.StatusOK, nil, nil)
+	}
+}
+
+// handleRevokeAllSessions logs the user out everywhere, including from
+// the session of the request
+func (s *Server) handleRevokeAllSessions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userI, _ := c.Get("user")
+		user, ok := userI.(*models.User)
+		if !ok {
+			log.Printf("can't get user from context\n")
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		if err := s.DB.RevokeUserSessions(user.ID.Hex()); err != nil {
+			log.Printf("revoke sessions error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		// also catch tokens issued without a session
+		if err := s.DB.RevokeUserTokens(user.ID.Hex(), time.Now()); err != nil {
+			log.Printf("revoke user tokens error: %v\n", err)
+			response.JSON(c, "", http.StatusInternalServerError, nil, []string{"internal server error"})
+			return
+		}
+		if services.CookieMode() {
+			services.ClearTokenCookies(c)
+		}
+		s.audit(c, &audit.Event{
+			Type:    audit.Logout,
+			Outcome: audit.Success,
+			Subject: user.Email,
+			Details: map[string]string{"everywhere": "true"},
+		})
+		response.JSON(c, "logged out everywhere", http.StatusOK, nil, nil)
+	}
+}
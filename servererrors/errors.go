@@ -7,25 +7,29 @@ import (
 	validator "github.com/go-playground/validator/v10"
 )
 
-// FieldError wraps around the validator error so it
-// can be used and caught specifically
+// FieldError describes a field that failed validation, either
+// in the validator or in a rule checked by hand, so it can be
+// used and caught specifically
 type FieldError struct {
-	err validator.FieldError
+	field string
+	tag   string
+	param string
+	value interface{}
 }
 
 func (q FieldError) String() string {
 	var sb strings.Builder
 
-	sb.WriteString("validation failed on field '" + q.err.Field() + "'")
-	sb.WriteString(", condition: " + q.err.ActualTag())
+	sb.WriteString("validation failed on field '" + q.field + "'")
+	sb.WriteString(", condition: " + q.tag)
 
 	// Print condition parameters, e.g. oneof=red blue -> { red blue }
-	if q.err.Param() != "" {
-		sb.WriteString(" { " + q.err.Param() + " }")
+	if q.param != "" {
+		sb.WriteString(" { " + q.param + " }")
 	}
 
-	if q.err.Value() != nil && q.err.Value() != "" {
-		sb.WriteString(fmt.Sprintf(", actual: %v", q.err.Value()))
+	if q.value != nil && q.value != "" {
+		sb.WriteString(fmt.Sprintf(", actual: %v", q.value))
 	}
 
 	return sb.String()
@@ -33,7 +37,28 @@ func (q FieldError) String() string {
 
 //NewFieldError returns a field error
 func NewFieldError(err validator.FieldError) FieldError {
-	return FieldError{err: err}
+	return FieldError{field: err.Field(), tag: err.ActualTag(), param: err.Param(), value: err.Value()}
+}
+
+// NewRuleError returns a field error for a rule that is checked outside
+// of the validator, like the password policy
+func NewRuleError(field, condition, param string) FieldError {
+	return FieldError{field: field, tag: condition, param: param}
+}
+
+// WithValue returns a copy of the error reporting value as the actual value
+func (q FieldError) WithValue(value interface{}) FieldError {
+	q.value = value
+	return q
+}
+
+// FieldErrorStrings converts field errors to the strings sent in responses
+func FieldErrorStrings(errs []FieldError) []string {
+	strs := make([]string, len(errs))
+	for i, err := range errs {
+		strs[i] = err.String()
+	}
+	return strs
 }
 
 // InActiveUserError defines an inactive user error
@@ -11,6 +11,21 @@ import (
 const AccessTokenValidity = time.Minute * 20
 const RefreshTokenValidity = time.Hour * 24
 
+// Token types, set as the typ claim of every token signed with JWT_SECRET
+// so that one kind of token can't be used as another
+const (
+	AccessTokenType        = "access"
+	RefreshTokenType       = "refresh"
+	InvitationTokenType    = "invitation"
+	ImpersonationTokenType = "impersonation"
+)
+
+// TokenType returns the typ claim of a token
+func TokenType(claims jwt.MapClaims) string {
+	typ, _ := claims["typ"].(string)
+	return typ
+}
+
 // GetTokenFromHeader returns the token string in the authorization header
 func GetTokenFromHeader(c *gin.Context) string {
 	authHeader := c.Request.Header.Get("Authorization")
@@ -56,3 +71,28 @@ func GenerateToken(signMethod *jwt.SigningMethodHMAC, claims jwt.MapClaims, secr
 	}
 	return &tokenString, nil
 }
+
+// StringsClaim returns a claim holding a list of strings
+func StringsClaim(claims jwt.MapClaims, name string) []string {
+	switch values := claims[name].(type) {
+	case []string:
+		return values
+	case []interface{}:
+		strs := make([]string, 0, len(values))
+		for _, v := range values {
+			if s, ok := v.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+		return strs
+	}
+	return nil
+}
+
+// ActorClaim returns the subject of the act claim of a token issued to
+// someone acting on behalf of the user, as described in RFC 8693
+func ActorClaim(claims jwt.MapClaims) string {
+	act, _ := claims["act"].(map[string]interface{})
+	sub, _ := act["sub"].(string)
+	return sub
+}
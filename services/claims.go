@@ -0,0 +1,32 @@
+package services
+
+import (
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/spankie/go-auth/models"
+	"github.com/spankie/go-auth/rbac"
+)
+
+// AccessTokenClaims returns the claims of an access token for user acting
+// for the organization with the hex ID orgID, which may be empty. The
+// roles claim only holds the global roles of the user. The roles they
+// have in the organization are kept apart in the org_roles claim, as they
+// only apply to the resources of the organization.
+func AccessTokenClaims(user *models.User, orgID string, authTime time.Time) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"typ":         AccessTokenType,
+		"user_email":  user.Email,
+		"exp":         time.Now().Add(AccessTokenValidity).Unix(),
+		"auth_time":   authTime.Unix(),
+		"roles":       rbac.UserRoles(user.Roles),
+		"permissions": user.Permissions,
+	}
+	if orgID != "" {
+		claims["org_id"] = orgID
+		if membership := user.Membership(orgID); membership != nil {
+			claims["org_roles"] = membership.Roles
+		}
+	}
+	return claims
+}
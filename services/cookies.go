@@ -0,0 +1,106 @@
+package services
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Names of the cookies holding the tokens in cookie mode
+const (
+	AccessTokenCookie  = "access_token"
+	RefreshTokenCookie = "refresh_token"
+)
+
+// AuthorizeFormCookie holds the token the login and consent page of the
+// authorization endpoint must be submitted with
+const AuthorizeFormCookie = "authorize_form"
+
+// CookieSettings describes how token cookies are set
+type CookieSettings struct {
+	Domain   string
+	Secure   bool
+	SameSite http.SameSite
+}
+
+// CookieMode reports whether tokens should be sent to clients in cookies
+// instead of the response body. It is enabled with AUTH_COOKIES=true.
+func CookieMode() bool {
+	return os.Getenv("AUTH_COOKIES") == "true"
+}
+
+// GetCookieSettings returns the cookie settings from the AUTH_COOKIE_DOMAIN,
+// AUTH_COOKIE_SAMESITE (strict, lax or none) and AUTH_COOKIE_INSECURE env
+// vars. Cookies are Secure and SameSite=Lax by default.
+func GetCookieSettings() CookieSettings {
+	settings := CookieSettings{
+		Domain:   os.Getenv("AUTH_COOKIE_DOMAIN"),
+		Secure:   os.Getenv("AUTH_COOKIE_INSECURE") != "true",
+		SameSite: http.SameSiteLaxMode,
+	}
+	switch strings.ToLower(os.Getenv("AUTH_COOKIE_SAMESITE")) {
+	case "strict":
+		settings.SameSite = http.SameSiteStrictMode
+	case "none":
+		// browsers reject SameSite=None cookies that aren't Secure
+		settings.SameSite = http.SameSiteNoneMode
+		settings.Secure = true
+	}
+	return settings
+}
+
+// SetTokenCookie sets a HttpOnly cookie holding token
+func SetTokenCookie(c *gin.Context, name, token string, maxAge int) {
+	setCookie(c, name, token, maxAge, true)
+}
+
+// SetCSRFCookie sets the cookie holding the CSRF token. Scripts need to
+// read it, so it isn't HttpOnly.
+func SetCSRFCookie(c *gin.Context, token string, maxAge int) {
+	setCookie(c, CSRFTokenCookie, token, maxAge, false)
+}
+
+// ClearTokenCookies removes the token and CSRF cookies from the client
+func ClearTokenCookies(c *gin.Context) {
+	SetTokenCookie(c, AccessTokenCookie, "", -1)
+	SetTokenCookie(c, RefreshTokenCookie, "", -1)
+	SetCSRFCookie(c, "", -1)
+}
+
+func setCookie(c *gin.Context, name, value string, maxAge int, httpOnly bool) {
+	settings := GetCookieSettings()
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   settings.Domain,
+		MaxAge:   maxAge,
+		Secure:   settings.Secure,
+		HttpOnly: httpOnly,
+		SameSite: settings.SameSite,
+	})
+}
+
+// GetTokenFromCookie returns the token in the cookie called name, or an
+// empty string if cookie mode is off or there is no such cookie
+func GetTokenFromCookie(c *gin.Context, name string) string {
+	if !CookieMode() {
+		return ""
+	}
+	token, err := c.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return token
+}
+
+// GetAccessToken returns the access token from the authorization header,
+// or from the access token cookie when there is no header
+func GetAccessToken(c *gin.Context) string {
+	if token := GetTokenFromHeader(c); token != "" {
+		return token
+	}
+	return GetTokenFromCookie(c, AccessTokenCookie)
+}
@@ -0,0 +1,50 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// CSRF tokens are sent to clients in a cookie scripts can read and must be
+// sent back in a header, which other sites can't do
+const (
+	CSRFTokenCookie = "csrf_token"
+	CSRFTokenHeader = "X-CSRF-Token"
+)
+
+// NewCSRFToken returns a random token signed with secret for the session
+// with the ID sessionID. Tokens are only valid for their session, so a
+// token an attacker got by logging in themselves and planted from another
+// subdomain can't be used to pass the check on someone else's session.
+func NewCSRFToken(secret, sessionID string) (string, error) {
+	token, err := RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	return token + "." + signCSRFToken(token, secret, sessionID), nil
+}
+
+// ValidCSRFToken reports whether the token in the header matches the one
+// in the cookie and was signed with secret for the session with the ID
+// sessionID
+func ValidCSRFToken(cookie, header, secret, sessionID string) bool {
+	if sessionID == "" {
+		return false
+	}
+	if cookie == "" || !hmac.Equal([]byte(cookie), []byte(header)) {
+		return false
+	}
+	parts := strings.SplitN(cookie, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	return hmac.Equal([]byte(parts[1]), []byte(signCSRFToken(parts[0], secret, sessionID)))
+}
+
+func signCSRFToken(token, secret, sessionID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("csrf:" + sessionID + ":" + token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,42 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidCSRFToken(t *testing.T) {
+	token, err := NewCSRFToken("secret", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewCSRFToken("secret", "session")
+	assert.NotEqual(t, token, other)
+	forged := strings.SplitN(token, ".", 2)[0] + "." + strings.Repeat("0", 64)
+
+	tests := []struct {
+		name      string
+		cookie    string
+		header    string
+		secret    string
+		sessionID string
+		valid     bool
+	}{
+		{name: "valid", cookie: token, header: token, secret: "secret", sessionID: "session", valid: true},
+		{name: "header doesn't match the cookie", cookie: token, header: other, secret: "secret", sessionID: "session"},
+		{name: "no header", cookie: token, header: "", secret: "secret", sessionID: "session"},
+		{name: "no cookie", cookie: "", header: "", secret: "secret", sessionID: "session"},
+		{name: "other session", cookie: token, header: token, secret: "secret", sessionID: "other"},
+		{name: "no session", cookie: token, header: token, secret: "secret", sessionID: ""},
+		{name: "other secret", cookie: token, header: token, secret: "other", sessionID: "session"},
+		{name: "forged signature", cookie: forged, header: forged, secret: "secret", sessionID: "session"},
+		{name: "unsigned", cookie: "token", header: "token", secret: "secret", sessionID: "session"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.valid, ValidCSRFToken(tt.cookie, tt.header, tt.secret, tt.sessionID))
+		})
+	}
+}
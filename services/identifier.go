@@ -0,0 +1,98 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// IdentifierKind describes what a login identifier refers to
+type IdentifierKind int
+
+const (
+	// UsernameIdentifier is an identifier that should be matched against usernames
+	UsernameIdentifier IdentifierKind = iota
+	// EmailIdentifier is an identifier that should be matched against emails
+	EmailIdentifier
+	// PhoneIdentifier is an identifier that should be matched against phone numbers
+	PhoneIdentifier
+)
+
+// ParseIdentifier works out whether identifier is a username, an email or a
+// phone number and returns it in its normalized form
+func ParseIdentifier(identifier string) (string, IdentifierKind) {
+	identifier = strings.TrimSpace(identifier)
+	if strings.Contains(identifier, "@") {
+		return NormalizeEmail(identifier), EmailIdentifier
+	}
+	if looksLikePhone(identifier) {
+		if phone, err := NormalizePhone(identifier); err == nil {
+			return phone, PhoneIdentifier
+		}
+	}
+	return identifier, UsernameIdentifier
+}
+
+// NormalizeEmail trims and lowercases an email address
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// NormalizePhone converts phone to the E.164 format (+<country code><number>).
+// Numbers in the national format (leading 0) are converted using the
+// DEFAULT_PHONE_COUNTRY_CODE env var, and are rejected when it isn't set
+func NormalizePhone(phone string) (string, error) {
+	var sb strings.Builder
+	for i, r := range strings.TrimSpace(phone) {
+		switch {
+		case r >= '0' && r <= '9':
+			sb.WriteRune(r)
+		case r == '+' && i == 0:
+			sb.WriteRune(r)
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return "", fmt.Errorf("invalid character %q in phone number", r)
+		}
+	}
+	number := sb.String()
+
+	switch {
+	case strings.HasPrefix(number, "+"):
+	case strings.HasPrefix(number, "00"):
+		number = "+" + number[2:]
+	case strings.HasPrefix(number, "0"):
+		countryCode := strings.TrimPrefix(os.Getenv("DEFAULT_PHONE_COUNTRY_CODE"), "+")
+		if countryCode == "" {
+			return "", fmt.Errorf("phone number has no country code")
+		}
+		number = "+" + countryCode + number[1:]
+	default:
+		number = "+" + number
+	}
+
+	// E.164 numbers have at most 15 digits, and no country uses less than 7
+	if digits := len(number) - 1; digits < 7 || digits > 15 || number[1] == '0' {
+		return "", fmt.Errorf("invalid phone number")
+	}
+	return number, nil
+}
+
+// looksLikePhone reports whether s only contains characters used when
+// writing phone numbers
+func looksLikePhone(s string) bool {
+	if s == "" {
+		return false
+	}
+	digits := 0
+	for i, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+		case r == '+' && i == 0:
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return false
+		}
+	}
+	return digits > 0
+}
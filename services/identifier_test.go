@@ -0,0 +1,89 @@
+package services
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	os.Setenv("DEFAULT_PHONE_COUNTRY_CODE", "+234")
+	defer os.Unsetenv("DEFAULT_PHONE_COUNTRY_CODE")
+
+	tests := []struct {
+		phone      string
+		normalized string
+		wantErr    bool
+	}{
+		{phone: "+2348909876787", normalized: "+2348909876787"},
+		{phone: " 0890 987 6787 ", normalized: "+2348909876787"},
+		{phone: "(0890) 987-6787", normalized: "+2348909876787"},
+		{phone: "0890.987.6787", normalized: "+2348909876787"},
+		{phone: "002348909876787", normalized: "+2348909876787"},
+		{phone: "2348909876787", normalized: "+2348909876787"},
+		{phone: "+1 (415) 555-0100", normalized: "+14155550100"},
+		{phone: "", wantErr: true},
+		{phone: "123456", wantErr: true},
+		{phone: "+1234567890123456", wantErr: true},
+		{phone: "+0123456789", wantErr: true},
+		{phone: "0890+9876787", wantErr: true},
+		{phone: "0890/987/6787", wantErr: true},
+		{phone: "0890 CALL ME", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.phone, func(t *testing.T) {
+			normalized, err := NormalizePhone(tt.phone)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.normalized, normalized)
+		})
+	}
+}
+
+func TestNormalizePhoneWithoutDefaultCountryCode(t *testing.T) {
+	os.Unsetenv("DEFAULT_PHONE_COUNTRY_CODE")
+	_, err := NormalizePhone("0890 987 6787")
+	assert.Error(t, err)
+
+	normalized, err := NormalizePhone("+234 890 987 6787")
+	assert.NoError(t, err)
+	assert.Equal(t, "+2348909876787", normalized)
+}
+
+func TestParseIdentifier(t *testing.T) {
+	tests := []struct {
+		name        string
+		countryCode string
+		identifier  string
+		normalized  string
+		kind        IdentifierKind
+	}{
+		{name: "username", identifier: " Spankie ", normalized: "Spankie", kind: UsernameIdentifier},
+		{name: "email", identifier: " Spankie@Gmail.com ", normalized: "spankie@gmail.com", kind: EmailIdentifier},
+		{name: "international phone", identifier: "+234 890 987 6787", normalized: "+2348909876787", kind: PhoneIdentifier},
+		{name: "national phone", countryCode: "234", identifier: "0890-987-6787", normalized: "+2348909876787", kind: PhoneIdentifier},
+		{name: "national phone without a default country code", identifier: "0890-987-6787", normalized: "0890-987-6787", kind: UsernameIdentifier},
+		// numeric usernames are looked up as phones first, see
+		// findUserByIdentifier
+		{name: "numeric username", identifier: "12345678", normalized: "+12345678", kind: PhoneIdentifier},
+		{name: "short numeric username", identifier: "1234", normalized: "1234", kind: UsernameIdentifier},
+		{name: "punctuation only", identifier: "-.-", normalized: "-.-", kind: UsernameIdentifier},
+		{name: "username with digits", identifier: "spankie2020", normalized: "spankie2020", kind: UsernameIdentifier},
+		{name: "username with punctuation", identifier: "spankie.dee", normalized: "spankie.dee", kind: UsernameIdentifier},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.countryCode != "" {
+				os.Setenv("DEFAULT_PHONE_COUNTRY_CODE", tt.countryCode)
+				defer os.Unsetenv("DEFAULT_PHONE_COUNTRY_CODE")
+			}
+			normalized, kind := ParseIdentifier(tt.identifier)
+			assert.Equal(t, tt.normalized, normalized)
+			assert.Equal(t, tt.kind, kind)
+		})
+	}
+}
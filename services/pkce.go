@@ -0,0 +1,32 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"regexp"
+)
+
+// codeVerifierPattern matches the code verifiers allowed by RFC 7636
+var codeVerifierPattern = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// codeChallengePattern matches S256 code challenges, the unpadded
+// base64url encoding of a SHA-256 hash
+var codeChallengePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+// ValidCodeChallenge reports whether challenge is a well formed S256 code
+// challenge
+func ValidCodeChallenge(challenge string) bool {
+	return codeChallengePattern.MatchString(challenge)
+}
+
+// S256Challenge returns the S256 PKCE code challenge of verifier
+func S256Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// VerifyCodeChallenge reports whether verifier is well formed and matches
+// the S256 code challenge
+func VerifyCodeChallenge(verifier, challenge string) bool {
+	return codeVerifierPattern.MatchString(verifier) && S256Challenge(verifier) == challenge
+}
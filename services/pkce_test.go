@@ -0,0 +1,58 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the example of RFC 7636 appendix B
+const (
+	rfc7636Verifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	rfc7636Challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+func TestS256Challenge(t *testing.T) {
+	assert.Equal(t, rfc7636Challenge, S256Challenge(rfc7636Verifier))
+}
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	long := strings.Repeat("a", 128)
+	tests := []struct {
+		name      string
+		verifier  string
+		challenge string
+		valid     bool
+	}{
+		{name: "rfc 7636", verifier: rfc7636Verifier, challenge: rfc7636Challenge, valid: true},
+		{name: "longest verifier", verifier: long, challenge: S256Challenge(long), valid: true},
+		{name: "other verifier", verifier: strings.Repeat("a", 43), challenge: rfc7636Challenge, valid: false},
+		{name: "plain challenge", verifier: rfc7636Verifier, challenge: rfc7636Verifier, valid: false},
+		{name: "verifier too short", verifier: "short", challenge: S256Challenge("short"), valid: false},
+		{name: "verifier too long", verifier: long + "a", challenge: S256Challenge(long + "a"), valid: false},
+		{name: "invalid characters", verifier: rfc7636Verifier[:42] + "+", challenge: S256Challenge(rfc7636Verifier[:42] + "+"), valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.valid, VerifyCodeChallenge(tt.verifier, tt.challenge))
+		})
+	}
+}
+
+func TestValidCodeChallenge(t *testing.T) {
+	tests := []struct {
+		challenge string
+		valid     bool
+	}{
+		{challenge: rfc7636Challenge, valid: true},
+		{challenge: rfc7636Challenge[:42], valid: false},
+		{challenge: rfc7636Challenge + "A", valid: false},
+		{challenge: rfc7636Challenge + "=", valid: false},
+		{challenge: strings.Replace(rfc7636Challenge, "-", "+", 1), valid: false},
+		{challenge: "", valid: false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.valid, ValidCodeChallenge(tt.challenge), tt.challenge)
+	}
+}